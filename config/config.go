@@ -23,12 +23,53 @@ type Config struct {
 		DB        int      `json:"db"`
 	} `json:"redis"`
 
+	Storage struct {
+		Backend          string        `json:"backend"`           // "redis", "memory" or "disk"
+		Path             string        `json:"path"`              // Data directory for the disk backend
+		SnapshotInterval time.Duration `json:"snapshot_interval"` // How often the disk backend compacts its log and the memory backend sweeps stale state
+	} `json:"storage"`
+
+	Clock struct {
+		Source string `json:"source"` // "local" (app clock) or "redis" (Redis server TIME)
+	} `json:"clock"`
+
 	RateLimit struct {
 		DefaultCapacity int64         `json:"default_capacity"`
 		DefaultRefill   time.Duration `json:"default_refill"`
 		Algorithm       string        `json:"algorithm"` // "token_bucket" or "leaky_bucket"
 	} `json:"rate_limit"`
 
+	HealthCheck struct {
+		Interval           time.Duration `json:"interval"`            // How often every Redis instance is pinged
+		Timeout            time.Duration `json:"timeout"`             // Timeout for a single ping
+		HealthyThreshold   int           `json:"healthy_threshold"`   // Consecutive successes before marking healthy
+		UnhealthyThreshold int           `json:"unhealthy_threshold"` // Consecutive failures before marking unhealthy
+	} `json:"health_check"`
+
+	CircuitBreaker struct {
+		ErrorThreshold   float64       `json:"error_threshold"`    // Failure ratio that opens a shard's breaker
+		MinRequests      int           `json:"min_requests"`       // Requests in the window before the ratio counts
+		Window           time.Duration `json:"window"`             // Error counting window
+		Cooldown         time.Duration `json:"cooldown"`           // How long an open breaker fails fast
+		HalfOpenRequests int           `json:"half_open_requests"` // Successful probes needed to close again
+	} `json:"circuit_breaker"`
+
+	Fallback struct {
+		MaxBuckets int           `json:"max_buckets"` // Cap on in-memory buckets per algorithm
+		IdleTTL    time.Duration `json:"idle_ttl"`    // Idle buckets older than this are evicted
+		Shards     int           `json:"shards"`      // Number of independently locked shards
+	} `json:"fallback"`
+
+	Policy struct {
+		File     string `json:"file"`      // Optional JSON file with per-key policies
+		FailMode string `json:"fail_mode"` // "allow", "deny" or "local" when the backend errors
+	} `json:"policy"`
+
+	Cost struct {
+		File            string `json:"file"`              // Optional JSON file with per-operation token costs
+		MaxClientTokens int64  `json:"max_client_tokens"` // Cap on client-supplied costs when no cost table is configured
+	} `json:"cost"`
+
 	JWT struct {
 		Secret string `json:"secret"`
 	} `json:"jwt"`
@@ -61,11 +102,45 @@ func (c *Config) loadFromEnv() {
 	c.Redis.Password = getEnv("REDIS_PASSWORD", "")
 	c.Redis.DB = getEnvInt("REDIS_DB", 0)
 
+	// Storage backend config
+	c.Storage.Backend = getEnv("STORAGE_BACKEND", "redis")
+	c.Storage.Path = getEnv("STORAGE_PATH", "data")
+	c.Storage.SnapshotInterval = getEnvDuration("STORAGE_SNAPSHOT_INTERVAL", time.Minute)
+
+	// Time source for the Redis scripts
+	c.Clock.Source = getEnv("CLOCK_SOURCE", "local")
+
+	// Redis health check config
+	c.HealthCheck.Interval = getEnvDuration("HEALTH_CHECK_INTERVAL", 5*time.Second)
+	c.HealthCheck.Timeout = getEnvDuration("HEALTH_CHECK_TIMEOUT", time.Second)
+	c.HealthCheck.HealthyThreshold = getEnvInt("HEALTH_CHECK_HEALTHY_THRESHOLD", 2)
+	c.HealthCheck.UnhealthyThreshold = getEnvInt("HEALTH_CHECK_UNHEALTHY_THRESHOLD", 3)
+
+	// Circuit breaker config
+	c.CircuitBreaker.ErrorThreshold = getEnvFloat64("BREAKER_ERROR_THRESHOLD", 0.5)
+	c.CircuitBreaker.MinRequests = getEnvInt("BREAKER_MIN_REQUESTS", 10)
+	c.CircuitBreaker.Window = getEnvDuration("BREAKER_WINDOW", 10*time.Second)
+	c.CircuitBreaker.Cooldown = getEnvDuration("BREAKER_COOLDOWN", 5*time.Second)
+	c.CircuitBreaker.HalfOpenRequests = getEnvInt("BREAKER_HALF_OPEN_REQUESTS", 1)
+
 	// Rate limiter config
 	c.RateLimit.DefaultCapacity = getEnvInt64("DEFAULT_CAPACITY", 100)
 	c.RateLimit.DefaultRefill = getEnvDuration("DEFAULT_REFILL_RATE", time.Second)
 	c.RateLimit.Algorithm = getEnv("ALGORITHM", "token_bucket")
 
+	// In-memory fallback store config
+	c.Fallback.MaxBuckets = getEnvInt("FALLBACK_MAX_BUCKETS", 100000)
+	c.Fallback.IdleTTL = getEnvDuration("FALLBACK_IDLE_TTL", 10*time.Minute)
+	c.Fallback.Shards = getEnvInt("FALLBACK_SHARDS", 16)
+
+	// Policy config
+	c.Policy.File = getEnv("POLICY_FILE", "")
+	c.Policy.FailMode = getEnv("FAIL_MODE", "local")
+
+	// Request cost config
+	c.Cost.File = getEnv("COST_FILE", "")
+	c.Cost.MaxClientTokens = getEnvInt64("COST_MAX_CLIENT_TOKENS", 100)
+
 	// JWT config
 	c.JWT.Secret = getEnv("JWT_SECRET", "your-secret-key-change-in-production")
 }
@@ -99,6 +174,15 @@ func getEnvInt64(key string, defaultValue int64) int64 {
 	return defaultValue
 }
 
+func getEnvFloat64(key string, defaultValue float64) float64 {
+	if value := os.Getenv(key); value != "" {
+		if floatVal, err := strconv.ParseFloat(value, 64); err == nil {
+			return floatVal
+		}
+	}
+	return defaultValue
+}
+
 func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
 	if value := os.Getenv(key); value != "" {
 		if duration, err := time.ParseDuration(value); err == nil {
@@ -1,8 +1,11 @@
 package handlers
 
 import (
-	"encoding/json"
+	"errors"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/Appy29/rate-limiter/middleware"
 	"github.com/Appy29/rate-limiter/models"
@@ -42,42 +45,223 @@ func (h *Handlers) AcquireHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var req models.AcquireRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		logger.Error("Failed to decode JSON", err)
-		utils.SendError(w, http.StatusBadRequest, "Invalid JSON body")
+	if err := utils.DecodeJSON(w, r, &req); err != nil {
+		logger.Warn("Invalid request body", "error", err.Error())
+		utils.SendValidationError(w, err)
+		return
+	}
+	if err := checkKey(req.Key, userID); err != nil {
+		logger.Warn("Key does not match the JWT", "user_id", userID, "key", req.Key)
+		utils.SendValidationError(w, err)
+		return
+	}
+	if err := req.Validate(); err != nil {
+		logger.Warn("Invalid acquire request", "user_id", userID, "error", err.Error())
+		utils.SendValidationError(w, err)
 		return
 	}
 
-	// Override key with user ID from JWT
+	// The key comes from the JWT
 	req.Key = userID
 
-	// Validate and set defaults
-	if req.Tokens <= 0 {
-		req.Tokens = 1 // default to 1 token
+	// The server prices the request; client-supplied tokens are ignored for priced operations
+	tokens, err := h.RateLimiter.ResolveCost(req)
+	if err != nil {
+		logger.Warn("Invalid acquire request", "user_id", userID, "error", err.Error())
+		utils.SendValidationError(w, err)
+		return
+	}
+	if tokens != req.RequestedTokens() {
+		logger.Info("Applied server-side cost", "operation", req.Operation, "client_tokens", req.RequestedTokens(), "tokens", tokens)
 	}
 
-	if req.Algorithm == "" {
-		req.Algorithm = "token_bucket" // default algorithm
+	// The key's policy picks the algorithm, so a throttled client cannot switch to a fresh bucket
+	policy := h.RateLimiter.ResolvePolicy(req.Key)
+	algorithm, err := policy.RequestAlgorithm(req.Algorithm)
+	if err != nil {
+		logger.Warn("Algorithm override rejected", "user_id", userID, "algorithm", req.Algorithm)
+		utils.SendValidationError(w, err)
+		return
+	}
+	req.Algorithm = algorithm
+
+	// A request larger than the bucket would be rejected forever; say so instead of 429
+	bound := policy
+	if req.Algorithm == "fair_share" && policy.Pool != "" {
+		bound = h.RateLimiter.ResolvePolicy(policy.Pool) // a share never exceeds its pool
+	}
+	if err := bound.CheckTokens(req.Algorithm, tokens); err != nil {
+		logger.Warn("Invalid acquire request", "user_id", userID, "error", err.Error())
+		utils.SendValidationError(w, err)
+		return
 	}
 
+	// Clients may lower their priority but only the JWT claim grants critical
+	priority, err := models.EffectivePriority(req.Priority, middleware.GetPriorityFromContext(r.Context()))
+	if err != nil {
+		logger.Warn("Priority not granted", "user_id", userID, "priority", req.Priority)
+		utils.SendValidationError(w, err)
+		return
+	}
+	req.Priority = priority
+
 	logger.Info("Processing acquire request",
 		"user_id", userID,
-		"tokens", req.Tokens,
+		"tokens", tokens,
 		"algorithm", req.Algorithm,
+		"priority", req.Priority,
 	)
 
+	// Nested quotas (user -> team -> org) are consumed together or not at all, whatever
+	// the algorithm of the user's own level
+	quotas, err := h.RateLimiter.QuotaChain(req.Key, middleware.GetQuotaParentsFromContext(r.Context()))
+	if err != nil {
+		logger.Warn("Quota claims rejected", "user_id", userID, "error", err.Error())
+		utils.SendValidationError(w, err)
+		return
+	}
+	hierarchical := len(quotas) > 1
+
+	// Leaky buckets in shaping mode hand out start times instead of plain yes/no
+	if req.Algorithm == "leaky_bucket" && policy.Mode == models.LeakyModeShape {
+		h.scheduleRequest(w, r, req, quotas, tokens)
+		return
+	}
+
 	// Use the rate limiter service with user ID as key
-	allowed := h.RateLimiter.Acquire(req.Key, req.Tokens, req.Algorithm)
+	var allowed bool
+	if hierarchical {
+		allowed, err = h.RateLimiter.AcquireHierarchy(quotas, tokens, req.Algorithm, req.Priority)
+	} else {
+		allowed, err = h.RateLimiter.Acquire(req.Key, tokens, req.Algorithm, req.Priority)
+	}
+
+	// Backend failed to decide - apply the fail mode from the key's policy
+	degraded := err != nil
+	if degraded {
+		failMode := policy.FailMode
+		logger.Error("Rate limiter backend error", err, "user_id", userID, "fail_mode", failMode)
+
+		switch failMode {
+		case models.FailModeAllow:
+			allowed = true
+		case models.FailModeDeny:
+			utils.SendBackendUnavailable(w)
+			return
+		default:
+			if hierarchical {
+				allowed = h.RateLimiter.AcquireHierarchyLocal(quotas, tokens, req.Algorithm, req.Priority)
+			} else {
+				allowed = h.RateLimiter.AcquireLocal(req.Key, tokens, req.Algorithm, req.Priority)
+			}
+		}
+	}
 
 	if allowed {
-		logger.Info("Request allowed", "user_id", userID)
-		utils.SendAcquireSuccess(w)
+		logger.Info("Request allowed", "user_id", userID, "degraded", degraded)
+		utils.SendAcquireSuccess(w, degraded)
 	} else {
-		logger.Warn("Request rate limited", "user_id", userID, "tokens_requested", req.Tokens)
-		utils.SendRateLimited(w, nil) // We'll calculate retry-after later
+		logger.Warn("Request rate limited", "user_id", userID, "tokens_requested", tokens, "degraded", degraded)
+		utils.SendRateLimited(w, h.penaltyRetryAfter(req.Key), degraded)
 	}
 }
 
+// scheduleRequest admits the request into the key's drip schedule and reports its start time.
+// With wait set, the response is held until the start time (or until the client goes away).
+func (h *Handlers) scheduleRequest(w http.ResponseWriter, r *http.Request, req models.AcquireRequest, quotas []string, tokens int64) {
+	logger := utils.GetLoggerFromContext(r.Context())
+
+	startAt, allowed, err := h.RateLimiter.Schedule(quotas, tokens, req.Priority)
+
+	// Backend failed to decide - apply the fail mode from the key's policy
+	degraded := err != nil
+	if degraded {
+		failMode := h.RateLimiter.ResolvePolicy(req.Key).FailMode
+		logger.Error("Rate limiter backend error", err, "user_id", req.Key, "fail_mode", failMode)
+
+		switch failMode {
+		case models.FailModeAllow:
+			startAt, allowed = time.Now(), true
+		case models.FailModeDeny:
+			utils.SendBackendUnavailable(w)
+			return
+		default:
+			startAt, allowed = h.RateLimiter.ScheduleLocal(quotas, tokens, req.Priority)
+		}
+	}
+
+	if !allowed {
+		logger.Warn("Request rate limited", "user_id", req.Key, "tokens_requested", tokens, "degraded", degraded)
+
+		// Rejected for waiting longer than the max wait: retry once the schedule has drained enough
+		retryAfter := h.penaltyRetryAfter(req.Key)
+		if retryAfter == nil && !startAt.IsZero() {
+			seconds := max(1, int(math.Ceil(time.Until(startAt).Seconds())))
+			retryAfter = &seconds
+		}
+		utils.SendRateLimited(w, retryAfter, degraded)
+		return
+	}
+
+	logger.Info("Request scheduled", "user_id", req.Key, "scheduled_at", startAt, "degraded", degraded)
+
+	if req.Wait {
+		if delay := time.Until(startAt); delay > 0 {
+			timer := time.NewTimer(delay)
+			defer timer.Stop()
+
+			select {
+			case <-timer.C:
+			case <-r.Context().Done():
+				logger.Warn("Client went away while waiting for its slot", "user_id", req.Key)
+				return
+			}
+		}
+	}
+
+	utils.SendAcquireScheduled(w, startAt, degraded)
+}
+
+// FeedbackHandler handles POST /feedback requests (admin only).
+// The protected service reports its health and the named key's adaptive limit moves accordingly.
+func (h *Handlers) FeedbackHandler(w http.ResponseWriter, r *http.Request) {
+	logger := utils.GetLoggerFromContext(r.Context())
+
+	if r.Method != http.MethodPost {
+		logger.Warn("Invalid method", "method", r.Method)
+		utils.SendError(w, http.StatusMethodNotAllowed, "Only POST method allowed")
+		return
+	}
+
+	var req models.FeedbackRequest
+	if err := utils.DecodeJSON(w, r, &req); err != nil {
+		logger.Warn("Invalid request body", "error", err.Error())
+		utils.SendValidationError(w, err)
+		return
+	}
+	if err := req.Validate(); err != nil {
+		logger.Warn("Invalid feedback", "error", err.Error())
+		utils.SendValidationError(w, err)
+		return
+	}
+
+	response, err := h.RateLimiter.Feedback(req)
+	if errors.Is(err, services.ErrNotAdaptive) {
+		logger.Warn("Feedback for key without adaptive policy", "key", req.Key)
+		utils.SendError(w, http.StatusBadRequest, "Key has no adaptive policy")
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to apply feedback", err, "key", req.Key)
+		utils.SendError(w, http.StatusServiceUnavailable, "Feedback could not be applied")
+		return
+	}
+
+	logger.Info("Applied feedback", "key", req.Key, "healthy", response.Healthy, "limit", response.Limit,
+		"admin", middleware.GetUserIDFromContext(r.Context()))
+	utils.SendJSON(w, http.StatusOK, response)
+}
+
 // StatusHandler handles GET /status requests
 func (h *Handlers) StatusHandler(w http.ResponseWriter, r *http.Request) {
 	// Get logger from context
@@ -102,6 +286,17 @@ func (h *Handlers) StatusHandler(w http.ResponseWriter, r *http.Request) {
 	// Get status from rate limiter service using user ID as key
 	response := h.RateLimiter.GetStatus(userID)
 
+	// Include every quota the user consumes from
+	quotas, err := h.RateLimiter.QuotaChain(userID, middleware.GetQuotaParentsFromContext(r.Context()))
+	if err != nil {
+		logger.Warn("Quota claims rejected", "user_id", userID, "error", err.Error())
+		utils.SendValidationError(w, err)
+		return
+	}
+	if len(quotas) > 1 {
+		response.Quotas = h.RateLimiter.HierarchyStatus(quotas)
+	}
+
 	logger.Info("Returning status",
 		"user_id", userID,
 		"tokens_left", response.TokensLeft,
@@ -112,7 +307,111 @@ func (h *Handlers) StatusHandler(w http.ResponseWriter, r *http.Request) {
 	utils.SendJSON(w, http.StatusOK, response)
 }
 
-// GenerateTokenHandler handles POST /generate-token requests (for testing)
+// UsageHandler handles GET /usage requests.
+// Reports consumed and remaining tokens per period for the user and every quota above it;
+// the optional "at" query parameter (YYYY-MM-DD or RFC 3339) selects a past period.
+func (h *Handlers) UsageHandler(w http.ResponseWriter, r *http.Request) {
+	logger := utils.GetLoggerFromContext(r.Context())
+
+	if r.Method != http.MethodGet {
+		logger.Warn("Invalid method", "method", r.Method)
+		utils.SendError(w, http.StatusMethodNotAllowed, "Only GET method allowed")
+		return
+	}
+
+	// Get user ID from JWT context
+	userID := middleware.GetUserIDFromContext(r.Context())
+	if userID == "" {
+		logger.Error("User ID not found in context", nil)
+		utils.SendError(w, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+
+	at := time.Now()
+	if value := r.URL.Query().Get("at"); value != "" {
+		parsed, err := parseUsageTime(value)
+		if err != nil {
+			logger.Warn("Invalid at parameter", "at", value)
+			utils.SendError(w, http.StatusBadRequest, "at must be a date (YYYY-MM-DD) or an RFC 3339 time")
+			return
+		}
+		at = parsed
+	}
+
+	quotas, err := h.RateLimiter.QuotaChain(userID, middleware.GetQuotaParentsFromContext(r.Context()))
+	if err != nil {
+		logger.Warn("Quota claims rejected", "user_id", userID, "error", err.Error())
+		utils.SendValidationError(w, err)
+		return
+	}
+
+	usage, err := h.RateLimiter.GetUsage(quotas, at)
+	if err != nil {
+		logger.Error("Failed to read usage", err, "user_id", userID)
+		utils.SendError(w, http.StatusServiceUnavailable, "Usage is unavailable")
+		return
+	}
+
+	if usage == nil {
+		usage = []models.PeriodUsage{}
+	}
+
+	logger.Info("Returning usage", "user_id", userID, "periods", len(usage))
+	utils.SendJSON(w, http.StatusOK, models.UsageResponse{Key: userID, Usage: usage})
+}
+
+// parseUsageTime accepts a date or an RFC 3339 timestamp
+func parseUsageTime(value string) (time.Time, error) {
+	if date, err := time.Parse("2006-01-02", value); err == nil {
+		return date, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// ClearPenaltyHandler handles DELETE /penalty?key=<key> requests (admins only)
+func (h *Handlers) ClearPenaltyHandler(w http.ResponseWriter, r *http.Request) {
+	logger := utils.GetLoggerFromContext(r.Context())
+
+	if r.Method != http.MethodDelete {
+		logger.Warn("Invalid method", "method", r.Method)
+		utils.SendError(w, http.StatusMethodNotAllowed, "Only DELETE method allowed")
+		return
+	}
+
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		logger.Warn("Missing key parameter")
+		utils.SendError(w, http.StatusBadRequest, "key is required")
+		return
+	}
+
+	if err := h.RateLimiter.ClearPenalty(key); err != nil {
+		logger.Error("Failed to clear penalty", err, "key", key)
+		utils.SendError(w, http.StatusServiceUnavailable, "Penalty could not be cleared")
+		return
+	}
+
+	logger.Info("Penalty cleared", "key", key, "admin", middleware.GetUserIDFromContext(r.Context()))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// penaltyRetryAfter returns the seconds until the key leaves the penalty box (nil if it is not boxed)
+func (h *Handlers) penaltyRetryAfter(key string) *int {
+	penalty := h.RateLimiter.Penalty(key)
+	if penalty == nil || penalty.BoxedUntil == nil {
+		return nil
+	}
+
+	seconds := int(math.Ceil(time.Until(*penalty.BoxedUntil).Seconds()))
+	if seconds <= 0 {
+		return nil
+	}
+	return &seconds
+}
+
+// GenerateTokenHandler handles POST /generate-token requests (for testing).
+// Self-service tokens carry only the user; quota, priority and admin claims come
+// from IssueTokenHandler, since leaving out a team or org would escape its quota.
 func (h *Handlers) GenerateTokenHandler(jwtSecret string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		logger := utils.GetLoggerFromContext(r.Context())
@@ -127,9 +426,9 @@ func (h *Handlers) GenerateTokenHandler(jwtSecret string) http.HandlerFunc {
 			UserID string `json:"user_id"`
 		}
 
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			logger.Error("Failed to decode JSON", err)
-			utils.SendError(w, http.StatusBadRequest, "Invalid JSON body")
+		if err := utils.DecodeJSON(w, r, &req); err != nil {
+			logger.Warn("Invalid request body", "error", err.Error())
+			utils.SendValidationError(w, err)
 			return
 		}
 
@@ -139,23 +438,80 @@ func (h *Handlers) GenerateTokenHandler(jwtSecret string) http.HandlerFunc {
 			return
 		}
 
-		// Generate JWT token
-		token, err := middleware.GenerateJWT(req.UserID, jwtSecret)
-		if err != nil {
-			logger.Error("Failed to generate JWT", err)
-			utils.SendError(w, http.StatusInternalServerError, "Failed to generate token")
+		sendToken(w, r, middleware.JWTClaims{UserID: req.UserID}, jwtSecret)
+	}
+}
+
+// IssueTokenHandler handles POST /issue-token requests (admin only).
+// Trusted issuers mint tokens with privileged claims: the team and org quotas the
+// user consumes from, a priority class, or the admin claim for another trusted service.
+func (h *Handlers) IssueTokenHandler(jwtSecret string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := utils.GetLoggerFromContext(r.Context())
+
+		if r.Method != http.MethodPost {
+			logger.Warn("Invalid method", "method", r.Method)
+			utils.SendError(w, http.StatusMethodNotAllowed, "Only POST method allowed")
 			return
 		}
 
-		logger.Info("Generated token", "user_id", req.UserID)
+		var req struct {
+			UserID   string `json:"user_id"`
+			Team     string `json:"team"` // optional quota claims
+			Org      string `json:"org"`
+			Priority string `json:"priority"` // optional: highest priority class the user may request
+			Admin    bool   `json:"admin"`    // optional: access to the admin endpoints
+		}
+
+		if err := utils.DecodeJSON(w, r, &req); err != nil {
+			logger.Warn("Invalid request body", "error", err.Error())
+			utils.SendValidationError(w, err)
+			return
+		}
 
-		response := map[string]interface{}{
-			"token":   token,
-			"user_id": req.UserID,
+		if req.UserID == "" {
+			logger.Warn("Missing user_id in request")
+			utils.SendError(w, http.StatusBadRequest, "user_id is required")
+			return
+		}
+		if req.Priority != "" && !models.IsPriority(req.Priority) {
+			logger.Warn("Unknown priority in request", "priority", req.Priority)
+			utils.SendErrorCode(w, http.StatusBadRequest, models.ErrorCodeUnknownPriority, "unknown priority "+strconv.Quote(req.Priority))
+			return
 		}
 
-		utils.SendJSON(w, http.StatusOK, response)
+		logger.Info("Issuing token", "user_id", req.UserID, "priority", req.Priority, "admin", req.Admin,
+			"issuer", middleware.GetUserIDFromContext(r.Context()))
+
+		sendToken(w, r, middleware.JWTClaims{
+			UserID:   req.UserID,
+			Team:     req.Team,
+			Org:      req.Org,
+			Priority: req.Priority,
+			Admin:    req.Admin,
+		}, jwtSecret)
+	}
+}
+
+// sendToken signs the claims and responds with the token
+func sendToken(w http.ResponseWriter, r *http.Request, claims middleware.JWTClaims, jwtSecret string) {
+	logger := utils.GetLoggerFromContext(r.Context())
+
+	token, err := middleware.GenerateScopedJWT(claims, jwtSecret)
+	if err != nil {
+		logger.Error("Failed to generate JWT", err)
+		utils.SendError(w, http.StatusInternalServerError, "Failed to generate token")
+		return
+	}
+
+	logger.Info("Generated token", "user_id", claims.UserID)
+
+	response := map[string]interface{}{
+		"token":   token,
+		"user_id": claims.UserID,
 	}
+
+	utils.SendJSON(w, http.StatusOK, response)
 }
 
 // MetricsHandler handles GET /metrics requests
@@ -187,3 +543,18 @@ func (h *Handlers) MetricsHandler(w http.ResponseWriter, r *http.Request) {
 
 	logger.Info("Metrics returned successfully")
 }
+
+// HealthHandler handles GET /health requests.
+// Always returns 200 while the process is serving; Redis problems show up as "degraded".
+func (h *Handlers) HealthHandler(w http.ResponseWriter, r *http.Request) {
+	utils.SendJSON(w, http.StatusOK, h.RateLimiter.GetHealth())
+}
+
+// checkKey rejects a body key naming someone other than the JWT user; the key always
+// comes from the JWT, so an empty key is fine
+func checkKey(key string, userID string) error {
+	if key != "" && key != userID {
+		return &models.ValidationError{Code: models.ErrorCodeKeyMismatch, Message: "key must be omitted or match the JWT user"}
+	}
+	return nil
+}
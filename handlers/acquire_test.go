@@ -2,20 +2,142 @@ package handlers_test
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/Appy29/rate-limiter/handlers"
+	"github.com/Appy29/rate-limiter/middleware"
 	"github.com/Appy29/rate-limiter/models"
+	"github.com/Appy29/rate-limiter/services"
+	"github.com/Appy29/rate-limiter/utils"
 )
 
 // mockRateLimiter is a simple mock for RateLimiterInterface
-type mockRateLimiter struct{}
+type mockRateLimiter struct {
+	acquireErr   error  // returned by Acquire to simulate a broken backend
+	failMode     string // fail mode reported by ResolvePolicy
+	localAllowed bool   // result of the in-memory fallback
+	mode         string // leaky bucket mode reported by ResolvePolicy
+	scheduleAt   time.Time
+	scheduleFull bool // Schedule rejects, with scheduleAt as the retry time
+	adaptive     bool // whether Feedback accepts the key
 
-func (m *mockRateLimiter) Acquire(key string, tokens int64, algorithm string) bool {
-	return true // always allow for testing
+	hierarchyCalls [][]string // quota chains passed to AcquireHierarchy
+	scheduleCalls  [][]string // quota chains passed to Schedule
+	quotaErr       error      // returned by QuotaChain when claims contradict the policies
+
+	cost          int64  // server-side cost reported by ResolveCost (0 = client tokens)
+	lastTokens    int64  // tokens passed to the last Acquire
+	lastPriority  string // priority passed to the last Acquire
+	lastAlgorithm string // algorithm passed to the last Acquire
+
+	pool          string // fair share pool reported by ResolvePolicy
+	algorithm     string // algorithm reported by ResolvePolicy
+	allowOverride bool   // whether ResolvePolicy lets requests pick the algorithm
+	capacity      int64  // bucket size reported by ResolvePolicy (0 = unbounded)
+
+	denied     bool      // Acquire rejects the request
+	boxedUntil time.Time // penalty box reported by Penalty (zero = none)
+	cleared    []string  // keys passed to ClearPenalty
+}
+
+func (m *mockRateLimiter) Acquire(key string, tokens int64, algorithm string, priority string) (bool, error) {
+	m.lastTokens = tokens
+	m.lastPriority = priority
+	m.lastAlgorithm = algorithm
+	if m.acquireErr != nil {
+		return false, m.acquireErr
+	}
+	return !m.denied, nil // allow unless told otherwise
+}
+
+func (m *mockRateLimiter) AcquireLocal(key string, tokens int64, algorithm string, priority string) bool {
+	return m.localAllowed
+}
+
+func (m *mockRateLimiter) Schedule(keys []string, requests int64, priority string) (time.Time, bool, error) {
+	m.scheduleCalls = append(m.scheduleCalls, keys)
+	if m.acquireErr != nil {
+		return time.Time{}, false, m.acquireErr
+	}
+	return m.scheduleAt, !m.scheduleFull, nil
+}
+
+func (m *mockRateLimiter) ScheduleLocal(keys []string, requests int64, priority string) (time.Time, bool) {
+	return m.scheduleAt, m.localAllowed
+}
+
+func (m *mockRateLimiter) ResolveCost(req models.AcquireRequest) (int64, error) {
+	if m.cost > 0 {
+		return m.cost, nil
+	}
+	return req.RequestedTokens(), nil
+}
+
+func (m *mockRateLimiter) Feedback(report models.FeedbackRequest) (models.FeedbackResponse, error) {
+	if !m.adaptive {
+		return models.FeedbackResponse{}, services.ErrNotAdaptive
+	}
+	return models.FeedbackResponse{Key: report.Key, Healthy: true, Limit: 11}, nil
+}
+
+func (m *mockRateLimiter) QuotaChain(key string, parents []string) ([]string, error) {
+	if m.quotaErr != nil {
+		return nil, m.quotaErr
+	}
+	return append([]string{key}, parents...), nil
+}
+
+func (m *mockRateLimiter) AcquireHierarchy(keys []string, tokens int64, algorithm string, priority string) (bool, error) {
+	m.hierarchyCalls = append(m.hierarchyCalls, keys)
+	return m.Acquire(keys[0], tokens, algorithm, priority)
+}
+
+func (m *mockRateLimiter) AcquireHierarchyLocal(keys []string, tokens int64, algorithm string, priority string) bool {
+	return m.localAllowed
+}
+
+func (m *mockRateLimiter) HierarchyStatus(keys []string) []models.QuotaStatus {
+	quotas := make([]models.QuotaStatus, len(keys))
+	for i, key := range keys {
+		quotas[i] = models.QuotaStatus{Key: key, TokensLeft: 5, Capacity: 10}
+	}
+	return quotas
+}
+
+func (m *mockRateLimiter) GetUsage(keys []string, at time.Time) ([]models.PeriodUsage, error) {
+	remaining := int64(600)
+	return []models.PeriodUsage{{Key: keys[0], Period: models.PeriodMonth, Consumed: 400, Limit: 1000, Remaining: &remaining}}, nil
+}
+
+func (m *mockRateLimiter) Penalty(key string) *models.PenaltyStatus {
+	if m.boxedUntil.IsZero() {
+		return nil
+	}
+	return &models.PenaltyStatus{Violations: 12, BoxedUntil: &m.boxedUntil}
+}
+
+func (m *mockRateLimiter) ClearPenalty(key string) error {
+	m.cleared = append(m.cleared, key)
+	return nil
+}
+
+func (m *mockRateLimiter) ResolvePolicy(key string) models.RateLimitConfig {
+	return models.RateLimitConfig{
+		Key:                    key,
+		Algorithm:              m.algorithm,
+		Capacity:               m.capacity,
+		FailMode:               m.failMode,
+		Mode:                   m.mode,
+		Pool:                   m.pool,
+		AllowAlgorithmOverride: m.allowOverride,
+	}
 }
 
 func (m *mockRateLimiter) GetStatus(key string) models.StatusResponse {
@@ -38,6 +160,16 @@ func (m *mockRateLimiter) GetPrometheusMetrics() string {
 	return "rate_limiter_total_requests Total requests\nrate_limiter_total_requests 100\n"
 }
 
+func (m *mockRateLimiter) GetHealth() models.HealthResponse {
+	return models.HealthResponse{
+		Status: "degraded",
+		Redis: map[string]models.InstanceHealth{
+			"redis-1": {Healthy: true, Breaker: "closed"},
+			"redis-2": {Healthy: false, Breaker: "open"},
+		},
+	}
+}
+
 func TestMetricsHandler_JSON(t *testing.T) {
 	h := handlers.NewHandlers(&mockRateLimiter{})
 
@@ -76,3 +208,684 @@ func TestMetricsHandler_Prometheus(t *testing.T) {
 		t.Errorf("expected prometheus output, got empty string")
 	}
 }
+
+// newAcquireRequest builds an authenticated /acquire request for the given user
+func newAcquireRequest(userID string, body string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/acquire", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	ctx := context.WithValue(req.Context(), middleware.UserIDKey, userID)
+	return req.WithContext(ctx)
+}
+
+func TestAcquireHandler_FailModes(t *testing.T) {
+	backendErr := errors.New("redis down")
+
+	tests := []struct {
+		name         string
+		limiter      *mockRateLimiter
+		wantStatus   int
+		wantAllowed  bool
+		wantDegraded bool
+	}{
+		{"healthy backend", &mockRateLimiter{}, http.StatusOK, true, false},
+		{"fail open", &mockRateLimiter{acquireErr: backendErr, failMode: models.FailModeAllow}, http.StatusOK, true, true},
+		{"fail closed", &mockRateLimiter{acquireErr: backendErr, failMode: models.FailModeDeny}, http.StatusServiceUnavailable, false, true},
+		{"local fallback allows", &mockRateLimiter{acquireErr: backendErr, failMode: models.FailModeLocal, localAllowed: true}, http.StatusOK, true, true},
+		{"local fallback limits", &mockRateLimiter{acquireErr: backendErr, failMode: models.FailModeLocal}, http.StatusTooManyRequests, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := handlers.NewHandlers(tt.limiter)
+			w := httptest.NewRecorder()
+
+			h.AcquireHandler(w, newAcquireRequest("user1", `{"tokens": 1}`))
+
+			resp := w.Result()
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("expected status %d, got %d", tt.wantStatus, resp.StatusCode)
+			}
+
+			var body models.AcquireResponse
+			if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+				t.Fatalf("failed to decode JSON response: %v", err)
+			}
+			if body.Allowed != tt.wantAllowed {
+				t.Errorf("expected allowed=%v, got %v", tt.wantAllowed, body.Allowed)
+			}
+			if body.Degraded != tt.wantDegraded {
+				t.Errorf("expected degraded=%v, got %v", tt.wantDegraded, body.Degraded)
+			}
+			if got := resp.Header.Get(utils.DegradedHeader) == "true"; got != tt.wantDegraded {
+				t.Errorf("expected degraded header=%v, got %v", tt.wantDegraded, got)
+			}
+		})
+	}
+}
+
+func TestAcquireHandler_ShapingMode(t *testing.T) {
+	tests := []struct {
+		name    string
+		delay   time.Duration
+		wait    bool
+		minTime time.Duration // minimum time the handler should take
+	}{
+		{"scheduled later", 200 * time.Millisecond, false, 0},
+		{"waits for slot", 50 * time.Millisecond, true, 50 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter := &mockRateLimiter{algorithm: "leaky_bucket", mode: models.LeakyModeShape, scheduleAt: time.Now().Add(tt.delay)}
+			h := handlers.NewHandlers(limiter)
+			w := httptest.NewRecorder()
+
+			body := `{"algorithm": "leaky_bucket"}`
+			if tt.wait {
+				body = `{"algorithm": "leaky_bucket", "wait": true}`
+			}
+
+			started := time.Now()
+			h.AcquireHandler(w, newAcquireRequest("user1", body))
+			if elapsed := time.Since(started); elapsed < tt.minTime {
+				t.Errorf("expected handler to wait at least %v, took %v", tt.minTime, elapsed)
+			}
+
+			resp := w.Result()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("expected status 200, got %d", resp.StatusCode)
+			}
+
+			var got models.AcquireResponse
+			if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+				t.Fatalf("failed to decode JSON response: %v", err)
+			}
+			if got.ScheduledAt == nil || !got.ScheduledAt.Equal(limiter.scheduleAt) {
+				t.Errorf("expected scheduled_at %v, got %v", limiter.scheduleAt, got.ScheduledAt)
+			}
+			if got.DelayMs == nil {
+				t.Fatal("expected delay_ms in response")
+			}
+			if tt.wait && *got.DelayMs != 0 {
+				t.Errorf("expected no remaining delay after waiting, got %dms", *got.DelayMs)
+			}
+			if !tt.wait && *got.DelayMs <= 0 {
+				t.Errorf("expected a positive delay, got %dms", *got.DelayMs)
+			}
+		})
+	}
+}
+
+func TestAcquireHandler_ShapingModeMaxWait(t *testing.T) {
+	limiter := &mockRateLimiter{algorithm: "leaky_bucket", mode: models.LeakyModeShape, scheduleFull: true, scheduleAt: time.Now().Add(4500 * time.Millisecond)}
+	h := handlers.NewHandlers(limiter)
+	w := httptest.NewRecorder()
+
+	h.AcquireHandler(w, newAcquireRequest("user1", `{"algorithm": "leaky_bucket", "wait": true}`))
+
+	resp := w.Result()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected status 429, got %d", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Retry-After"); got != "5" {
+		t.Errorf("expected Retry-After 5, got %q", got)
+	}
+}
+
+func TestAcquireHandler_ServerSideCost(t *testing.T) {
+	limiter := &mockRateLimiter{cost: 50}
+	h := handlers.NewHandlers(limiter)
+
+	w := httptest.NewRecorder()
+	h.AcquireHandler(w, newAcquireRequest("user1", `{"tokens": 1, "operation": "bulk_export"}`))
+
+	if w.Result().StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Result().StatusCode)
+	}
+	if limiter.lastTokens != 50 {
+		t.Errorf("expected the table cost of 50 tokens to be charged, got %d", limiter.lastTokens)
+	}
+}
+
+func TestAcquireHandler_Priority(t *testing.T) {
+	tests := []struct {
+		name           string
+		claim          string
+		body           string
+		expectedStatus int
+		expected       string
+	}{
+		{"default", "", `{}`, http.StatusOK, models.PriorityNormal},
+		{"lowered by request", "", `{"priority": "background"}`, http.StatusOK, models.PriorityBackground},
+		{"critical needs the claim", "", `{"priority": "critical"}`, http.StatusForbidden, ""},
+		{"above the claim", models.PriorityBackground, `{"priority": "normal"}`, http.StatusForbidden, ""},
+		{"critical granted by claim", models.PriorityCritical, `{"priority": "critical"}`, http.StatusOK, models.PriorityCritical},
+		{"claim is the default", models.PriorityCritical, `{}`, http.StatusOK, models.PriorityCritical},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter := &mockRateLimiter{}
+			h := handlers.NewHandlers(limiter)
+
+			req := newAcquireRequest("user1", tt.body)
+			req = req.WithContext(context.WithValue(req.Context(), middleware.PriorityKey, tt.claim))
+
+			w := httptest.NewRecorder()
+			h.AcquireHandler(w, req)
+
+			if w.Result().StatusCode != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d", tt.expectedStatus, w.Result().StatusCode)
+			}
+			if limiter.lastPriority != tt.expected {
+				t.Errorf("expected priority %q, got %q", tt.expected, limiter.lastPriority)
+			}
+			if tt.expectedStatus == http.StatusForbidden {
+				var resp models.ErrorResponse
+				json.NewDecoder(w.Body).Decode(&resp)
+				if resp.ErrorCode != models.ErrorCodePriorityNotGranted {
+					t.Errorf("expected error code %q, got %q", models.ErrorCodePriorityNotGranted, resp.ErrorCode)
+				}
+			}
+		})
+	}
+}
+
+func TestAcquireHandler_FairShareByDefault(t *testing.T) {
+	limiter := &mockRateLimiter{pool: "partner_api"}
+	h := handlers.NewHandlers(limiter)
+
+	w := httptest.NewRecorder()
+	h.AcquireHandler(w, newAcquireRequest("user1", `{"tokens": 1}`))
+
+	if w.Result().StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Result().StatusCode)
+	}
+	if limiter.lastAlgorithm != "fair_share" {
+		t.Errorf("expected a key in a pool to default to fair_share, got %q", limiter.lastAlgorithm)
+	}
+}
+
+func TestAcquireHandler_AlgorithmPinned(t *testing.T) {
+	tests := []struct {
+		name           string
+		limiter        *mockRateLimiter
+		body           string
+		expectedStatus int
+		expected       string
+	}{
+		{"policy algorithm", &mockRateLimiter{algorithm: "leaky_bucket"}, `{}`, http.StatusOK, "leaky_bucket"},
+		{"same algorithm requested", &mockRateLimiter{algorithm: "leaky_bucket"}, `{"algorithm": "leaky_bucket"}`, http.StatusOK, "leaky_bucket"},
+		{"switch rejected", &mockRateLimiter{algorithm: "leaky_bucket"}, `{"algorithm": "token_bucket"}`, http.StatusBadRequest, ""},
+		{"switch allowed by policy", &mockRateLimiter{algorithm: "leaky_bucket", allowOverride: true}, `{"algorithm": "token_bucket"}`, http.StatusOK, "token_bucket"},
+		{"unknown algorithm", &mockRateLimiter{allowOverride: true}, `{"algorithm": "sliding_window"}`, http.StatusBadRequest, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := handlers.NewHandlers(tt.limiter)
+
+			w := httptest.NewRecorder()
+			h.AcquireHandler(w, newAcquireRequest("user1", tt.body))
+
+			if w.Result().StatusCode != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d", tt.expectedStatus, w.Result().StatusCode)
+			}
+			if tt.limiter.lastAlgorithm != tt.expected {
+				t.Errorf("expected algorithm %q, got %q", tt.expected, tt.limiter.lastAlgorithm)
+			}
+		})
+	}
+}
+
+func TestAcquireHandler_Validation(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		expected string
+	}{
+		{"malformed JSON", `{"tokens": `, models.ErrorCodeInvalidJSON},
+		{"unknown field", `{"tokens": 1, "token": 5}`, models.ErrorCodeUnknownField},
+		{"negative tokens", `{"tokens": -3}`, models.ErrorCodeInvalidTokens},
+		{"zero tokens", `{"tokens": 0}`, models.ErrorCodeInvalidTokens},
+		{"unknown algorithm", `{"algorithm": "sliding_window"}`, models.ErrorCodeUnknownAlgorithm},
+		{"unknown priority", `{"priority": "urgent"}`, models.ErrorCodeUnknownPriority},
+		{"someone else's key", `{"key": "user2"}`, models.ErrorCodeKeyMismatch},
+		{"more than the bucket holds", `{"tokens": 21}`, models.ErrorCodeTokensAboveCapacity},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter := &mockRateLimiter{capacity: 20}
+			h := handlers.NewHandlers(limiter)
+
+			w := httptest.NewRecorder()
+			h.AcquireHandler(w, newAcquireRequest("user1", tt.body))
+
+			resp := w.Result()
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Fatalf("expected status 400, got %d", resp.StatusCode)
+			}
+
+			var got models.ErrorResponse
+			if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+				t.Fatalf("failed to decode JSON response: %v", err)
+			}
+			if got.ErrorCode != tt.expected {
+				t.Errorf("expected error code %q, got %q (%s)", tt.expected, got.ErrorCode, got.Message)
+			}
+			if limiter.lastTokens != 0 {
+				t.Error("expected an invalid request not to reach the rate limiter")
+			}
+		})
+	}
+}
+
+func TestAcquireHandler_RequestBody(t *testing.T) {
+	tests := []struct {
+		name           string
+		contentType    string
+		body           string
+		expectedStatus int
+		expectedCode   string
+	}{
+		{"json", "application/json", `{"tokens": 1}`, http.StatusOK, ""},
+		{"json with charset", "application/json; charset=utf-8", `{"tokens": 1}`, http.StatusOK, ""},
+		{"no content type", "", `{"tokens": 1}`, http.StatusUnsupportedMediaType, models.ErrorCodeUnsupportedMediaType},
+		{"form", "application/x-www-form-urlencoded", `tokens=1`, http.StatusUnsupportedMediaType, models.ErrorCodeUnsupportedMediaType},
+		{"empty body", "application/json", ``, http.StatusBadRequest, models.ErrorCodeInvalidJSON},
+		{"two values", "application/json", `{"tokens": 1} {"tokens": 2}`, http.StatusBadRequest, models.ErrorCodeInvalidJSON},
+		{"trailing garbage", "application/json", `{"tokens": 1}]`, http.StatusBadRequest, models.ErrorCodeInvalidJSON},
+		{"too large", "application/json", `{"operation": "` + strings.Repeat("a", utils.MaxBodyBytes) + `"}`, http.StatusRequestEntityTooLarge, models.ErrorCodeBodyTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := handlers.NewHandlers(&mockRateLimiter{})
+
+			req := newAcquireRequest("user1", tt.body)
+			req.Header.Set("Content-Type", tt.contentType)
+
+			w := httptest.NewRecorder()
+			h.AcquireHandler(w, req)
+
+			resp := w.Result()
+			if resp.StatusCode != tt.expectedStatus {
+				t.Fatalf("expected status %d, got %d", tt.expectedStatus, resp.StatusCode)
+			}
+			if tt.expectedCode == "" {
+				return
+			}
+
+			var got models.ErrorResponse
+			if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+				t.Fatalf("failed to decode JSON response: %v", err)
+			}
+			if got.ErrorCode != tt.expectedCode {
+				t.Errorf("expected error code %q, got %q (%s)", tt.expectedCode, got.ErrorCode, got.Message)
+			}
+		})
+	}
+}
+
+func TestAcquireHandler_PenaltyRetryAfter(t *testing.T) {
+	limiter := &mockRateLimiter{denied: true, boxedUntil: time.Now().Add(30 * time.Second)}
+	h := handlers.NewHandlers(limiter)
+
+	w := httptest.NewRecorder()
+	h.AcquireHandler(w, newAcquireRequest("user1", `{"tokens": 1}`))
+
+	if w.Result().StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected status 429, got %d", w.Result().StatusCode)
+	}
+	if got := w.Result().Header.Get("Retry-After"); got != "30" {
+		t.Errorf("expected Retry-After of 30 seconds for the penalty box, got %q", got)
+	}
+}
+
+func TestClearPenaltyHandler(t *testing.T) {
+	limiter := &mockRateLimiter{}
+	h := handlers.NewHandlers(limiter)
+	handler := middleware.AdminMiddleware(h.ClearPenaltyHandler)
+
+	tests := []struct {
+		name     string
+		admin    bool
+		url      string
+		expected int
+	}{
+		{"not an admin", false, "/penalty?key=scraper", http.StatusForbidden},
+		{"missing key", true, "/penalty", http.StatusBadRequest},
+		{"cleared", true, "/penalty?key=scraper", http.StatusNoContent},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodDelete, tt.url, nil)
+			req = req.WithContext(context.WithValue(req.Context(), middleware.AdminKey, tt.admin))
+
+			w := httptest.NewRecorder()
+			handler(w, req)
+
+			if w.Result().StatusCode != tt.expected {
+				t.Errorf("expected status %d, got %d", tt.expected, w.Result().StatusCode)
+			}
+		})
+	}
+
+	if len(limiter.cleared) != 1 || limiter.cleared[0] != "scraper" {
+		t.Errorf("expected only the admin request to clear the penalty, got %v", limiter.cleared)
+	}
+}
+
+func TestAcquireHandler_QuotaHierarchy(t *testing.T) {
+	limiter := &mockRateLimiter{}
+	h := handlers.NewHandlers(limiter)
+
+	req := newAcquireRequest("user1", `{"tokens": 2}`)
+	req = req.WithContext(context.WithValue(req.Context(), middleware.QuotaParentsKey, []string{"team:payments", "org:acme"}))
+
+	w := httptest.NewRecorder()
+	h.AcquireHandler(w, req)
+
+	if w.Result().StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Result().StatusCode)
+	}
+	if len(limiter.hierarchyCalls) != 1 || len(limiter.hierarchyCalls[0]) != 3 {
+		t.Fatalf("expected one hierarchical acquire over user, team and org, got %v", limiter.hierarchyCalls)
+	}
+
+	// Status lists every level
+	statusReq := httptest.NewRequest(http.MethodGet, "/status", nil)
+	statusReq = statusReq.WithContext(req.Context())
+
+	w = httptest.NewRecorder()
+	h.StatusHandler(w, statusReq)
+
+	var status models.StatusResponse
+	if err := json.NewDecoder(w.Result().Body).Decode(&status); err != nil {
+		t.Fatalf("failed to decode JSON response: %v", err)
+	}
+	if len(status.Quotas) != 3 || status.Quotas[2].Key != "org:acme" {
+		t.Errorf("expected quotas for user, team and org, got %+v", status.Quotas)
+	}
+}
+
+func TestAcquireHandler_QuotaHierarchyForEveryAlgorithm(t *testing.T) {
+	parents := []string{"team:payments", "org:acme"}
+
+	// The leaky bucket still consumes the enclosing quotas
+	limiter := &mockRateLimiter{algorithm: "leaky_bucket"}
+	h := handlers.NewHandlers(limiter)
+	req := newAcquireRequest("user1", `{"tokens": 2}`)
+	req = req.WithContext(context.WithValue(req.Context(), middleware.QuotaParentsKey, parents))
+
+	w := httptest.NewRecorder()
+	h.AcquireHandler(w, req)
+
+	if w.Result().StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Result().StatusCode)
+	}
+	if len(limiter.hierarchyCalls) != 1 || len(limiter.hierarchyCalls[0]) != 3 || limiter.lastAlgorithm != "leaky_bucket" {
+		t.Fatalf("expected one leaky bucket acquire over user, team and org, got %v (%s)", limiter.hierarchyCalls, limiter.lastAlgorithm)
+	}
+
+	// So does shaping mode
+	limiter = &mockRateLimiter{algorithm: "leaky_bucket", mode: models.LeakyModeShape, scheduleAt: time.Now()}
+	h = handlers.NewHandlers(limiter)
+	req = newAcquireRequest("user1", `{"tokens": 2}`)
+	req = req.WithContext(context.WithValue(req.Context(), middleware.QuotaParentsKey, parents))
+
+	w = httptest.NewRecorder()
+	h.AcquireHandler(w, req)
+
+	if w.Result().StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Result().StatusCode)
+	}
+	if len(limiter.scheduleCalls) != 1 || len(limiter.scheduleCalls[0]) != 3 {
+		t.Errorf("expected the schedule to cover user, team and org, got %v", limiter.scheduleCalls)
+	}
+}
+
+func TestAcquireHandler_QuotaClaimsContradictPolicy(t *testing.T) {
+	limiter := &mockRateLimiter{quotaErr: &models.ValidationError{
+		Status:  http.StatusForbidden,
+		Code:    models.ErrorCodeQuotaChainMismatch,
+		Message: "token names another parent quota",
+	}}
+	h := handlers.NewHandlers(limiter)
+
+	req := newAcquireRequest("user1", `{"tokens": 2}`)
+	req = req.WithContext(context.WithValue(req.Context(), middleware.QuotaParentsKey, []string{"team:search"}))
+
+	w := httptest.NewRecorder()
+	h.AcquireHandler(w, req)
+
+	if w.Result().StatusCode != http.StatusForbidden {
+		t.Fatalf("expected status 403, got %d", w.Result().StatusCode)
+	}
+
+	var response models.ErrorResponse
+	if err := json.NewDecoder(w.Result().Body).Decode(&response); err != nil {
+		t.Fatalf("failed to decode JSON response: %v", err)
+	}
+	if response.ErrorCode != models.ErrorCodeQuotaChainMismatch {
+		t.Errorf("expected error code %q, got %q", models.ErrorCodeQuotaChainMismatch, response.ErrorCode)
+	}
+	if len(limiter.hierarchyCalls) != 0 || limiter.lastTokens != 0 {
+		t.Error("expected nothing to be consumed")
+	}
+}
+
+func TestUsageHandler(t *testing.T) {
+	h := handlers.NewHandlers(&mockRateLimiter{})
+
+	tests := []struct {
+		name       string
+		query      string
+		wantStatus int
+	}{
+		{"current period", "", http.StatusOK},
+		{"past period", "?at=2026-09-15", http.StatusOK},
+		{"invalid time", "?at=last-month", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/usage"+tt.query, nil)
+			req = req.WithContext(context.WithValue(req.Context(), middleware.UserIDKey, "user1"))
+
+			w := httptest.NewRecorder()
+			h.UsageHandler(w, req)
+
+			resp := w.Result()
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("expected status %d, got %d", tt.wantStatus, resp.StatusCode)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+
+			var body models.UsageResponse
+			if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+				t.Fatalf("failed to decode JSON response: %v", err)
+			}
+			if len(body.Usage) != 1 || body.Usage[0].Remaining == nil || *body.Usage[0].Remaining != 600 {
+				t.Errorf("expected 600 tokens remaining this month, got %+v", body.Usage)
+			}
+		})
+	}
+}
+
+func TestFeedbackHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		limiter    *mockRateLimiter
+		admin      bool
+		body       string
+		wantStatus int
+		wantCode   string
+	}{
+		{"adaptive key", &mockRateLimiter{adaptive: true}, true, `{"key": "partner_api", "error_rate": 0.01, "latency_ms": 120}`, http.StatusOK, ""},
+		{"static key", &mockRateLimiter{}, true, `{"key": "partner_api", "error_rate": 0.01}`, http.StatusBadRequest, ""},
+		{"missing key", &mockRateLimiter{adaptive: true}, true, `{"error_rate": 0.01}`, http.StatusBadRequest, models.ErrorCodeMissingKey},
+		{"not admin", &mockRateLimiter{adaptive: true}, false, `{"key": "partner_api", "healthy": false}`, http.StatusForbidden, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := handlers.NewHandlers(tt.limiter)
+			handler := middleware.AdminMiddleware(h.FeedbackHandler)
+			w := httptest.NewRecorder()
+
+			req := httptest.NewRequest(http.MethodPost, "/feedback", bytes.NewBufferString(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			req = req.WithContext(context.WithValue(req.Context(), middleware.UserIDKey, "backend_service"))
+			req = req.WithContext(context.WithValue(req.Context(), middleware.AdminKey, tt.admin))
+			handler(w, req)
+
+			resp := w.Result()
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("expected status %d, got %d", tt.wantStatus, resp.StatusCode)
+			}
+			if tt.wantCode != "" {
+				var body models.ErrorResponse
+				if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+					t.Fatalf("failed to decode JSON response: %v", err)
+				}
+				if body.ErrorCode != tt.wantCode {
+					t.Errorf("expected error code %q, got %q", tt.wantCode, body.ErrorCode)
+				}
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+
+			var body models.FeedbackResponse
+			if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+				t.Fatalf("failed to decode JSON response: %v", err)
+			}
+			if body.Key != "partner_api" || body.Limit != 11 {
+				t.Errorf("expected limit 11 for partner_api, got %d for %q", body.Limit, body.Key)
+			}
+		})
+	}
+}
+
+const testJWTSecret = "test-secret"
+
+// postToken calls a token endpoint and returns the status and the issued token
+func postToken(t *testing.T, handler http.HandlerFunc, admin bool, body string) (int, string) {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodPost, "/token", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	req = req.WithContext(context.WithValue(req.Context(), middleware.AdminKey, admin))
+	w := httptest.NewRecorder()
+	handler(w, req)
+
+	var response struct {
+		Token string `json:"token"`
+	}
+	json.NewDecoder(w.Result().Body).Decode(&response)
+	return w.Result().StatusCode, response.Token
+}
+
+// tokenClaims runs the token through the JWT middleware and returns its priority and admin claims
+func tokenClaims(t *testing.T, token string) (priority string, admin bool) {
+	t.Helper()
+
+	handler := middleware.JWTMiddleware(testJWTSecret)(func(w http.ResponseWriter, r *http.Request) {
+		priority = middleware.GetPriorityFromContext(r.Context())
+		admin = middleware.IsAdminFromContext(r.Context())
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/status", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	handler(w, req)
+
+	if w.Result().StatusCode != http.StatusOK {
+		t.Fatalf("expected the issued token to be valid, got status %d", w.Result().StatusCode)
+	}
+	return priority, admin
+}
+
+func TestTokenHandlers_PriorityClaim(t *testing.T) {
+	h := handlers.NewHandlers(&mockRateLimiter{})
+	generate := h.GenerateTokenHandler(testJWTSecret)
+	issue := middleware.AdminMiddleware(h.IssueTokenHandler(testJWTSecret))
+
+	if status, _ := postToken(t, generate, false, `{"user_id": "user1", "priority": "critical"}`); status != http.StatusBadRequest {
+		t.Errorf("expected self-service tokens to refuse a priority claim, got status %d", status)
+	}
+
+	if status, _ := postToken(t, issue, false, `{"user_id": "user1", "priority": "critical"}`); status != http.StatusForbidden {
+		t.Errorf("expected only admins to issue priority tokens, got status %d", status)
+	}
+
+	status, token := postToken(t, issue, true, `{"user_id": "user1", "priority": "critical"}`)
+	if status != http.StatusOK {
+		t.Fatalf("expected an admin to issue a priority token, got status %d", status)
+	}
+	if got, _ := tokenClaims(t, token); got != models.PriorityCritical {
+		t.Errorf("expected the critical priority claim, got %q", got)
+	}
+}
+
+func TestTokenHandlers_AdminClaim(t *testing.T) {
+	h := handlers.NewHandlers(&mockRateLimiter{})
+	generate := h.GenerateTokenHandler(testJWTSecret)
+	issue := middleware.AdminMiddleware(h.IssueTokenHandler(testJWTSecret))
+
+	if status, _ := postToken(t, generate, false, `{"user_id": "user1", "admin": true}`); status != http.StatusBadRequest {
+		t.Errorf("expected self-service tokens to refuse the admin claim, got status %d", status)
+	}
+
+	// Leaving out the org claim would escape the org's quota
+	if status, _ := postToken(t, generate, false, `{"user_id": "user1", "team": "payments"}`); status != http.StatusBadRequest {
+		t.Errorf("expected self-service tokens to refuse quota claims, got status %d", status)
+	}
+
+	status, token := postToken(t, generate, false, `{"user_id": "user1"}`)
+	if status != http.StatusOK {
+		t.Fatalf("expected a self-service token, got status %d", status)
+	}
+	if _, admin := tokenClaims(t, token); admin {
+		t.Error("expected a self-service token without the admin claim")
+	}
+
+	if status, _ := postToken(t, issue, false, `{"user_id": "user1", "admin": true}`); status != http.StatusForbidden {
+		t.Errorf("expected only admins to issue admin tokens, got status %d", status)
+	}
+
+	status, token = postToken(t, issue, true, `{"user_id": "backend_service", "admin": true}`)
+	if status != http.StatusOK {
+		t.Fatalf("expected an admin to issue an admin token, got status %d", status)
+	}
+	if _, admin := tokenClaims(t, token); !admin {
+		t.Error("expected the issued token to carry the admin claim")
+	}
+}
+
+func TestHealthHandler(t *testing.T) {
+	h := handlers.NewHandlers(&mockRateLimiter{})
+
+	req := httptest.NewRequest(http.MethodGet, "/health", nil)
+	w := httptest.NewRecorder()
+
+	h.HealthHandler(w, req)
+
+	resp := w.Result()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected status 200, got %d", resp.StatusCode)
+	}
+
+	var health models.HealthResponse
+	if err := json.NewDecoder(resp.Body).Decode(&health); err != nil {
+		t.Fatalf("failed to decode JSON response: %v", err)
+	}
+	if health.Redis["redis-2"].Breaker != "open" {
+		t.Errorf("expected redis-2 breaker to be reported open, got %q", health.Redis["redis-2"].Breaker)
+	}
+}
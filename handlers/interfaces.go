@@ -10,6 +10,7 @@ type HandlersInterface interface {
 	StatusHandler(w http.ResponseWriter, r *http.Request)
 	GenerateTokenHandler(jwtSecret string) http.HandlerFunc
 	MetricsHandler(w http.ResponseWriter, r *http.Request)
+	HealthHandler(w http.ResponseWriter, r *http.Request)
 }
 
 var _ HandlersInterface = (*Handlers)(nil)
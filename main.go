@@ -1,9 +1,11 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
 
 	"github.com/Appy29/rate-limiter/config"
 	"github.com/Appy29/rate-limiter/handlers"
@@ -12,31 +14,47 @@ import (
 )
 
 func main() {
+	adminUser := flag.String("admin-token", "", "print an admin token for this user ID and exit (requires ENV=dev)")
+	flag.Parse()
+
 	// Load configuration
 	cfg := config.Load()
 
+	// Bootstrap: the first admin token cannot come from an admin endpoint
+	if *adminUser != "" {
+		printAdminToken(*adminUser, cfg.JWT.Secret)
+		return
+	}
+
 	fmt.Printf("Starting Rate Limiter Server...\n")
 	fmt.Printf("Environment: %s\n", getEnv("ENV", "dev"))
 	fmt.Printf("Server will run on: %s\n", cfg.GetServerAddress())
+	fmt.Printf("Storage Backend: %s\n", cfg.Storage.Backend)
 	fmt.Printf("Redis Instances: %v\n", cfg.Redis.Instances)
 	fmt.Printf("Default Capacity: %d\n", cfg.RateLimit.DefaultCapacity)
 	fmt.Printf("Default Refill Rate: %v\n", cfg.RateLimit.DefaultRefill)
 	fmt.Printf("JWT Secret: %s\n", maskSecret(cfg.JWT.Secret))
 
 	// Test Redis connectivity
-	fmt.Println("\nTesting Redis connectivity...")
-	redisManager := services.NewRedisManager(cfg.Redis.Instances, cfg.Redis.Password, cfg.Redis.DB)
-	healthStatus := redisManager.GetHealthStatus()
-	for node, healthy := range healthStatus {
-		if healthy {
-			fmt.Printf("Yes %s: Connected\n", node)
-		} else {
-			fmt.Printf("No %s: Failed\n", node)
+	if cfg.Storage.Backend == services.StorageRedis {
+		fmt.Println("\nTesting Redis connectivity...")
+		redisManager := services.NewRedisManager(cfg.Redis.Instances, cfg.Redis.Password, cfg.Redis.DB)
+		healthStatus := redisManager.GetHealthStatus()
+		for node, healthy := range healthStatus {
+			if healthy {
+				fmt.Printf("Yes %s: Connected\n", node)
+			} else {
+				fmt.Printf("No %s: Failed\n", node)
+			}
 		}
+		redisManager.Close()
 	}
 
-	// Initialize services with Redis backend
-	var rateLimiter services.RateLimiterInterface = services.NewRedisRateLimiterService(cfg)
+	// Initialize services with the configured storage backend
+	rateLimiter, err := services.NewRedisRateLimiterService(cfg)
+	if err != nil {
+		log.Fatal("Failed to initialize rate limiter:", err)
+	}
 
 	// Initialize handlers
 	h := handlers.NewHandlers(rateLimiter)
@@ -53,10 +71,7 @@ func main() {
 
 func setupRoutes(h *handlers.Handlers, cfg *config.Config) {
 	// Health check (no middleware needed)
-	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("OK"))
-	})
+	http.HandleFunc("/health", h.HealthHandler)
 
 	// Token generation endpoint (for testing) - only context middleware
 	http.HandleFunc("/generate-token", middleware.ContextMiddleware(h.GenerateTokenHandler(cfg.JWT.Secret)))
@@ -70,6 +85,23 @@ func setupRoutes(h *handlers.Handlers, cfg *config.Config) {
 		middleware.JWTMiddleware(cfg.JWT.Secret)(h.StatusHandler),
 	))
 
+	http.HandleFunc("/usage", middleware.ContextMiddleware(
+		middleware.JWTMiddleware(cfg.JWT.Secret)(h.UsageHandler),
+	))
+
+	// Admin endpoints - context + JWT + admin claim
+	http.HandleFunc("/issue-token", middleware.ContextMiddleware(
+		middleware.JWTMiddleware(cfg.JWT.Secret)(middleware.AdminMiddleware(h.IssueTokenHandler(cfg.JWT.Secret))),
+	))
+
+	http.HandleFunc("/feedback", middleware.ContextMiddleware(
+		middleware.JWTMiddleware(cfg.JWT.Secret)(middleware.AdminMiddleware(h.FeedbackHandler)),
+	))
+
+	http.HandleFunc("/penalty", middleware.ContextMiddleware(
+		middleware.JWTMiddleware(cfg.JWT.Secret)(middleware.AdminMiddleware(h.ClearPenaltyHandler)),
+	))
+
 	// Metrics endpoint - only context middleware (no JWT required for monitoring)
 	http.HandleFunc("/metrics", middleware.ContextMiddleware(h.MetricsHandler))
 
@@ -84,6 +116,20 @@ func getEnv(key, defaultValue string) string {
 	return defaultValue
 }
 
+// printAdminToken mints a token with the admin claim. Only for development setups;
+// elsewhere admin tokens are issued by existing admins through /issue-token.
+func printAdminToken(userID string, secret string) {
+	if os.Getenv("ENV") != "dev" {
+		log.Fatal("-admin-token is only available with ENV=dev")
+	}
+
+	token, err := middleware.GenerateScopedJWT(middleware.JWTClaims{UserID: userID, Admin: true}, secret)
+	if err != nil {
+		log.Fatal("Failed to generate admin token:", err)
+	}
+	fmt.Println(token)
+}
+
 // maskSecret masks JWT secret for logging
 func maskSecret(secret string) string {
 	if len(secret) <= 6 {
@@ -13,15 +13,40 @@ import (
 type jwtContextKey string
 
 const (
-	UserIDKey jwtContextKey = "user_id"
+	UserIDKey       jwtContextKey = "user_id"
+	QuotaParentsKey jwtContextKey = "quota_parents"
+	PriorityKey     jwtContextKey = "priority"
+	AdminKey        jwtContextKey = "admin"
+)
+
+// Key prefixes of the quotas named by the team and org claims
+const (
+	TeamQuotaPrefix = "team:"
+	OrgQuotaPrefix  = "org:"
 )
 
 // JWTClaims represents the JWT payload
 type JWTClaims struct {
-	UserID string `json:"user_id"`
+	UserID   string `json:"user_id"`
+	Team     string `json:"team,omitempty"`     // optional: the user also consumes from the team's quota
+	Org      string `json:"org,omitempty"`      // optional: ... and from the organization's quota
+	Priority string `json:"priority,omitempty"` // optional: highest priority class the user may request
+	Admin    bool   `json:"admin,omitempty"`    // optional: may use the admin endpoints
 	jwt.RegisteredClaims
 }
 
+// QuotaParents returns the quota keys above the user named by the claims, innermost first
+func (c *JWTClaims) QuotaParents() []string {
+	var parents []string
+	if c.Team != "" {
+		parents = append(parents, TeamQuotaPrefix+c.Team)
+	}
+	if c.Org != "" {
+		parents = append(parents, OrgQuotaPrefix+c.Org)
+	}
+	return parents
+}
+
 // JWTMiddleware validates JWT token and extracts user ID
 func JWTMiddleware(jwtSecret string) func(http.HandlerFunc) http.HandlerFunc {
 	return func(next http.HandlerFunc) http.HandlerFunc {
@@ -70,8 +95,11 @@ func JWTMiddleware(jwtSecret string) func(http.HandlerFunc) http.HandlerFunc {
 					return
 				}
 
-				// Add user ID to context
+				// Add user ID and the quotas above it to context
 				ctx := context.WithValue(r.Context(), UserIDKey, claims.UserID)
+				ctx = context.WithValue(ctx, QuotaParentsKey, claims.QuotaParents())
+				ctx = context.WithValue(ctx, PriorityKey, claims.Priority)
+				ctx = context.WithValue(ctx, AdminKey, claims.Admin)
 				r = r.WithContext(ctx)
 
 				logger.Info("JWT validated successfully", "user_id", claims.UserID)
@@ -95,17 +123,54 @@ func GetUserIDFromContext(ctx context.Context) string {
 	return ""
 }
 
+// GetQuotaParentsFromContext extracts the quota keys above the user from context
+func GetQuotaParentsFromContext(ctx context.Context) []string {
+	if parents, ok := ctx.Value(QuotaParentsKey).([]string); ok {
+		return parents
+	}
+	return nil
+}
+
+// GetPriorityFromContext extracts the highest priority class the user may request from context
+func GetPriorityFromContext(ctx context.Context) string {
+	if priority, ok := ctx.Value(PriorityKey).(string); ok {
+		return priority
+	}
+	return ""
+}
+
+// IsAdminFromContext reports whether the JWT grants access to the admin endpoints
+func IsAdminFromContext(ctx context.Context) bool {
+	admin, _ := ctx.Value(AdminKey).(bool)
+	return admin
+}
+
+// AdminMiddleware only lets requests with the admin claim through (after JWTMiddleware)
+func AdminMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !IsAdminFromContext(r.Context()) {
+			utils.GetLoggerFromContext(r.Context()).Warn("Admin endpoint called without admin claim", "user_id", GetUserIDFromContext(r.Context()))
+			utils.SendError(w, http.StatusForbidden, "Admin access required")
+			return
+		}
+		next(w, r)
+	}
+}
+
 // GenerateJWT creates a JWT token for testing purposes
 func GenerateJWT(userID string, jwtSecret string) (string, error) {
-	claims := &JWTClaims{
-		UserID: userID,
-		RegisteredClaims: jwt.RegisteredClaims{
-			Subject:   userID,
-			ExpiresAt: jwt.NewNumericDate(jwt.TimeFunc().Add(24 * 60 * 60 * 1000000000)), // 24 hours
-			IssuedAt:  jwt.NewNumericDate(jwt.TimeFunc()),
-		},
+	return GenerateScopedJWT(JWTClaims{UserID: userID}, jwtSecret)
+}
+
+// GenerateScopedJWT creates a JWT token for testing purposes with the optional claims set
+// (team, org, priority, admin); the registered claims are filled in
+func GenerateScopedJWT(claims JWTClaims, jwtSecret string) (string, error) {
+	claims.RegisteredClaims = jwt.RegisteredClaims{
+		Subject:   claims.UserID,
+		ExpiresAt: jwt.NewNumericDate(jwt.TimeFunc().Add(24 * 60 * 60 * 1000000000)), // 24 hours
+		IssuedAt:  jwt.NewNumericDate(jwt.TimeFunc()),
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, &claims)
 	return token.SignedString([]byte(jwtSecret))
 }
@@ -1,12 +1,65 @@
 package models
 
-import "time"
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+)
+
+// Fail modes decide what happens to a request when the rate limiter backend errors
+const (
+	FailModeAllow = "allow" // let the request through unchecked
+	FailModeDeny  = "deny"  // reject the request as unavailable
+	FailModeLocal = "local" // evaluate against the in-memory fallback buckets
+)
+
+// Leaky bucket modes
+const (
+	LeakyModeMeter = "meter" // admit or reject against the queue length (default)
+	LeakyModeShape = "shape" // admit into a drip schedule and report when each request may start
+)
+
+// DefaultMaxWait is how far ahead shaping mode schedules a request unless the policy says otherwise
+const DefaultMaxWait = 30 * time.Second
+
+// Priority classes, highest first. Policies can reserve part of a bucket for the higher classes.
+const (
+	PriorityCritical   = "critical"
+	PriorityNormal     = "normal" // default
+	PriorityBackground = "background"
+)
+
+// priorityRanks orders the priority classes
+var priorityRanks = map[string]int{
+	PriorityBackground: 0,
+	PriorityNormal:     1,
+	PriorityCritical:   2,
+}
 
 // AcquireRequest represents the request to acquire tokens
 type AcquireRequest struct {
 	Key       string `json:"key"`       // user ID, API key, or any identifier
-	Tokens    int64  `json:"tokens"`    // number of tokens to acquire (default: 1)
-	Algorithm string `json:"algorithm"` // "token_bucket" or "leaky_bucket" (optional)
+	Tokens    *int64 `json:"tokens"`    // number of tokens to acquire (nil = DefaultTokens)
+	Algorithm string `json:"algorithm"` // optional: must match the key's policy unless it allows overrides
+	Wait      bool   `json:"wait"`      // shaping mode: respond only once the scheduled start time is reached
+	Priority  string `json:"priority"`  // "critical", "normal" (default) or "background"
+
+	// Operation about to be performed, e.g. "bulk_export" or "GET /export";
+	// its cost comes from the server-side cost table
+	Operation string `json:"operation,omitempty"`
+}
+
+// DefaultTokens is what a request that does not say how many tokens it needs acquires
+const DefaultTokens = 1
+
+// RequestedTokens returns the tokens the client asked for, DefaultTokens if it left them out
+func (ar *AcquireRequest) RequestedTokens() int64 {
+	if ar.Tokens == nil {
+		return DefaultTokens
+	}
+	return *ar.Tokens
 }
 
 // AcquireResponse represents the response from acquire endpoint
@@ -14,6 +67,11 @@ type AcquireResponse struct {
 	Allowed    bool   `json:"allowed"`
 	Message    string `json:"message"`
 	RetryAfter *int   `json:"retry_after,omitempty"` // seconds to wait before retry
+	Degraded   bool   `json:"degraded,omitempty"`    // decision was made without the backend
+
+	// Shaping mode only: when the request may start, and how long that is from now
+	ScheduledAt *time.Time `json:"scheduled_at,omitempty"`
+	DelayMs     *int64     `json:"delay_ms,omitempty"`
 }
 
 // StatusRequest represents the request to get status (via query params)
@@ -31,11 +89,44 @@ type StatusResponse struct {
 	RefillRate     time.Duration `json:"refill_rate"`
 	NextRefillTime time.Time     `json:"next_refill_time"`
 	IsBlocked      bool          `json:"is_blocked"`
+	ExpiresAt      *time.Time    `json:"expires_at,omitempty"` // when the stored state expires (if the backend expires it)
 
 	// Extended fields for multi-algorithm support (optional)
 	// These fields are only populated when user has used multiple algorithms
 	TokenBucketStatus *AlgorithmStatus `json:"token_bucket_status,omitempty"`
 	LeakyBucketStatus *AlgorithmStatus `json:"leaky_bucket_status,omitempty"`
+
+	// Nested quotas the key consumes from, innermost (the key itself) first
+	Quotas []QuotaStatus `json:"quotas,omitempty"`
+
+	// The key's share of a global pool, if its policy names one
+	FairShare *FairShareStatus `json:"fair_share,omitempty"`
+
+	// Recent violations and penalty box, if the key has any
+	Penalty *PenaltyStatus `json:"penalty,omitempty"`
+}
+
+// PenaltyStatus represents a key's standing in the penalty box
+type PenaltyStatus struct {
+	Violations int64      `json:"violations"`            // recent rejections; one is forgiven per quiet window
+	BoxedUntil *time.Time `json:"boxed_until,omitempty"` // every request is rejected until then
+}
+
+// FairShareStatus represents a tenant's share of a global pool
+type FairShareStatus struct {
+	Pool           string `json:"pool"`
+	ActiveTenants  int64  `json:"active_tenants"`   // tenants currently splitting the pool
+	Share          int64  `json:"share"`            // the tenant's bucket size: the pool size over the active tenants
+	TokensLeft     int64  `json:"tokens_left"`      // left in the tenant's share
+	PoolTokensLeft int64  `json:"pool_tokens_left"` // left in the whole pool
+}
+
+// QuotaStatus represents one level of a quota hierarchy (user, team, org)
+type QuotaStatus struct {
+	Key            string    `json:"key"`
+	TokensLeft     int64     `json:"tokens_left"`
+	Capacity       int64     `json:"capacity"`
+	NextRefillTime time.Time `json:"next_refill_time"`
 }
 
 // AlgorithmStatus represents status for a specific algorithm
@@ -47,41 +138,448 @@ type AlgorithmStatus struct {
 	RefillRate     time.Duration `json:"refill_rate"`
 	NextRefillTime time.Time     `json:"next_refill_time"`
 	IsBlocked      bool          `json:"is_blocked"`
-	HasState       bool          `json:"has_state"` // Whether this algorithm has been used
+	HasState       bool          `json:"has_state"`            // Whether this algorithm has been used
+	ExpiresAt      *time.Time    `json:"expires_at,omitempty"` // when the stored state expires (if the backend expires it)
 }
 
-// RateLimitConfig represents the configuration for a specific key
+// RateLimitConfig represents the configuration (policy) for a specific key
 type RateLimitConfig struct {
-	Key        string        `json:"key"`
-	Algorithm  string        `json:"algorithm"`   // "token_bucket" or "leaky_bucket"
-	Capacity   int64         `json:"capacity"`    // max tokens/requests
-	RefillRate time.Duration `json:"refill_rate"` // how often to refill
+	Key          string        `json:"key"`
+	Algorithm    string        `json:"algorithm"`     // "token_bucket", "leaky_bucket" or "fair_share" (empty = fair_share with a pool, else token_bucket)
+	Capacity     int64         `json:"capacity"`      // max tokens/requests
+	RefillRate   time.Duration `json:"refill_rate"`   // how often to refill
+	RefillTokens float64       `json:"refill_tokens"` // tokens added per refill interval, may be fractional (0 = 1)
+	FailMode     string        `json:"fail_mode"`     // "allow", "deny" or "local" on backend errors
+	TTL          time.Duration `json:"ttl"`           // how long idle state is kept (0 = until the bucket is back to its initial state)
+	Parent       string        `json:"parent"`        // key of the enclosing quota, e.g. "team:payments" (token bucket)
+	Pool         string        `json:"pool"`          // key of the global pool shared fairly with other tenants (fair share)
+
+	// Whether requests may pick another algorithm than the policy's. Each algorithm keeps
+	// separate state, so this lets a throttled client switch to a fresh allowance.
+	AllowAlgorithmOverride bool `json:"allow_algorithm_override"`
+
+	// Token bucket only: the sustained rate is RefillTokens per RefillRate, Burst is the
+	// bucket size (0 = Capacity) and InitialTokens is what new keys start with (nil = full).
+	Burst         int64  `json:"burst"`
+	InitialTokens *int64 `json:"initial_tokens"`
+
+	// Token bucket only: how far below zero a request may take the bucket, so a
+	// transaction that has started can finish. Refills repay the debt before new
+	// requests are admitted (0 = all-or-nothing).
+	Debt int64 `json:"debt"`
+
+	// Leaky bucket only
+	Mode    string        `json:"mode"`     // "meter" (default) or "shape"
+	MaxWait time.Duration `json:"max_wait"` // shaping mode: longest a request may be scheduled ahead (0 = 30s)
+
+	// Fair share pools only: tenants seen within this window split the pool (0 = 1m)
+	ActiveWindow time.Duration `json:"active_window"`
+
+	// Penalty box for keys that keep getting rate limited (nil = no penalties)
+	Penalty *PenaltyConfig `json:"penalty,omitempty"`
+
+	// Adaptive limits driven by /feedback (nil = static limits)
+	Adaptive *AdaptiveConfig `json:"adaptive,omitempty"`
+
+	// Long-horizon quotas on top of the bucket; usage is recorded for every listed period
+	Periods []PeriodQuota `json:"periods,omitempty"`
+
+	// Fraction of the bucket held back from each priority class, e.g. {"normal": 0.2, "background": 0.5}.
+	// Classes not listed (usually critical) may use the whole bucket.
+	Reserve map[string]float64 `json:"reserve,omitempty"`
+
+	// Priority of the request being evaluated; set per request, never configured
+	Priority string `json:"-"`
+}
+
+// algorithms is the registry of algorithms that policies and requests may name
+var algorithms = map[string]bool{
+	"token_bucket": true,
+	"leaky_bucket": true,
+	"fair_share":   true,
+}
+
+// IsAlgorithm reports whether the algorithm is in the registry
+func IsAlgorithm(name string) bool {
+	return algorithms[name]
+}
+
+// Usage periods, as calendar windows in UTC
+const (
+	PeriodDay   = "day"
+	PeriodMonth = "month"
+)
+
+// PeriodQuota caps the tokens a key may use per calendar period
+type PeriodQuota struct {
+	Period  string `json:"period"`  // "day" or "month"
+	Limit   int64  `json:"limit"`   // tokens per period (0 = unlimited, usage is only recorded)
+	Overage bool   `json:"overage"` // allow use beyond the limit and report it as overage
+}
+
+// OperationCost is one entry of the server-side cost table.
+// There is no size-based pricing: the limiter only sees the /acquire call, never the
+// operation's payload, and the size of the /acquire body is as much the client's
+// choice as a reported size. Operations whose cost varies are priced at their worst case.
+type OperationCost struct {
+	Operation string `json:"operation"` // operation name or route; "*" prices unlisted operations
+	Tokens    int64  `json:"tokens"`    // cost (0 = 1)
+}
+
+// UsageResponse reports a key's usage per period
+type UsageResponse struct {
+	Key   string        `json:"key"`
+	Usage []PeriodUsage `json:"usage"`
+}
+
+// PeriodUsage is the usage of one key in one period window
+type PeriodUsage struct {
+	Key       string    `json:"key"` // the key itself or an enclosing quota (team, org)
+	Period    string    `json:"period"`
+	Start     time.Time `json:"start"`
+	ResetAt   time.Time `json:"reset_at"`
+	Consumed  int64     `json:"consumed"`
+	Limit     int64     `json:"limit,omitempty"`     // omitted when unlimited
+	Remaining *int64    `json:"remaining,omitempty"` // omitted when unlimited
+	Overage   int64     `json:"overage,omitempty"`   // usage beyond the limit (billable)
+}
+
+// AdaptiveConfig tunes an AIMD (additive increase, multiplicative decrease) limit.
+// The limit replaces Capacity and scales the refill rate with it; it starts at Capacity.
+type AdaptiveConfig struct {
+	MinLimit     int64   `json:"min_limit"`      // never cut below this (0 = 1)
+	MaxLimit     int64   `json:"max_limit"`      // never raise above this (0 = Capacity)
+	Increase     int64   `json:"increase"`       // added per healthy report (0 = 1)
+	Decrease     float64 `json:"decrease"`       // multiplier per unhealthy report, between 0 and 1 (0 = 0.5)
+	MaxErrorRate float64 `json:"max_error_rate"` // error rate above which a report is unhealthy (0 = any error)
+	MaxLatencyMs int64   `json:"max_latency_ms"` // latency above which a report is unhealthy (0 = ignored)
+}
+
+// PenaltyConfig puts keys that keep getting rate limited in a penalty box.
+// Every rejection counts as a violation, and one violation is forgiven per Window
+// without new ones. From the Threshold-th violation on, each further one boxes the key
+// for Base * Multiplier^(violations - Threshold), capped at Max.
+type PenaltyConfig struct {
+	Threshold  int64         `json:"threshold"`  // violations before the first box (0 = 10)
+	Window     time.Duration `json:"window"`     // decay interval (0 = 1m)
+	Base       time.Duration `json:"base"`       // length of the first box (0 = 1s)
+	Multiplier float64       `json:"multiplier"` // growth per further violation (0 = 2)
+	Max        time.Duration `json:"max"`        // longest box (0 = 1h)
+}
+
+// FeedbackRequest reports the health of the service protected by a key's limit.
+// Only the protected service (an admin token) sends feedback, naming the key.
+type FeedbackRequest struct {
+	Key       string  `json:"key"`
+	Healthy   *bool   `json:"healthy,omitempty"`    // explicit verdict; overrides the measurements
+	ErrorRate float64 `json:"error_rate,omitempty"` // fraction of failed calls since the last report
+	LatencyMs int64   `json:"latency_ms,omitempty"` // observed latency, e.g. p99
+}
+
+// FeedbackResponse reports the adaptive limit after applying feedback
+type FeedbackResponse struct {
+	Key     string `json:"key"`
+	Healthy bool   `json:"healthy"` // how the report was judged
+	Limit   int64  `json:"limit"`   // the new limit
+}
+
+// HealthResponse represents the service health reported by /health
+type HealthResponse struct {
+	Status string                    `json:"status"` // "ok" or "degraded"
+	Redis  map[string]InstanceHealth `json:"redis"`  // keyed by instance name
+}
+
+// InstanceHealth represents the health of a single Redis instance
+type InstanceHealth struct {
+	Healthy bool   `json:"healthy"` // latest background probe result
+	Breaker string `json:"breaker"` // "closed", "half_open" or "open"
 }
 
 // ErrorResponse represents an error response
 type ErrorResponse struct {
-	Error   string `json:"error"`
-	Code    int    `json:"code"`
-	Message string `json:"message"`
+	Error     string `json:"error"`
+	Code      int    `json:"code"`
+	ErrorCode string `json:"error_code"` // machine-readable reason, e.g. "unknown_field"
+	Message   string `json:"message"`
+}
+
+// Error codes of rejected requests
+const (
+	ErrorCodeInvalidJSON          = "invalid_json"
+	ErrorCodeUnknownField         = "unknown_field"
+	ErrorCodeKeyMismatch          = "key_mismatch"          // body key is not the JWT user
+	ErrorCodeMissingKey           = "missing_key"           // admin request does not name the key it acts on
+	ErrorCodeInvalidTokens        = "invalid_tokens"        // zero or negative tokens
+	ErrorCodeTokensAboveLimit     = "tokens_above_limit"    // client tokens above the configured maximum
+	ErrorCodeTokensAboveCapacity  = "tokens_above_capacity" // more tokens than the key's bucket can ever hold
+	ErrorCodeUnknownOperation     = "unknown_operation"     // operation missing from the configured cost table
+	ErrorCodeUnknownAlgorithm     = "unknown_algorithm"
+	ErrorCodeAlgorithmPinned      = "algorithm_pinned" // the key's policy sets another algorithm
+	ErrorCodeUnknownPriority      = "unknown_priority"
+	ErrorCodePriorityNotGranted   = "priority_not_granted" // priority above the JWT priority claim
+	ErrorCodeBodyTooLarge         = "body_too_large"
+	ErrorCodeUnsupportedMediaType = "unsupported_media_type"
+	ErrorCodeQuotaChainMismatch   = "quota_chain_mismatch" // team/org claims contradict the policy hierarchy
+)
+
+// ValidationError is a request rejected as invalid, with a machine-readable code
+type ValidationError struct {
+	Status  int // HTTP status to answer with (0 = 400 Bad Request)
+	Code    string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Message
+}
+
+// invalid returns a validation error with a formatted message
+func invalid(code string, format string, args ...interface{}) *ValidationError {
+	return &ValidationError{Code: code, Message: fmt.Sprintf(format, args...)}
 }
 
 // ===== HELPER METHODS =====
 
-// Validate validates and sets defaults for AcquireRequest
-func (ar *AcquireRequest) Validate() error {
-	// Set defaults
-	if ar.Tokens <= 0 {
-		ar.Tokens = 1
+// UnmarshalJSON accepts durations either as nanoseconds or as strings like "1s"
+func (rc *RateLimitConfig) UnmarshalJSON(data []byte) error {
+	type rateLimitConfigAlias RateLimitConfig
+	aux := struct {
+		*rateLimitConfigAlias
+		RefillRate   json.RawMessage `json:"refill_rate"`
+		TTL          json.RawMessage `json:"ttl"`
+		ActiveWindow json.RawMessage `json:"active_window"`
+		MaxWait      json.RawMessage `json:"max_wait"`
+	}{rateLimitConfigAlias: (*rateLimitConfigAlias)(rc)}
+
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
 	}
-	if ar.Algorithm == "" {
-		ar.Algorithm = "token_bucket"
+
+	refillRate, err := parseJSONDuration(aux.RefillRate)
+	if err != nil {
+		return fmt.Errorf("refill_rate: %w", err)
+	}
+	rc.RefillRate = refillRate
+
+	ttl, err := parseJSONDuration(aux.TTL)
+	if err != nil {
+		return fmt.Errorf("ttl: %w", err)
 	}
+	rc.TTL = ttl
 
-	// Validate algorithm
-	if ar.Algorithm != "token_bucket" && ar.Algorithm != "leaky_bucket" {
-		ar.Algorithm = "token_bucket" // Default to token bucket for invalid algorithms
+	activeWindow, err := parseJSONDuration(aux.ActiveWindow)
+	if err != nil {
+		return fmt.Errorf("active_window: %w", err)
 	}
+	rc.ActiveWindow = activeWindow
 
+	maxWait, err := parseJSONDuration(aux.MaxWait)
+	if err != nil {
+		return fmt.Errorf("max_wait: %w", err)
+	}
+	rc.MaxWait = maxWait
+
+	return nil
+}
+
+// UnmarshalJSON accepts durations either as nanoseconds or as strings like "30s"
+func (pc *PenaltyConfig) UnmarshalJSON(data []byte) error {
+	type penaltyConfigAlias PenaltyConfig
+	aux := struct {
+		*penaltyConfigAlias
+		Window json.RawMessage `json:"window"`
+		Base   json.RawMessage `json:"base"`
+		Max    json.RawMessage `json:"max"`
+	}{penaltyConfigAlias: (*penaltyConfigAlias)(pc)}
+
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+
+	for _, field := range []struct {
+		name  string
+		raw   json.RawMessage
+		value *time.Duration
+	}{{"window", aux.Window, &pc.Window}, {"base", aux.Base, &pc.Base}, {"max", aux.Max, &pc.Max}} {
+		duration, err := parseJSONDuration(field.raw)
+		if err != nil {
+			return fmt.Errorf("%s: %w", field.name, err)
+		}
+		*field.value = duration
+	}
+
+	return nil
+}
+
+// parseJSONDuration parses a duration given as a JSON number (ns) or string
+func parseJSONDuration(raw json.RawMessage) (time.Duration, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return 0, nil
+	}
+
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return time.ParseDuration(text)
+	}
+
+	var nanos int64
+	if err := json.Unmarshal(raw, &nanos); err != nil {
+		return 0, err
+	}
+	return time.Duration(nanos), nil
+}
+
+// BurstSize returns the token bucket size: Burst if set, otherwise Capacity
+func (rc *RateLimitConfig) BurstSize() int64 {
+	if rc.Burst > 0 {
+		return rc.Burst
+	}
+	return rc.Capacity
+}
+
+// StartTokens returns the tokens a new token bucket starts with, capped at the burst size
+func (rc *RateLimitConfig) StartTokens() int64 {
+	burst := rc.BurstSize()
+	if rc.InitialTokens == nil || *rc.InitialTokens > burst {
+		return burst
+	}
+	if *rc.InitialTokens < 0 {
+		return 0
+	}
+	return *rc.InitialTokens
+}
+
+// ReservedFraction returns the fraction of the bucket held back from the policy's request priority
+func (rc *RateLimitConfig) ReservedFraction() float64 {
+	priority := rc.Priority
+	if priority == "" {
+		priority = PriorityNormal
+	}
+	return math.Max(0, math.Min(1, rc.Reserve[priority]))
+}
+
+// ReservedTokens returns how many of size tokens (or queue slots) are held back from
+// the policy's request priority
+func (rc *RateLimitConfig) ReservedTokens(size int64) int64 {
+	return int64(math.Ceil(rc.ReservedFraction() * float64(size)))
+}
+
+// TokenFloor returns the lowest level a request may leave a token bucket at: the
+// priority reserve, or minus the debt limit for borrowing policies. Borrowing never
+// eats into capacity reserved for higher priorities.
+func (rc *RateLimitConfig) TokenFloor() int64 {
+	reserve := rc.ReservedTokens(rc.BurstSize())
+	if reserve > 0 || rc.Debt <= 0 {
+		return reserve
+	}
+	return -rc.Debt
+}
+
+// ScheduleMaxWait returns the longest a shaped request may be scheduled ahead
+func (rc *RateLimitConfig) ScheduleMaxWait() time.Duration {
+	if rc.MaxWait > 0 {
+		return rc.MaxWait
+	}
+	return DefaultMaxWait
+}
+
+// PolicyAlgorithm returns the algorithm the policy's key is limited with
+func (rc *RateLimitConfig) PolicyAlgorithm() string {
+	if rc.Algorithm != "" {
+		return rc.Algorithm
+	}
+	if rc.Pool != "" {
+		return "fair_share"
+	}
+	return "token_bucket"
+}
+
+// RequestAlgorithm returns the algorithm a request runs with. The policy decides; a
+// request naming another algorithm is rejected unless the policy allows overrides.
+func (rc *RateLimitConfig) RequestAlgorithm(requested string) (string, error) {
+	algorithm := rc.PolicyAlgorithm()
+	if requested == "" || requested == algorithm {
+		return algorithm, nil
+	}
+	if !IsAlgorithm(requested) {
+		return "", invalid(ErrorCodeUnknownAlgorithm, "unknown algorithm %q", requested)
+	}
+	if !rc.AllowAlgorithmOverride {
+		return "", invalid(ErrorCodeAlgorithmPinned, "algorithm %q requested, but the key's policy uses %q", requested, algorithm)
+	}
+	return requested, nil
+}
+
+// MaxTokens returns the most tokens one request can ever be granted by the algorithm:
+// the queue size for leaky buckets, otherwise the bucket size plus any debt allowed
+func (rc *RateLimitConfig) MaxTokens(algorithm string) int64 {
+	switch algorithm {
+	case "leaky_bucket":
+		return rc.Capacity
+	case "fair_share":
+		return rc.BurstSize()
+	default:
+		return rc.BurstSize() + max(0, rc.Debt)
+	}
+}
+
+// CheckTokens rejects requests for more tokens than the algorithm can ever grant under the policy
+func (rc *RateLimitConfig) CheckTokens(algorithm string, tokens int64) error {
+	if limit := rc.MaxTokens(algorithm); limit > 0 && tokens > limit {
+		return invalid(ErrorCodeTokensAboveCapacity, "%d tokens requested, but the key's %s holds at most %d", tokens, algorithm, limit)
+	}
+	return nil
+}
+
+// IsPriority reports whether the priority class exists
+func IsPriority(name string) bool {
+	_, ok := priorityRanks[name]
+	return ok
+}
+
+// EffectivePriority returns the class a request runs at. A request may lower its class
+// below what the caller is allowed (the JWT claim, normal without one); asking for a higher
+// one is rejected rather than quietly run at a lower class. An empty or unknown request
+// class runs at the allowed class.
+func EffectivePriority(requested string, allowed string) (string, error) {
+	if _, ok := priorityRanks[allowed]; !ok {
+		allowed = PriorityNormal
+	}
+	if _, ok := priorityRanks[requested]; !ok {
+		return allowed, nil
+	}
+	if priorityRanks[requested] > priorityRanks[allowed] {
+		return "", &ValidationError{
+			Status:  http.StatusForbidden,
+			Code:    ErrorCodePriorityNotGranted,
+			Message: fmt.Sprintf("priority %q requested, but the token grants at most %q", requested, allowed),
+		}
+	}
+	return requested, nil
+}
+
+// Validate checks the AcquireRequest without changing it. Omitted fields keep their
+// defaults (one token, the policy's algorithm, the caller's priority), but values that
+// are set must be valid. Errors are *ValidationError.
+func (ar *AcquireRequest) Validate() error {
+	if ar.Tokens != nil && *ar.Tokens <= 0 {
+		return invalid(ErrorCodeInvalidTokens, "tokens must be positive, got %d", *ar.Tokens)
+	}
+	if ar.Algorithm != "" && !IsAlgorithm(ar.Algorithm) {
+		return invalid(ErrorCodeUnknownAlgorithm, "unknown algorithm %q", ar.Algorithm)
+	}
+	if ar.Priority != "" && !IsPriority(ar.Priority) {
+		return invalid(ErrorCodeUnknownPriority, "unknown priority %q", ar.Priority)
+	}
+	return nil
+}
+
+// Validate checks the FeedbackRequest; the reporting service must name the key.
+// Errors are *ValidationError.
+func (fr *FeedbackRequest) Validate() error {
+	if fr.Key == "" {
+		return invalid(ErrorCodeMissingKey, "key is required")
+	}
 	return nil
 }
 
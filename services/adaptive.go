@@ -0,0 +1,212 @@
+package services
+
+import (
+	"errors"
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/Appy29/rate-limiter/models"
+	"github.com/go-redis/redis/v8"
+)
+
+// ErrNotAdaptive is returned for feedback on a key whose policy has no adaptive limit
+var ErrNotAdaptive = errors.New("key has no adaptive policy")
+
+const adaptiveKeyPrefix = "adaptive:"
+
+// AIMD defaults for unset AdaptiveConfig fields
+const (
+	defaultAdaptiveIncrease = 1
+	defaultAdaptiveDecrease = 0.5
+)
+
+// adaptiveCacheTTL is how long an instance applies a limit before re-reading it from the store
+const adaptiveCacheTTL = time.Second
+
+// AdaptiveStep is one AIMD move of a key's limit, with the policy's defaults filled in
+type AdaptiveStep struct {
+	Initial  int64   // limit before any feedback (the policy's capacity)
+	Healthy  bool    // raise by Increase, or cut by the Decrease factor
+	Increase int64   // added when healthy
+	Decrease float64 // multiplier when unhealthy
+	Min      int64   // never cut below this
+	Max      int64   // never raise above this
+}
+
+// adaptiveStepScript moves a key's limit by one AIMD step and returns the new limit.
+// The limit is kept without expiry: only keys with an adaptive policy have one.
+// ARGV: initial, healthy (1 or 0), increase, decrease, min, max.
+var adaptiveStepScript = redis.NewScript(`
+local limit = tonumber(redis.call('GET', KEYS[1])) or tonumber(ARGV[1])
+
+if ARGV[2] == '1' then
+	limit = limit + tonumber(ARGV[3])
+else
+	limit = math.floor(limit * tonumber(ARGV[4]))
+end
+limit = math.max(tonumber(ARGV[5]), math.min(tonumber(ARGV[6]), limit))
+
+redis.call('SET', KEYS[1], limit)
+return limit
+`)
+
+// next applies the step to the current limit
+func (step AdaptiveStep) next(limit int64) int64 {
+	if step.Healthy {
+		limit += step.Increase
+	} else {
+		limit = int64(math.Floor(float64(limit) * step.Decrease))
+	}
+	return max(step.Min, min(step.Max, limit))
+}
+
+// adaptiveLimits applies the AIMD limits of adaptive keys. The limits live in the store,
+// so every app instance enforces the same limit whichever one received the feedback;
+// each instance caches a limit for adaptiveCacheTTL to keep the store off the request path.
+type adaptiveLimits struct {
+	store  Store
+	cached map[string]cachedLimit
+	mutex  sync.Mutex
+}
+
+// cachedLimit is a limit as last read from the store
+type cachedLimit struct {
+	limit  int64
+	exists bool // whether feedback has moved the limit yet
+	readAt time.Time
+}
+
+// newAdaptiveLimits creates a limit cache over the store
+func newAdaptiveLimits(store Store) *adaptiveLimits {
+	return &adaptiveLimits{store: store, cached: make(map[string]cachedLimit)}
+}
+
+// apply returns the policy with Capacity, Burst and RefillRate scaled to the key's current limit
+func (al *adaptiveLimits) apply(policy models.RateLimitConfig) models.RateLimitConfig {
+	if policy.Adaptive == nil || policy.Capacity <= 0 {
+		return policy
+	}
+
+	limit, exists := al.current(policy.Key)
+	if !exists {
+		return policy
+	}
+	// The policy may have been tightened since the limit was stored
+	return scalePolicy(policy, clampLimit(*policy.Adaptive, policy.Capacity, limit))
+}
+
+// current returns the key's limit, reading the store when the cached one is stale.
+// If the store cannot be read the stale limit is kept.
+func (al *adaptiveLimits) current(key string) (int64, bool) {
+	al.mutex.Lock()
+	cached, exists := al.cached[key]
+	al.mutex.Unlock()
+
+	if exists && time.Since(cached.readAt) < adaptiveCacheTTL {
+		return cached.limit, cached.exists
+	}
+
+	limit, stored, err := al.store.AdaptiveLimit(key)
+	if err != nil {
+		log.Printf("Failed to read adaptive limit for %s: %v", key, err)
+		return cached.limit, cached.exists
+	}
+
+	al.remember(key, cachedLimit{limit: limit, exists: stored, readAt: time.Now()})
+	return limit, stored
+}
+
+// remember caches a limit read from or written to the store
+func (al *adaptiveLimits) remember(key string, limit cachedLimit) {
+	al.mutex.Lock()
+	defer al.mutex.Unlock()
+
+	al.cached[key] = limit
+}
+
+// feedback judges a health report and moves the key's limit in the store: up by Increase
+// when healthy, down by the Decrease factor otherwise, clamped to [MinLimit, MaxLimit]
+func (al *adaptiveLimits) feedback(policy models.RateLimitConfig, report models.FeedbackRequest) (healthy bool, limit int64, err error) {
+	adaptive := *policy.Adaptive
+	healthy = isHealthy(adaptive, report)
+
+	limit, err = al.store.AdjustAdaptiveLimit(policy.Key, adaptiveStep(adaptive, policy.Capacity, healthy))
+	if err != nil {
+		return healthy, 0, err
+	}
+
+	al.remember(policy.Key, cachedLimit{limit: limit, exists: true, readAt: time.Now()})
+	return healthy, limit, nil
+}
+
+// adaptiveStep fills in the policy's AIMD defaults
+func adaptiveStep(adaptive models.AdaptiveConfig, capacity int64, healthy bool) AdaptiveStep {
+	step := AdaptiveStep{
+		Initial:  capacity,
+		Healthy:  healthy,
+		Increase: adaptive.Increase,
+		Decrease: adaptive.Decrease,
+		Min:      clampLimit(adaptive, capacity, math.MinInt64),
+		Max:      clampLimit(adaptive, capacity, math.MaxInt64),
+	}
+	if step.Increase <= 0 {
+		step.Increase = defaultAdaptiveIncrease
+	}
+	if step.Decrease <= 0 || step.Decrease >= 1 {
+		step.Decrease = defaultAdaptiveDecrease
+	}
+	return step
+}
+
+// isHealthy decides whether a report should raise or cut the limit
+func isHealthy(adaptive models.AdaptiveConfig, report models.FeedbackRequest) bool {
+	if report.Healthy != nil {
+		return *report.Healthy
+	}
+	if report.ErrorRate > adaptive.MaxErrorRate {
+		return false
+	}
+	if adaptive.MaxLatencyMs > 0 && report.LatencyMs > adaptive.MaxLatencyMs {
+		return false
+	}
+	return true
+}
+
+// clampLimit keeps a limit within the policy's bounds
+func clampLimit(adaptive models.AdaptiveConfig, capacity int64, limit int64) int64 {
+	minLimit := adaptive.MinLimit
+	if minLimit <= 0 {
+		minLimit = 1
+	}
+	maxLimit := adaptive.MaxLimit
+	if maxLimit <= 0 {
+		maxLimit = capacity
+	}
+
+	if limit > maxLimit {
+		limit = maxLimit
+	}
+	if limit < minLimit {
+		limit = minLimit
+	}
+	return limit
+}
+
+// scalePolicy resizes a policy to the given limit, keeping its shape: the bucket
+// holds limit tokens and refills (or drains) in the same time as before
+func scalePolicy(policy models.RateLimitConfig, limit int64) models.RateLimitConfig {
+	if limit == policy.Capacity {
+		return policy
+	}
+
+	factor := float64(limit) / float64(policy.Capacity)
+
+	if policy.Burst > 0 {
+		policy.Burst = max(1, int64(math.Round(float64(policy.Burst)*factor)))
+	}
+	policy.RefillRate = time.Duration(float64(policy.RefillRate) / factor)
+	policy.Capacity = limit
+	return policy
+}
@@ -0,0 +1,101 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Appy29/rate-limiter/models"
+)
+
+var adaptiveTestPolicy = models.RateLimitConfig{
+	Key:        "adaptive_user",
+	Algorithm:  "token_bucket",
+	Capacity:   10,
+	RefillRate: time.Second,
+	Adaptive:   &models.AdaptiveConfig{MinLimit: 2, MaxLimit: 12, Increase: 1, Decrease: 0.5, MaxLatencyMs: 500},
+}
+
+func TestAdaptiveLimits_AIMD(t *testing.T) {
+	_, redisStore := newTestRedisStore(t)
+	stores := map[string]Store{
+		"memory": newMemoryStore(newBoundedStore[*tokenBucket](0, 0, 0), newBoundedStore[*leakyBucket](0, 0, 0)),
+		"redis":  redisStore,
+	}
+	unhealthy := false
+
+	steps := []struct {
+		name   string
+		report models.FeedbackRequest
+		want   int64
+	}{
+		{"healthy raises additively", models.FeedbackRequest{}, 11},
+		{"capped at max", models.FeedbackRequest{LatencyMs: 100}, 12},
+		{"still capped", models.FeedbackRequest{}, 12},
+		{"errors cut multiplicatively", models.FeedbackRequest{ErrorRate: 0.2}, 6},
+		{"slow responses cut", models.FeedbackRequest{LatencyMs: 900}, 3},
+		{"explicit verdict wins", models.FeedbackRequest{Healthy: &unhealthy}, 2},
+		{"floored at min", models.FeedbackRequest{ErrorRate: 1}, 2},
+		{"recovers", models.FeedbackRequest{}, 3},
+	}
+
+	for name, store := range stores {
+		limits := newAdaptiveLimits(store)
+		for _, step := range steps {
+			if _, got, err := limits.feedback(adaptiveTestPolicy, step.report); got != step.want || err != nil {
+				t.Fatalf("%s: %s: expected limit %d, got %d (%v)", name, step.name, step.want, got, err)
+			}
+		}
+	}
+}
+
+func TestAdaptiveLimits_SharedThroughStore(t *testing.T) {
+	_, store := newTestRedisStore(t)
+	receiving := newAdaptiveLimits(store)
+	other := newAdaptiveLimits(store)
+
+	// The other instance caches the static limit before any feedback
+	if got := other.apply(adaptiveTestPolicy); got.Capacity != 10 {
+		t.Fatalf("Expected the static capacity before feedback, got %d", got.Capacity)
+	}
+
+	if _, limit, err := receiving.feedback(adaptiveTestPolicy, models.FeedbackRequest{ErrorRate: 0.5}); limit != 5 || err != nil {
+		t.Fatalf("Expected the cut to 5, got %d (%v)", limit, err)
+	}
+
+	// Once its cache expires, the other instance applies the limit the store holds
+	other.cached[adaptiveTestPolicy.Key] = cachedLimit{readAt: time.Now().Add(-adaptiveCacheTTL)}
+	if got := other.apply(adaptiveTestPolicy); got.Capacity != 5 {
+		t.Errorf("Expected every instance to apply the stored limit 5, got %d", got.Capacity)
+	}
+}
+
+func TestAdaptiveLimits_ScalesPolicy(t *testing.T) {
+	limits := newAdaptiveLimits(newMemoryStore(newBoundedStore[*tokenBucket](0, 0, 0), newBoundedStore[*leakyBucket](0, 0, 0)))
+
+	if got := limits.apply(adaptiveTestPolicy); got.Capacity != 10 || got.RefillRate != time.Second {
+		t.Errorf("Expected the static policy before any feedback, got capacity %d every %v", got.Capacity, got.RefillRate)
+	}
+
+	limits.feedback(adaptiveTestPolicy, models.FeedbackRequest{ErrorRate: 0.5}) // 10 -> 5
+
+	scaled := limits.apply(adaptiveTestPolicy)
+	if scaled.Capacity != 5 {
+		t.Errorf("Expected capacity 5 after the cut, got %d", scaled.Capacity)
+	}
+	if scaled.RefillRate != 2*time.Second {
+		t.Errorf("Expected the refill rate to halve with the limit, got one token every %v", scaled.RefillRate)
+	}
+}
+
+func TestMemoryStore_FollowsAdaptiveLimit(t *testing.T) {
+	store := newMemoryStore(newBoundedStore[*tokenBucket](0, 0, 0), newBoundedStore[*leakyBucket](0, 0, 0))
+	policy := models.RateLimitConfig{Key: "adaptive_user", Capacity: 10, RefillRate: time.Hour, RefillTokens: 1}
+
+	store.ConsumeTokens(policy.Key, policy, 2) // 8 left
+
+	store.ConsumeTokens(policy.Key, scalePolicy(policy, 5), 0)
+	status, _ := store.TokenBucketStatus(policy.Key, policy)
+	if status.Capacity != 5 || status.Level != 5 {
+		t.Errorf("Expected the bucket to shrink to 5/5, got %d/%d", status.Level, status.Capacity)
+	}
+}
@@ -0,0 +1,193 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Bucket state is stored in Redis as a hash of integer fields. Older deployments
+// stored a cjson-encoded string under the same key; both the scripts and the Go
+// readers accept that legacy format, and the scripts rewrite it as a hash.
+//
+// Scripts keep time in integer microseconds. Lua numbers are doubles, exact only up
+// to 2^53: a Unix time in nanoseconds is past that and would be rounded to 256 ns
+// steps, while microseconds stay exact for the next few centuries.
+
+// bucketFields names the hash fields of one algorithm's state
+type bucketFields struct {
+	level      string // tokens left or queue length
+	last       string // last refill or leak (µs)
+	rate       string // refill or leak interval (µs)
+	frac       string // optional fraction of a token in millionths
+	legacyLast string // last refill or leak in the legacy JSON (ns)
+	legacyRate string // refill or leak interval in the legacy JSON (ns)
+}
+
+var (
+	tokenBucketFields = bucketFields{
+		level: "tokens", last: "last_refill_us", rate: "refill_rate_us", frac: "token_millionths",
+		legacyLast: "last_refill_ns", legacyRate: "refill_rate_ns",
+	}
+	leakyBucketFields = bucketFields{
+		level: "queue_length", last: "last_leak_us", rate: "leak_rate_us",
+		legacyLast: "last_leak_ns", legacyRate: "leak_rate_ns",
+	}
+)
+
+// bucketStateLua is prepended to every bucket script.
+// current_time_us returns the caller's time, or the Redis server time when the caller sends 0;
+// effects replication keeps replicas consistent with the non-deterministic TIME call.
+// read_bucket returns level and timestamp in µs (nil for a new bucket), migrating legacy
+// JSON, whose timestamp field has the same name ending in _ns instead of _us.
+// int formats a Lua number as an integer so Redis stores "1700000000000000", not "1.7e+15".
+const bucketStateLua = `
+local function current_time_us(client_now_us)
+	if client_now_us > 0 then
+		return client_now_us
+	end
+	if redis.replicate_commands then
+		redis.replicate_commands()
+	end
+	local server_time = redis.call('TIME')
+	return tonumber(server_time[1]) * 1000000 + tonumber(server_time[2])
+end
+
+local function read_bucket(key, level_field, last_field)
+	local key_type = redis.call('TYPE', key)['ok']
+	if key_type == 'string' then
+		local data = cjson.decode(redis.call('GET', key))
+		redis.call('DEL', key)
+		local last_ns = tonumber(data[string.gsub(last_field, '_us$', '_ns')])
+		if last_ns == nil then
+			return tonumber(data[level_field]), nil
+		end
+		return tonumber(data[level_field]), math.floor(last_ns / 1000)
+	end
+	local values = redis.call('HMGET', key, level_field, last_field)
+	return tonumber(values[1]), tonumber(values[2])
+end
+
+local function int(n)
+	return string.format('%d', n)
+end
+`
+
+// Clock sources selectable through config
+const (
+	ClockLocal = "local" // each app instance's own clock
+	ClockRedis = "redis" // the Redis server's TIME, shared by all app instances
+)
+
+// scriptNow returns the now_us argument for the scripts; 0 makes them read the server time
+func scriptNow(serverTime bool) int64 {
+	if serverTime {
+		return 0
+	}
+	return time.Now().UnixMicro()
+}
+
+// scriptRate converts a refill or leak interval to the scripts' microseconds.
+// Sub-microsecond intervals round up to one so the scripts never divide by zero.
+func scriptRate(rate time.Duration) int64 {
+	return max(1, rate.Microseconds())
+}
+
+// redisNow returns the current time from the same source the scripts use
+func redisNow(ctx context.Context, client *redis.Client, serverTime bool) time.Time {
+	if serverTime {
+		if now, err := client.Time(ctx).Result(); err == nil {
+			return now
+		}
+	}
+	return time.Now()
+}
+
+// keyExpiresAt converts the key's remaining TTL into a deadline (zero if it has none)
+func keyExpiresAt(ctx context.Context, client *redis.Client, key string) time.Time {
+	ttl, err := client.PTTL(ctx, key).Result()
+	if err != nil || ttl <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(ttl)
+}
+
+// bucketState is a decoded bucket
+type bucketState struct {
+	Capacity int64
+	Level    int64
+	Fraction float64 // fractional tokens on top of Level
+	Rate     time.Duration
+	Last     time.Time
+}
+
+// readBucketState loads a bucket hash (or legacy JSON string).
+// exists is false when the key has no state; err is set for Redis failures only.
+func readBucketState(ctx context.Context, client *redis.Client, key string, fields bucketFields) (state bucketState, exists bool, err error) {
+	values, err := client.HMGet(ctx, key, "capacity", fields.level, fields.rate, fields.last).Result()
+	if err != nil {
+		if strings.HasPrefix(err.Error(), "WRONGTYPE") {
+			return readLegacyBucketState(ctx, client, key, fields)
+		}
+		return bucketState{}, false, err
+	}
+
+	parsed := make([]int64, len(values))
+	for i, value := range values {
+		text, ok := value.(string)
+		if !ok {
+			return bucketState{}, false, nil // missing field means no (complete) state
+		}
+		if parsed[i], err = strconv.ParseInt(text, 10, 64); err != nil {
+			return bucketState{}, false, nil
+		}
+	}
+
+	state = bucketState{
+		Capacity: parsed[0],
+		Level:    parsed[1],
+		Rate:     time.Duration(parsed[2]) * time.Microsecond,
+		Last:     time.UnixMicro(parsed[3]),
+	}
+
+	if fields.frac != "" {
+		if millionths, err := client.HGet(ctx, key, fields.frac).Int64(); err == nil {
+			state.Fraction = float64(millionths) / 1e6
+		}
+	}
+
+	return state, true, nil
+}
+
+// readLegacyBucketState decodes a bucket stored by older versions as a JSON string.
+// Its timestamps were encoded by cjson as floats, so they are only accurate to ~14 digits.
+func readLegacyBucketState(ctx context.Context, client *redis.Client, key string, fields bucketFields) (bucketState, bool, error) {
+	bucketData, err := client.Get(ctx, key).Result()
+	if err == redis.Nil {
+		return bucketState{}, false, nil
+	}
+	if err != nil {
+		return bucketState{}, false, err
+	}
+
+	var data map[string]interface{}
+	if err := json.Unmarshal([]byte(bucketData), &data); err != nil {
+		return bucketState{}, false, nil
+	}
+
+	number := func(field string) int64 {
+		value, _ := data[field].(float64)
+		return int64(value)
+	}
+
+	return bucketState{
+		Capacity: number("capacity"),
+		Level:    number(fields.level),
+		Rate:     time.Duration(number(fields.legacyRate)),
+		Last:     time.Unix(0, number(fields.legacyLast)),
+	}, true, nil
+}
@@ -0,0 +1,212 @@
+package services
+
+import (
+	"container/list"
+	"hash/crc32"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// boundedStore is a size-capped, sharded map of in-memory buckets.
+// Each shard keeps its own LRU list; the least recently used bucket is evicted
+// when a shard is full, and buckets idle for longer than idleTTL are dropped lazily.
+type boundedStore[T any] struct {
+	shards      []*storeShard[T]
+	maxPerShard int
+	idleTTL     time.Duration
+
+	capacityEvictions int64 // evicted because the shard was full
+	idleEvictions     int64 // evicted because they were idle too long
+
+	now func() time.Time // swapped out in tests
+}
+
+// storeShard is one lock domain of a boundedStore
+type storeShard[T any] struct {
+	items map[string]*list.Element
+	lru   *list.List // front = most recently used
+	mutex sync.Mutex
+}
+
+// storeEntry is a bucket with its bookkeeping
+type storeEntry[T any] struct {
+	key      string
+	value    T
+	lastUsed time.Time
+}
+
+// newBoundedStore creates a store holding at most maxSize buckets across shardCount shards
+func newBoundedStore[T any](maxSize int, idleTTL time.Duration, shardCount int) *boundedStore[T] {
+	if shardCount <= 0 {
+		shardCount = 16
+	}
+	if maxSize <= 0 {
+		maxSize = 100000
+	}
+	if maxSize < shardCount {
+		maxSize = shardCount
+	}
+
+	s := &boundedStore[T]{
+		shards:      make([]*storeShard[T], shardCount),
+		maxPerShard: maxSize / shardCount,
+		idleTTL:     idleTTL,
+		now:         time.Now,
+	}
+
+	for i := range s.shards {
+		s.shards[i] = &storeShard[T]{
+			items: make(map[string]*list.Element),
+			lru:   list.New(),
+		}
+	}
+
+	return s
+}
+
+// newUnboundedStore creates a sharded store that never evicts, for state that must not be lost
+func newUnboundedStore[T any](shardCount int) *boundedStore[T] {
+	s := newBoundedStore[T](0, 0, shardCount)
+	s.maxPerShard = math.MaxInt
+	return s
+}
+
+// newBoundedStoreLike creates a store with the same size and sharding as another
+func newBoundedStoreLike[T any, U any](other *boundedStore[U], idleTTL time.Duration) *boundedStore[T] {
+	s := newBoundedStore[T](0, idleTTL, len(other.shards))
+	s.maxPerShard = other.maxPerShard
+	return s
+}
+
+// GetOrCreate returns the bucket for key, creating it if needed
+func (s *boundedStore[T]) GetOrCreate(key string, create func() T) T {
+	shard := s.shardFor(key)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	now := s.now()
+
+	if element, exists := shard.items[key]; exists {
+		entry := element.Value.(*storeEntry[T])
+		entry.lastUsed = now
+		shard.lru.MoveToFront(element)
+		return entry.value
+	}
+
+	s.evictIdle(shard, now)
+	for shard.lru.Len() >= s.maxPerShard {
+		s.removeElement(shard, shard.lru.Back())
+		atomic.AddInt64(&s.capacityEvictions, 1)
+	}
+
+	entry := &storeEntry[T]{key: key, value: create(), lastUsed: now}
+	shard.items[key] = shard.lru.PushFront(entry)
+	return entry.value
+}
+
+// Get returns the bucket for key without creating or touching it
+func (s *boundedStore[T]) Get(key string) (T, bool) {
+	shard := s.shardFor(key)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	if element, exists := shard.items[key]; exists {
+		return element.Value.(*storeEntry[T]).value, true
+	}
+
+	var zero T
+	return zero, false
+}
+
+// Delete removes the bucket for key
+func (s *boundedStore[T]) Delete(key string) {
+	shard := s.shardFor(key)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	if element, exists := shard.items[key]; exists {
+		s.removeElement(shard, element)
+	}
+}
+
+// Keys returns the keys accepted by the filter
+func (s *boundedStore[T]) Keys(filter func(key string) bool) []string {
+	var keys []string
+
+	for _, shard := range s.shards {
+		shard.mutex.Lock()
+		for key := range shard.items {
+			if filter(key) {
+				keys = append(keys, key)
+			}
+		}
+		shard.mutex.Unlock()
+	}
+
+	return keys
+}
+
+// Sweep removes the buckets done reports as finished with and returns how many it removed.
+// done runs under the shard lock, so no request can fetch a bucket while it is judged.
+func (s *boundedStore[T]) Sweep(done func(value T) bool) int {
+	removed := 0
+
+	for _, shard := range s.shards {
+		shard.mutex.Lock()
+		for _, element := range shard.items {
+			if done(element.Value.(*storeEntry[T]).value) {
+				s.removeElement(shard, element)
+				removed++
+			}
+		}
+		shard.mutex.Unlock()
+	}
+
+	return removed
+}
+
+// Len returns the number of buckets held
+func (s *boundedStore[T]) Len() int {
+	total := 0
+
+	for _, shard := range s.shards {
+		shard.mutex.Lock()
+		total += shard.lru.Len()
+		shard.mutex.Unlock()
+	}
+
+	return total
+}
+
+// Evictions returns the eviction counters by reason
+func (s *boundedStore[T]) Evictions() (capacity int64, idle int64) {
+	return atomic.LoadInt64(&s.capacityEvictions), atomic.LoadInt64(&s.idleEvictions)
+}
+
+// evictIdle drops buckets from the back of the LRU that have been idle too long (caller holds the lock)
+func (s *boundedStore[T]) evictIdle(shard *storeShard[T], now time.Time) {
+	if s.idleTTL <= 0 {
+		return
+	}
+
+	for element := shard.lru.Back(); element != nil; element = shard.lru.Back() {
+		if now.Sub(element.Value.(*storeEntry[T]).lastUsed) < s.idleTTL {
+			return
+		}
+		s.removeElement(shard, element)
+		atomic.AddInt64(&s.idleEvictions, 1)
+	}
+}
+
+// removeElement unlinks an entry (caller holds the lock)
+func (s *boundedStore[T]) removeElement(shard *storeShard[T], element *list.Element) {
+	entry := shard.lru.Remove(element).(*storeEntry[T])
+	delete(shard.items, entry.key)
+}
+
+// shardFor picks the shard for a key
+func (s *boundedStore[T]) shardFor(key string) *storeShard[T] {
+	return s.shards[crc32.ChecksumIEEE([]byte(key))%uint32(len(s.shards))]
+}
@@ -0,0 +1,66 @@
+package services
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBoundedStore_EvictsLeastRecentlyUsed(t *testing.T) {
+	store := newBoundedStore[int](2, 0, 1)
+
+	store.GetOrCreate("a", func() int { return 1 })
+	store.GetOrCreate("b", func() int { return 2 })
+	store.GetOrCreate("a", func() int { return -1 }) // touch a, b is now LRU
+	store.GetOrCreate("c", func() int { return 3 })
+
+	if _, exists := store.Get("b"); exists {
+		t.Error("Expected least recently used bucket to be evicted")
+	}
+	if value, exists := store.Get("a"); !exists || value != 1 {
+		t.Errorf("Expected bucket a to survive with its original value, got %d (exists=%v)", value, exists)
+	}
+	if capacity, _ := store.Evictions(); capacity != 1 {
+		t.Errorf("Expected 1 capacity eviction, got %d", capacity)
+	}
+}
+
+func TestBoundedStore_EvictsIdleBuckets(t *testing.T) {
+	store := newBoundedStore[int](100, time.Minute, 1)
+	now := time.Now()
+	store.now = func() time.Time { return now }
+
+	store.GetOrCreate("idle", func() int { return 1 })
+
+	now = now.Add(2 * time.Minute)
+	store.GetOrCreate("fresh", func() int { return 2 })
+
+	if _, exists := store.Get("idle"); exists {
+		t.Error("Expected idle bucket to be evicted")
+	}
+	if _, idle := store.Evictions(); idle != 1 {
+		t.Errorf("Expected 1 idle eviction, got %d", idle)
+	}
+}
+
+func TestBoundedStore_SizeCapUnderKeySpray(t *testing.T) {
+	maxSize := 64
+	store := newBoundedStore[int](maxSize, 0, 8)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				store.GetOrCreate(fmt.Sprintf("attacker-%d-%d", g, i), func() int { return i })
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	if size := store.Len(); size > maxSize {
+		t.Errorf("Expected at most %d buckets, got %d", maxSize, size)
+	}
+}
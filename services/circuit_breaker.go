@@ -0,0 +1,267 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// ErrCircuitOpen is returned without touching the network while a shard's breaker is open
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// BreakerState is the state of a circuit breaker
+type BreakerState int32
+
+const (
+	BreakerClosed   BreakerState = iota // requests flow normally
+	BreakerHalfOpen                     // a limited number of probe requests are let through
+	BreakerOpen                         // requests fail fast until the cool-down expires
+)
+
+// String returns the state name used in logs, metrics and /health
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerHalfOpen:
+		return "half_open"
+	case BreakerOpen:
+		return "open"
+	default:
+		return "unknown"
+	}
+}
+
+// CircuitBreakerSettings configures when a breaker trips and recovers
+type CircuitBreakerSettings struct {
+	ErrorThreshold   float64       // failure ratio in the window that opens the breaker
+	MinRequests      int           // requests needed in the window before the ratio counts
+	Window           time.Duration // length of the counting window
+	Cooldown         time.Duration // how long the breaker stays open
+	HalfOpenRequests int           // successful probes needed to close again
+}
+
+// CircuitBreaker tracks the error rate of one Redis shard
+type CircuitBreaker struct {
+	name     string
+	settings CircuitBreakerSettings
+
+	state       BreakerState
+	openedAt    time.Time
+	windowStart time.Time
+	requests    int
+	failures    int
+
+	halfOpenInFlight  int
+	halfOpenSuccesses int
+
+	onStateChange func(name string, from, to BreakerState)
+	now           func() time.Time // swapped out in tests
+	mutex         sync.Mutex
+}
+
+// NewCircuitBreaker creates a closed circuit breaker
+func NewCircuitBreaker(name string, settings CircuitBreakerSettings, onStateChange func(name string, from, to BreakerState)) *CircuitBreaker {
+	if settings.ErrorThreshold <= 0 || settings.ErrorThreshold > 1 {
+		settings.ErrorThreshold = 0.5
+	}
+	if settings.MinRequests <= 0 {
+		settings.MinRequests = 10
+	}
+	if settings.Window <= 0 {
+		settings.Window = 10 * time.Second
+	}
+	if settings.Cooldown <= 0 {
+		settings.Cooldown = 5 * time.Second
+	}
+	if settings.HalfOpenRequests <= 0 {
+		settings.HalfOpenRequests = 1
+	}
+
+	return &CircuitBreaker{
+		name:          name,
+		settings:      settings,
+		state:         BreakerClosed,
+		windowStart:   time.Now(),
+		onStateChange: onStateChange,
+		now:           time.Now,
+	}
+}
+
+// Allow reports whether a request may be sent to the shard
+func (cb *CircuitBreaker) Allow() error {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	switch cb.currentState() {
+	case BreakerOpen:
+		return ErrCircuitOpen
+	case BreakerHalfOpen:
+		if cb.halfOpenInFlight >= cb.settings.HalfOpenRequests {
+			return ErrCircuitOpen
+		}
+		cb.halfOpenInFlight++
+	}
+
+	return nil
+}
+
+// Record reports the outcome of a request that Allow let through
+func (cb *CircuitBreaker) Record(failed bool) {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	now := cb.now()
+
+	switch cb.currentState() {
+	case BreakerHalfOpen:
+		if cb.halfOpenInFlight > 0 {
+			cb.halfOpenInFlight--
+		}
+		if failed {
+			cb.transition(BreakerOpen, now)
+			return
+		}
+		cb.halfOpenSuccesses++
+		if cb.halfOpenSuccesses >= cb.settings.HalfOpenRequests {
+			cb.transition(BreakerClosed, now)
+		}
+
+	case BreakerClosed:
+		if now.Sub(cb.windowStart) > cb.settings.Window {
+			cb.resetWindow(now)
+		}
+
+		cb.requests++
+		if failed {
+			cb.failures++
+		}
+
+		if cb.requests >= cb.settings.MinRequests &&
+			float64(cb.failures)/float64(cb.requests) >= cb.settings.ErrorThreshold {
+			cb.transition(BreakerOpen, now)
+		}
+	}
+}
+
+// State returns the current state, moving open breakers to half-open after the cool-down
+func (cb *CircuitBreaker) State() BreakerState {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	return cb.currentState()
+}
+
+// currentState applies the cool-down expiry (caller holds the lock)
+func (cb *CircuitBreaker) currentState() BreakerState {
+	if cb.state == BreakerOpen && cb.now().Sub(cb.openedAt) >= cb.settings.Cooldown {
+		cb.transition(BreakerHalfOpen, cb.now())
+	}
+	return cb.state
+}
+
+// transition changes state and resets counters (caller holds the lock)
+func (cb *CircuitBreaker) transition(to BreakerState, now time.Time) {
+	from := cb.state
+	if from == to {
+		return
+	}
+
+	cb.state = to
+	cb.halfOpenInFlight = 0
+	cb.halfOpenSuccesses = 0
+	cb.resetWindow(now)
+	if to == BreakerOpen {
+		cb.openedAt = now
+	}
+
+	log.Printf("Circuit breaker %s: %s -> %s", cb.name, from, to)
+	if cb.onStateChange != nil {
+		cb.onStateChange(cb.name, from, to)
+	}
+}
+
+// resetWindow starts a new counting window (caller holds the lock)
+func (cb *CircuitBreaker) resetWindow(now time.Time) {
+	cb.windowStart = now
+	cb.requests = 0
+	cb.failures = 0
+}
+
+// breakerBypassKey marks a context whose commands the breaker neither guards nor counts
+type breakerBypassKey struct{}
+
+// withoutBreaker sends commands made with ctx around the shard's circuit breaker.
+// Health probes use it: an open breaker must not fail the probe that decides whether
+// the instance is healthy, and probes must not take the half-open trial slots.
+func withoutBreaker(ctx context.Context) context.Context {
+	return context.WithValue(ctx, breakerBypassKey{}, true)
+}
+
+// bypassesBreaker reports whether ctx was created by withoutBreaker
+func bypassesBreaker(ctx context.Context) bool {
+	bypass, _ := ctx.Value(breakerBypassKey{}).(bool)
+	return bypass
+}
+
+// breakerHook plugs a circuit breaker into a go-redis client so every command is guarded
+type breakerHook struct {
+	breaker *CircuitBreaker
+}
+
+func (h breakerHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	if bypassesBreaker(ctx) {
+		return ctx, nil
+	}
+	return ctx, h.breaker.Allow()
+}
+
+func (h breakerHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	if bypassesBreaker(ctx) {
+		return nil
+	}
+	// Commands rejected by the breaker itself never reached Redis
+	if !errors.Is(cmd.Err(), ErrCircuitOpen) {
+		h.breaker.Record(isBackendFailure(cmd.Err()))
+	}
+	return nil
+}
+
+func (h breakerHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	if bypassesBreaker(ctx) {
+		return ctx, nil
+	}
+	return ctx, h.breaker.Allow()
+}
+
+func (h breakerHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	if bypassesBreaker(ctx) {
+		return nil
+	}
+	failed := false
+	for _, cmd := range cmds {
+		if errors.Is(cmd.Err(), ErrCircuitOpen) {
+			return nil
+		}
+		if isBackendFailure(cmd.Err()) {
+			failed = true
+		}
+	}
+	h.breaker.Record(failed)
+	return nil
+}
+
+// isBackendFailure separates availability problems from normal replies.
+// Missing keys and errors returned by Redis itself (e.g. script errors) don't count.
+func isBackendFailure(err error) bool {
+	if err == nil || err == redis.Nil {
+		return false
+	}
+
+	var redisErr redis.Error
+	return !errors.As(err, &redisErr)
+}
@@ -0,0 +1,108 @@
+package services
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// newTestBreaker creates a breaker with a controllable clock
+func newTestBreaker(transitions *[]string) (*CircuitBreaker, *time.Time) {
+	now := time.Now()
+	cb := NewCircuitBreaker("redis-1", CircuitBreakerSettings{
+		ErrorThreshold:   0.5,
+		MinRequests:      4,
+		Window:           time.Minute,
+		Cooldown:         5 * time.Second,
+		HalfOpenRequests: 2,
+	}, func(name string, from, to BreakerState) {
+		*transitions = append(*transitions, from.String()+"->"+to.String())
+	})
+	cb.now = func() time.Time { return now }
+	return cb, &now
+}
+
+func TestCircuitBreaker_OpensOnErrorRate(t *testing.T) {
+	var transitions []string
+	cb, _ := newTestBreaker(&transitions)
+
+	// Below MinRequests the ratio is ignored
+	cb.Record(true)
+	cb.Record(true)
+	cb.Record(false)
+	if cb.State() != BreakerClosed {
+		t.Fatalf("Expected breaker to stay closed below min requests, got %s", cb.State())
+	}
+
+	// 3 failures out of 4 crosses the 50% threshold
+	cb.Record(true)
+	if cb.State() != BreakerOpen {
+		t.Fatalf("Expected breaker to open, got %s", cb.State())
+	}
+	if err := cb.Allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("Expected ErrCircuitOpen while open, got %v", err)
+	}
+	if len(transitions) != 1 || transitions[0] != "closed->open" {
+		t.Errorf("Expected one closed->open transition, got %v", transitions)
+	}
+}
+
+func TestCircuitBreaker_HalfOpenRecovery(t *testing.T) {
+	var transitions []string
+	cb, now := newTestBreaker(&transitions)
+
+	for i := 0; i < 4; i++ {
+		cb.Record(true)
+	}
+
+	// After the cool-down, a limited number of probes are allowed
+	*now = now.Add(6 * time.Second)
+	if cb.State() != BreakerHalfOpen {
+		t.Fatalf("Expected half-open after cool-down, got %s", cb.State())
+	}
+	if err := cb.Allow(); err != nil {
+		t.Fatalf("Expected first probe to be allowed, got %v", err)
+	}
+	if err := cb.Allow(); err != nil {
+		t.Fatalf("Expected second probe to be allowed, got %v", err)
+	}
+	if err := cb.Allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("Expected third concurrent probe to be rejected, got %v", err)
+	}
+
+	cb.Record(false)
+	cb.Record(false)
+	if cb.State() != BreakerClosed {
+		t.Fatalf("Expected breaker to close after successful probes, got %s", cb.State())
+	}
+}
+
+func TestCircuitBreaker_HalfOpenFailureReopens(t *testing.T) {
+	var transitions []string
+	cb, now := newTestBreaker(&transitions)
+
+	for i := 0; i < 4; i++ {
+		cb.Record(true)
+	}
+	*now = now.Add(6 * time.Second)
+
+	if err := cb.Allow(); err != nil {
+		t.Fatalf("Expected probe to be allowed, got %v", err)
+	}
+	cb.Record(true)
+
+	if cb.State() != BreakerOpen {
+		t.Errorf("Expected failed probe to reopen the breaker, got %s", cb.State())
+	}
+}
+
+func TestIsBackendFailure(t *testing.T) {
+	if isBackendFailure(nil) || isBackendFailure(redis.Nil) {
+		t.Error("Expected nil and redis.Nil not to count as failures")
+	}
+	if !isBackendFailure(errors.New("dial tcp: connection refused")) {
+		t.Error("Expected network errors to count as failures")
+	}
+}
@@ -0,0 +1,106 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/Appy29/rate-limiter/config"
+	"github.com/Appy29/rate-limiter/models"
+)
+
+const (
+	defaultOperation       = "*" // cost table entry that prices operations not listed in it
+	defaultMaxClientTokens = 100 // cap on client-supplied costs when the config sets none
+)
+
+// CostTable prices requests on the server so clients cannot pick their own cost.
+// Without a table clients name their cost, up to the configured maximum. Once a table
+// is configured every request is priced by it: unlisted operations pay the "*" entry,
+// or are rejected if there is none.
+type CostTable struct {
+	costs           map[string]int64 // operation -> tokens
+	maxClientTokens int64
+}
+
+// NewCostTable creates a cost table from the optional cost file
+func NewCostTable(cfg *config.Config) *CostTable {
+	ct := &CostTable{
+		costs:           make(map[string]int64),
+		maxClientTokens: cfg.Cost.MaxClientTokens,
+	}
+	if ct.maxClientTokens <= 0 {
+		ct.maxClientTokens = defaultMaxClientTokens
+	}
+
+	if cfg.Cost.File != "" {
+		costs, err := loadCostFile(cfg.Cost.File)
+		if err != nil {
+			log.Printf("Failed to load cost file %s: %v", cfg.Cost.File, err)
+		}
+		for _, cost := range costs {
+			ct.Set(cost)
+		}
+	}
+
+	return ct
+}
+
+// Set registers the cost of an operation
+func (ct *CostTable) Set(cost models.OperationCost) {
+	if cost.Operation == "" {
+		log.Printf("Cost table: ignoring entry without an operation")
+		return
+	}
+	if cost.Tokens <= 0 {
+		cost.Tokens = 1
+	}
+	ct.costs[cost.Operation] = cost.Tokens
+}
+
+// Cost returns the tokens a request is charged. With a table, operations cost what
+// the table says whatever the client sent, and an operation the table cannot price
+// is an error. Without one, the client's tokens are charged, and asking for more
+// than the configured maximum is an error.
+func (ct *CostTable) Cost(operation string, clientTokens int64) (int64, error) {
+	if len(ct.costs) == 0 {
+		if clientTokens > ct.maxClientTokens {
+			return 0, &models.ValidationError{
+				Code:    models.ErrorCodeTokensAboveLimit,
+				Message: fmt.Sprintf("%d tokens requested, at most %d allowed", clientTokens, ct.maxClientTokens),
+			}
+		}
+		return clientTokens, nil
+	}
+
+	if tokens, exists := ct.costs[operation]; exists {
+		return tokens, nil
+	}
+	if tokens, exists := ct.costs[defaultOperation]; exists {
+		return tokens, nil
+	}
+
+	if operation == "" {
+		return 0, &models.ValidationError{Code: models.ErrorCodeUnknownOperation, Message: "operation is required"}
+	}
+	return 0, &models.ValidationError{
+		Code:    models.ErrorCodeUnknownOperation,
+		Message: fmt.Sprintf("operation %q has no cost", operation),
+	}
+}
+
+// loadCostFile reads a JSON array of operation costs
+func loadCostFile(path string) ([]models.OperationCost, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var costs []models.OperationCost
+	if err := json.Unmarshal(data, &costs); err != nil {
+		return nil, fmt.Errorf("invalid cost file: %w", err)
+	}
+
+	return costs, nil
+}
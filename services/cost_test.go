@@ -0,0 +1,60 @@
+package services
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Appy29/rate-limiter/config"
+	"github.com/Appy29/rate-limiter/models"
+)
+
+func TestCostTable_Cost(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Cost.MaxClientTokens = 10
+
+	table := NewCostTable(cfg)
+	table.Set(models.OperationCost{Operation: "bulk_export", Tokens: 50})
+	table.Set(models.OperationCost{Operation: "POST /upload", Tokens: 20})
+
+	withDefault := NewCostTable(cfg)
+	withDefault.Set(models.OperationCost{Operation: "bulk_export", Tokens: 50})
+	withDefault.Set(models.OperationCost{Operation: "*", Tokens: 2})
+
+	tests := []struct {
+		name         string
+		table        *CostTable
+		operation    string
+		clientTokens int64
+		want         int64
+		wantCode     string
+	}{
+		{"table cost ignores the client", table, "bulk_export", 1, 50, ""},
+		{"varying cost is charged its worst case", table, "POST /upload", 1, 20, ""},
+		{"unknown operation is rejected", table, "search", 3, 0, models.ErrorCodeUnknownOperation},
+		{"missing operation is rejected", table, "", 1, 0, models.ErrorCodeUnknownOperation},
+		{"unknown operation pays the default entry", withDefault, "search", 1, 2, ""},
+		{"missing operation pays the default entry", withDefault, "", 1, 2, ""},
+		{"without a table the client's tokens are charged", NewCostTable(cfg), "", 3, 3, ""},
+		{"client tokens above the maximum are rejected", NewCostTable(cfg), "", 500, 0, models.ErrorCodeTokensAboveLimit},
+		{"client tokens are capped by default", NewCostTable(&config.Config{}), "", 101, 0, models.ErrorCodeTokensAboveLimit},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.table.Cost(tt.operation, tt.clientTokens)
+			if tt.wantCode != "" {
+				var verr *models.ValidationError
+				if !errors.As(err, &verr) || verr.Code != tt.wantCode {
+					t.Fatalf("Expected a %s error, got %v", tt.wantCode, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Expected cost %d, got %d", tt.want, got)
+			}
+		})
+	}
+}
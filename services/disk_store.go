@@ -0,0 +1,570 @@
+package services
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Appy29/rate-limiter/models"
+)
+
+const (
+	diskSnapshotFile = "snapshot.jsonl"
+	diskLogFile      = "wal.jsonl"
+)
+
+// diskStore is an embedded, single-node backend that keeps bucket state across restarts.
+// Buckets are evaluated in memory with the same semantics as the Redis scripts; every
+// successful change is appended to a write-ahead log, and the log is periodically
+// compacted into a snapshot. On startup the snapshot is loaded and the log replayed.
+type diskStore struct {
+	memory *memoryStore
+	dir    string
+
+	wal   *os.File
+	mutex sync.Mutex // guards wal and snapshotting
+
+	snapshotInterval time.Duration
+	stopCh           chan struct{}
+	stopOnce         sync.Once
+}
+
+// diskRecord is the persisted state of one bucket, counter, penalty or limit (one JSON line)
+type diskRecord struct {
+	Algorithm string  `json:"algorithm"`
+	Key       string  `json:"key"`
+	Capacity  int64   `json:"capacity"`
+	RateNs    int64   `json:"rate_ns"`
+	PerRate   float64 `json:"per_rate,omitempty"`  // tokens added per interval (token bucket)
+	Level     float64 `json:"level"`               // tokens left, queue length, tokens used, violations or adaptive limit
+	LastNs    int64   `json:"last_ns"`             // last refill, leak or violation (usage: expiry)
+	Window    string  `json:"window,omitempty"`    // period window of a usage counter
+	UntilNs   int64   `json:"until_ns,omitempty"`  // end of a penalty box
+	ExpireNs  int64   `json:"expire_ns,omitempty"` // when a penalty has fully decayed
+}
+
+// newDiskStore opens (or creates) the data directory and restores its state
+func newDiskStore(dir string, snapshotInterval time.Duration, shards int) (*diskStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create data directory: %w", err)
+	}
+
+	if snapshotInterval <= 0 {
+		snapshotInterval = time.Minute
+	}
+
+	// No eviction - every bucket is persisted, and dropping one from memory would hand
+	// its key a fresh bucket while the log still holds the old state. State that no
+	// longer matters is swept when a snapshot replaces the log instead.
+	ds := &diskStore{
+		memory: newMemoryStore(
+			newUnboundedStore[*tokenBucket](shards),
+			newUnboundedStore[*leakyBucket](shards),
+		),
+		dir:              dir,
+		snapshotInterval: snapshotInterval,
+		stopCh:           make(chan struct{}),
+	}
+
+	for _, name := range []string{diskSnapshotFile, diskLogFile} {
+		if err := ds.load(filepath.Join(dir, name)); err != nil {
+			return nil, err
+		}
+	}
+
+	// Compact what we just replayed so the log starts empty
+	if err := ds.Snapshot(); err != nil {
+		return nil, err
+	}
+
+	go ds.snapshotLoop()
+
+	return ds, nil
+}
+
+// ConsumeTokens runs the token bucket and persists the new state when tokens were taken
+func (ds *diskStore) ConsumeTokens(key string, policy models.RateLimitConfig, tokens int64) (bool, error) {
+	allowed, _ := ds.memory.ConsumeTokens(key, policy, tokens)
+	if allowed {
+		ds.appendTokenBucket(tokenBucketKey(key))
+		ds.appendUsage(QuotaLevel{Key: key, Policy: policy})
+	}
+	return allowed, nil
+}
+
+// AddRequests runs the leaky bucket and persists the new state when requests were queued
+func (ds *diskStore) AddRequests(key string, policy models.RateLimitConfig, requests int64) (bool, error) {
+	allowed, _ := ds.memory.AddRequests(key, policy, requests)
+	if allowed {
+		ds.appendLeakyBucket(key)
+		ds.appendUsage(QuotaLevel{Key: key, Policy: policy})
+	}
+	return allowed, nil
+}
+
+// ScheduleRequests runs the leaky bucket in shaping mode and persists the new state when admitted
+func (ds *diskStore) ScheduleRequests(key string, policy models.RateLimitConfig, requests int64) (time.Duration, bool, error) {
+	delay, allowed, _ := ds.memory.ScheduleRequests(key, policy, requests)
+	if allowed {
+		ds.appendLeakyBucket(key)
+		ds.appendUsage(QuotaLevel{Key: key, Policy: policy})
+	}
+	return delay, allowed, nil
+}
+
+// ConsumeHierarchy runs the hierarchy in memory and persists every level when tokens were taken
+func (ds *diskStore) ConsumeHierarchy(levels []QuotaLevel, tokens int64) (bool, error) {
+	allowed, _ := ds.memory.ConsumeHierarchy(levels, tokens)
+	if allowed {
+		for _, level := range levels {
+			ds.appendTokenBucket(level.bucketKey())
+		}
+		ds.appendUsage(levels...)
+	}
+	return allowed, nil
+}
+
+// RefundHierarchy refunds the levels in memory and persists them
+func (ds *diskStore) RefundHierarchy(levels []QuotaLevel, tokens int64) error {
+	ds.memory.RefundHierarchy(levels, tokens)
+	for _, level := range levels {
+		ds.appendTokenBucket(level.bucketKey())
+	}
+	ds.appendUsage(levels...)
+	return nil
+}
+
+// HierarchyStatus reports every level of the hierarchy
+func (ds *diskStore) HierarchyStatus(levels []QuotaLevel) ([]BucketStatus, error) {
+	return ds.memory.HierarchyStatus(levels)
+}
+
+// Usage reads the level's period counters
+func (ds *diskStore) Usage(level QuotaLevel, windows []UsageWindow) ([]int64, error) {
+	return ds.memory.Usage(level, windows)
+}
+
+// ConsumeFairShare runs the fair share in memory and persists the pool and share when tokens were taken.
+// The active tenant set is not persisted; it rebuilds within one window after a restart.
+func (ds *diskStore) ConsumeFairShare(pool QuotaLevel, tenant QuotaLevel, tokens int64) (bool, error) {
+	allowed, _ := ds.memory.ConsumeFairShare(pool, tenant, tokens)
+	if allowed {
+		poolKey, _, shareKey := fairShareKeys(pool.Key, tenant.Key)
+		ds.appendTokenBucket(poolKey)
+		ds.appendTokenBucket(shareKey)
+		ds.appendUsage(tenant)
+	}
+	return allowed, nil
+}
+
+// FairShareStatus reports the pool and the tenant's share
+func (ds *diskStore) FairShareStatus(pool QuotaLevel, tenant string) (PoolStatus, error) {
+	return ds.memory.FairShareStatus(pool, tenant)
+}
+
+// RecordViolation counts a rejection of the key and persists its penalty state,
+// so a restart does not release a key from its penalty box
+func (ds *diskStore) RecordViolation(key string, rule models.PenaltyConfig) (PenaltyState, error) {
+	state, _ := ds.memory.RecordViolation(key, rule)
+	ds.appendPenalty(key)
+	return state, nil
+}
+
+// Penalty reads the key's penalty state
+func (ds *diskStore) Penalty(key string, rule models.PenaltyConfig) (PenaltyState, error) {
+	return ds.memory.Penalty(key, rule)
+}
+
+// ClearPenalty forgets the key's penalty state and persists that it was cleared
+func (ds *diskStore) ClearPenalty(key string) error {
+	ds.memory.ClearPenalty(key)
+	ds.appendPenalty(key)
+	return nil
+}
+
+// AdaptiveLimit reads the key's AIMD limit
+func (ds *diskStore) AdaptiveLimit(key string) (int64, bool, error) {
+	return ds.memory.AdaptiveLimit(key)
+}
+
+// AdjustAdaptiveLimit moves the key's AIMD limit and persists it
+func (ds *diskStore) AdjustAdaptiveLimit(key string, step AdaptiveStep) (int64, error) {
+	limit, _ := ds.memory.AdjustAdaptiveLimit(key, step)
+	ds.appendAdaptive(key)
+	return limit, nil
+}
+
+// TokenBucketStatus reports the token bucket for the key
+func (ds *diskStore) TokenBucketStatus(key string, policy models.RateLimitConfig) (BucketStatus, error) {
+	return ds.memory.TokenBucketStatus(key, policy)
+}
+
+// LeakyBucketStatus reports the leaky bucket for the key
+func (ds *diskStore) LeakyBucketStatus(key string, policy models.RateLimitConfig) (BucketStatus, error) {
+	return ds.memory.LeakyBucketStatus(key, policy)
+}
+
+// Close writes a final snapshot and closes the log
+func (ds *diskStore) Close() error {
+	ds.stopOnce.Do(func() {
+		close(ds.stopCh)
+	})
+
+	if err := ds.Snapshot(); err != nil {
+		return err
+	}
+
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+
+	return ds.wal.Close()
+}
+
+// Snapshot writes every bucket to a new snapshot file and truncates the log.
+// State that no longer changes anything (full token buckets, drained queues, expired
+// counters and penalties) is dropped first, so neither memory nor the snapshot keeps
+// every key ever seen.
+func (ds *diskStore) Snapshot() error {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+
+	ds.memory.sweep(time.Now())
+
+	tmpPath := filepath.Join(ds.dir, diskSnapshotFile+".tmp")
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("create snapshot: %w", err)
+	}
+
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+
+	all := func(string) bool { return true }
+	for _, key := range ds.memory.tokenBuckets.Keys(all) {
+		if record, ok := ds.tokenBucketRecord(key); ok {
+			encoder.Encode(record)
+		}
+	}
+	for _, key := range ds.memory.leakyBuckets.Keys(all) {
+		if record, ok := ds.leakyBucketRecord(key); ok {
+			encoder.Encode(record)
+		}
+	}
+	for _, key := range ds.memory.usageKeys(all) {
+		for _, record := range ds.usageRecords(key) {
+			encoder.Encode(record)
+		}
+	}
+	for _, key := range ds.memory.penalties.Keys(all) {
+		if record, ok := ds.penaltyRecord(key); ok {
+			encoder.Encode(record)
+		}
+	}
+	for _, record := range ds.adaptiveRecords() {
+		encoder.Encode(record)
+	}
+
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return fmt.Errorf("write snapshot: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("sync snapshot: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("close snapshot: %w", err)
+	}
+	if err := os.Rename(tmpPath, filepath.Join(ds.dir, diskSnapshotFile)); err != nil {
+		return fmt.Errorf("install snapshot: %w", err)
+	}
+
+	// Everything in the log is now covered by the snapshot
+	if ds.wal != nil {
+		ds.wal.Close()
+	}
+	ds.wal, err = os.OpenFile(filepath.Join(ds.dir, diskLogFile), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("reset log: %w", err)
+	}
+
+	return nil
+}
+
+// snapshotLoop compacts the log in the background and syncs it to disk
+func (ds *diskStore) snapshotLoop() {
+	ticker := time.NewTicker(ds.snapshotInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := ds.Snapshot(); err != nil {
+				log.Printf("Disk store snapshot failed: %v", err)
+			}
+		case <-ds.stopCh:
+			return
+		}
+	}
+}
+
+// appendTokenBucket logs the current state of a token bucket.
+// The state is read under the log lock, so the last record for a key is always the newest.
+func (ds *diskStore) appendTokenBucket(key string) {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+
+	if record, ok := ds.tokenBucketRecord(key); ok {
+		ds.appendRecord(record)
+	}
+}
+
+// appendLeakyBucket logs the current state of a leaky bucket
+func (ds *diskStore) appendLeakyBucket(key string) {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+
+	if record, ok := ds.leakyBucketRecord(key); ok {
+		ds.appendRecord(record)
+	}
+}
+
+// appendUsage logs the period counters of the levels that have any
+func (ds *diskStore) appendUsage(levels ...QuotaLevel) {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+
+	for _, level := range levels {
+		if len(level.Policy.Periods) == 0 {
+			continue
+		}
+		for _, record := range ds.usageRecords(level.Key) {
+			ds.appendRecord(record)
+		}
+	}
+}
+
+// appendPenalty logs the key's penalty state; a cleared key is logged with no violations
+func (ds *diskStore) appendPenalty(key string) {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+
+	record, ok := ds.penaltyRecord(key)
+	if !ok {
+		record = diskRecord{Algorithm: "penalty", Key: key}
+	}
+	ds.appendRecord(record)
+}
+
+// appendAdaptive logs the key's AIMD limit
+func (ds *diskStore) appendAdaptive(key string) {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+
+	if limit, exists, _ := ds.memory.AdaptiveLimit(key); exists {
+		ds.appendRecord(diskRecord{Algorithm: "adaptive", Key: key, Level: float64(limit)})
+	}
+}
+
+// appendRecord writes one record to the log (caller holds the lock)
+func (ds *diskStore) appendRecord(record diskRecord) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("Disk store: failed to encode %s: %v", record.Key, err)
+		return
+	}
+
+	if _, err := ds.wal.Write(append(data, '\n')); err != nil {
+		log.Printf("Disk store: failed to persist %s: %v", record.Key, err)
+	}
+}
+
+// tokenBucketRecord captures a token bucket's state
+func (ds *diskStore) tokenBucketRecord(key string) (diskRecord, bool) {
+	bucket, exists := ds.memory.tokenBuckets.Get(key)
+	if !exists {
+		return diskRecord{}, false
+	}
+
+	tokens, lastRefill := bucket.snapshot()
+	return diskRecord{
+		Algorithm: "token_bucket",
+		Key:       key,
+		Capacity:  bucket.capacity,
+		RateNs:    bucket.refillRate.Nanoseconds(),
+		PerRate:   bucket.refillTokens,
+		Level:     tokens,
+		LastNs:    lastRefill.UnixNano(),
+	}, true
+}
+
+// leakyBucketRecord captures a leaky bucket's state
+func (ds *diskStore) leakyBucketRecord(key string) (diskRecord, bool) {
+	bucket, exists := ds.memory.leakyBuckets.Get(key)
+	if !exists {
+		return diskRecord{}, false
+	}
+
+	queueLength, lastLeak := bucket.snapshot()
+	return diskRecord{
+		Algorithm: "leaky_bucket",
+		Key:       key,
+		Capacity:  bucket.capacity,
+		RateNs:    bucket.leakRate.Nanoseconds(),
+		Level:     float64(queueLength),
+		LastNs:    lastLeak.UnixNano(),
+	}, true
+}
+
+// usageRecords captures a key's period counters
+func (ds *diskStore) usageRecords(key string) []diskRecord {
+	ds.memory.usageMutex.Lock()
+	defer ds.memory.usageMutex.Unlock()
+
+	counters, _ := ds.memory.usage.Get(key)
+	records := make([]diskRecord, 0, len(counters))
+	for windowID, counter := range counters {
+		records = append(records, diskRecord{
+			Algorithm: "usage",
+			Key:       key,
+			Window:    windowID,
+			Level:     float64(counter.value),
+			LastNs:    counter.expireAt.UnixNano(),
+		})
+	}
+	return records
+}
+
+// penaltyRecord captures a key's penalty state
+func (ds *diskStore) penaltyRecord(key string) (diskRecord, bool) {
+	penalty, exists := ds.memory.penaltySnapshot(key)
+	if !exists {
+		return diskRecord{}, false
+	}
+
+	record := diskRecord{
+		Algorithm: "penalty",
+		Key:       key,
+		Level:     float64(penalty.violations),
+		LastNs:    penalty.last.UnixNano(),
+	}
+	if !penalty.until.IsZero() {
+		record.UntilNs = penalty.until.UnixNano()
+	}
+	if !penalty.expireAt.IsZero() {
+		record.ExpireNs = penalty.expireAt.UnixNano()
+	}
+	return record, true
+}
+
+// adaptiveRecords captures every AIMD limit
+func (ds *diskStore) adaptiveRecords() []diskRecord {
+	ds.memory.adaptiveMutex.Lock()
+	defer ds.memory.adaptiveMutex.Unlock()
+
+	records := make([]diskRecord, 0, len(ds.memory.adaptive))
+	for key, limit := range ds.memory.adaptive {
+		records = append(records, diskRecord{Algorithm: "adaptive", Key: key, Level: float64(limit)})
+	}
+	return records
+}
+
+// load replays a snapshot or log file; later records for a key replace earlier ones.
+// A torn last line (crash mid-write) is skipped.
+func (ds *diskStore) load(path string) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("open %s: %w", path, err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record diskRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			log.Printf("Disk store: skipping corrupt record in %s: %v", path, err)
+			continue
+		}
+		ds.restore(record)
+	}
+
+	return scanner.Err()
+}
+
+// restore installs a persisted bucket, usage counter, penalty or adaptive limit
+func (ds *diskStore) restore(record diskRecord) {
+	switch record.Algorithm {
+	case "usage":
+		ds.restoreUsage(record)
+		return
+	case "penalty":
+		ds.restorePenalty(record)
+		return
+	case "adaptive":
+		ds.memory.adaptiveMutex.Lock()
+		ds.memory.adaptive[record.Key] = int64(record.Level)
+		ds.memory.adaptiveMutex.Unlock()
+		return
+	}
+
+	if record.RateNs <= 0 {
+		return
+	}
+
+	rate := time.Duration(record.RateNs)
+	last := time.Unix(0, record.LastNs)
+
+	switch record.Algorithm {
+	case "token_bucket":
+		ds.memory.tokenBuckets.Delete(record.Key)
+		ds.memory.tokenBuckets.GetOrCreate(record.Key, func() *tokenBucket {
+			return restoreTokenBucket(record.Capacity, rate, record.PerRate, record.Level, last)
+		})
+	case "leaky_bucket":
+		ds.memory.leakyBuckets.Delete(record.Key)
+		ds.memory.leakyBuckets.GetOrCreate(record.Key, func() *leakyBucket {
+			return restoreLeakyBucket(record.Capacity, rate, int64(record.Level), last)
+		})
+	}
+}
+
+// restorePenalty installs a persisted penalty, or forgets one that was cleared
+func (ds *diskStore) restorePenalty(record diskRecord) {
+	if record.Level <= 0 {
+		ds.memory.ClearPenalty(record.Key)
+		return
+	}
+
+	penalty := penaltyRecord{violations: int64(record.Level), last: time.Unix(0, record.LastNs)}
+	if record.UntilNs > 0 {
+		penalty.until = time.Unix(0, record.UntilNs)
+	}
+	if record.ExpireNs > 0 {
+		penalty.expireAt = time.Unix(0, record.ExpireNs)
+	}
+	ds.memory.restorePenalty(record.Key, penalty)
+}
+
+// restoreUsage installs a persisted usage counter, skipping those past their retention
+func (ds *diskStore) restoreUsage(record diskRecord) {
+	expireAt := time.Unix(0, record.LastNs)
+	if record.Window == "" || time.Now().After(expireAt) {
+		return
+	}
+
+	ds.memory.usageMutex.Lock()
+	defer ds.memory.usageMutex.Unlock()
+
+	counters := ds.memory.usage.GetOrCreate(record.Key, func() map[string]usageCounter {
+		return make(map[string]usageCounter)
+	})
+	counters[record.Window] = usageCounter{value: int64(record.Level), expireAt: expireAt}
+}
@@ -0,0 +1,221 @@
+package services
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Appy29/rate-limiter/models"
+)
+
+var diskTestPolicy = models.RateLimitConfig{
+	Key:        "disk_user",
+	Algorithm:  "token_bucket",
+	Capacity:   5,
+	RefillRate: time.Hour,
+}
+
+func TestDiskStore_StateSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+
+	store, err := newDiskStore(dir, time.Hour, 0)
+	if err != nil {
+		t.Fatalf("Failed to open disk store: %v", err)
+	}
+
+	store.ConsumeTokens("disk_user", diskTestPolicy, 4)
+	store.AddRequests("disk_queue", diskTestPolicy, 3)
+	store.AdjustAdaptiveLimit("disk_user", AdaptiveStep{Initial: 5, Healthy: true, Increase: 2, Min: 1, Max: 10})
+
+	if err := store.Close(); err != nil {
+		t.Fatalf("Failed to close disk store: %v", err)
+	}
+
+	reopened, err := newDiskStore(dir, time.Hour, 0)
+	if err != nil {
+		t.Fatalf("Failed to reopen disk store: %v", err)
+	}
+	defer reopened.Close()
+
+	status, _ := reopened.TokenBucketStatus("disk_user", diskTestPolicy)
+	if !status.HasState || status.Level != 1 {
+		t.Errorf("Expected 1 token left after restart, got %d (state: %v)", status.Level, status.HasState)
+	}
+
+	queue, _ := reopened.LeakyBucketStatus("disk_queue", diskTestPolicy)
+	if !queue.HasState || queue.Level != 3 {
+		t.Errorf("Expected queue length 3 after restart, got %d (state: %v)", queue.Level, queue.HasState)
+	}
+
+	if limit, exists, _ := reopened.AdaptiveLimit("disk_user"); !exists || limit != 7 {
+		t.Errorf("Expected adaptive limit 7 after restart, got %d (exists: %v)", limit, exists)
+	}
+
+	allowed, _ := reopened.ConsumeTokens("disk_user", diskTestPolicy, 2)
+	if allowed {
+		t.Error("Expected restored bucket to reject more tokens than it holds")
+	}
+}
+
+func TestDiskStore_ReplaysLogWithoutSnapshot(t *testing.T) {
+	dir := t.TempDir()
+
+	store, err := newDiskStore(dir, time.Hour, 0)
+	if err != nil {
+		t.Fatalf("Failed to open disk store: %v", err)
+	}
+
+	store.ConsumeTokens("disk_user", diskTestPolicy, 1)
+	store.ConsumeTokens("disk_user", diskTestPolicy, 1)
+
+	// Simulate a crash: the log has the changes, the snapshot does not
+	store.stopOnce.Do(func() { close(store.stopCh) })
+	store.wal.Close()
+
+	data, err := os.ReadFile(filepath.Join(dir, diskLogFile))
+	if err != nil || len(data) == 0 {
+		t.Fatalf("Expected log records before restart, got %q (%v)", data, err)
+	}
+
+	reopened, err := newDiskStore(dir, time.Hour, 0)
+	if err != nil {
+		t.Fatalf("Failed to reopen disk store: %v", err)
+	}
+	defer reopened.Close()
+
+	status, _ := reopened.TokenBucketStatus("disk_user", diskTestPolicy)
+	if status.Level != 3 {
+		t.Errorf("Expected last logged state (3 tokens) after replay, got %d", status.Level)
+	}
+}
+
+func TestDiskStore_UsageSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	policy := diskTestPolicy
+	policy.Capacity = 20
+	policy.Periods = []models.PeriodQuota{{Period: models.PeriodMonth}}
+	windows := usageWindows(policy, time.Now())
+
+	store, err := newDiskStore(dir, time.Hour, 0)
+	if err != nil {
+		t.Fatalf("Failed to open disk store: %v", err)
+	}
+	store.ConsumeTokens("disk_user", policy, 7)
+	store.ConsumeTokens("disk_user", policy, 5)
+	store.Close()
+
+	reopened, err := newDiskStore(dir, time.Hour, 0)
+	if err != nil {
+		t.Fatalf("Failed to reopen disk store: %v", err)
+	}
+	defer reopened.Close()
+
+	counts, _ := reopened.Usage(QuotaLevel{Key: "disk_user", Policy: policy}, windows)
+	if counts[0] != 12 {
+		t.Errorf("Expected 12 tokens used after restart, got %d", counts[0])
+	}
+}
+
+func TestDiskStore_NeverEvictsPersistedBuckets(t *testing.T) {
+	store, err := newDiskStore(t.TempDir(), time.Hour, 1)
+	if err != nil {
+		t.Fatalf("Failed to open disk store: %v", err)
+	}
+	defer store.Close()
+
+	// Far more keys than the in-memory fallback would hold
+	for i := 0; i < 100000; i++ {
+		store.memory.getOrCreateTokenBucket(strconv.Itoa(i), diskTestPolicy)
+	}
+	store.ConsumeTokens("disk_user", diskTestPolicy, 1)
+	for i := 0; i < 1000; i++ {
+		store.memory.getOrCreateTokenBucket("spray_"+strconv.Itoa(i), diskTestPolicy)
+	}
+
+	if status, _ := store.TokenBucketStatus("disk_user", diskTestPolicy); !status.HasState || status.Level != 4 {
+		t.Errorf("Expected disk_user to keep its bucket with 4 tokens, got %+v", status)
+	}
+	if capacity, _ := store.memory.tokenBuckets.Evictions(); capacity != 0 {
+		t.Errorf("Expected no evictions, got %d", capacity)
+	}
+}
+
+func TestDiskStore_SnapshotDropsStateThatNoLongerMatters(t *testing.T) {
+	dir := t.TempDir()
+	store, err := newDiskStore(dir, time.Hour, 0)
+	if err != nil {
+		t.Fatalf("Failed to open disk store: %v", err)
+	}
+	defer store.Close()
+
+	fast := models.RateLimitConfig{Capacity: 2, RefillRate: time.Millisecond}
+	store.ConsumeTokens("refilled_user", fast, 2)
+	store.AddRequests("drained_queue", fast, 1)
+	store.RecordViolation("reformed", penaltyRule(models.PenaltyConfig{Threshold: 1, Base: time.Millisecond, Window: time.Millisecond}))
+
+	store.memory.usageMutex.Lock()
+	store.memory.usage.GetOrCreate("last_month", func() map[string]usageCounter {
+		return map[string]usageCounter{"month:old": {value: 3, expireAt: time.Now().Add(-time.Hour)}}
+	})
+	store.memory.usageMutex.Unlock()
+
+	// Still limiting: the bucket has not refilled
+	store.ConsumeTokens("disk_user", diskTestPolicy, 4)
+
+	time.Sleep(50 * time.Millisecond)
+	if err := store.Snapshot(); err != nil {
+		t.Fatalf("Failed to snapshot: %v", err)
+	}
+
+	if keys := store.memory.tokenBuckets.Keys(func(string) bool { return true }); len(keys) != 1 || keys[0] != tokenBucketKey("disk_user") {
+		t.Errorf("Expected only disk_user's bucket to be kept, got %v", keys)
+	}
+	if store.memory.leakyBuckets.Len() != 0 || store.memory.usage.Len() != 0 || store.memory.penalties.Len() != 0 {
+		t.Errorf("Expected drained queues, expired counters and penalties to be dropped, got %d, %d and %d",
+			store.memory.leakyBuckets.Len(), store.memory.usage.Len(), store.memory.penalties.Len())
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, diskSnapshotFile))
+	if err != nil {
+		t.Fatalf("Failed to read snapshot: %v", err)
+	}
+	if lines := strings.Count(string(data), "\n"); lines != 1 {
+		t.Errorf("Expected one record in the snapshot, got %d:\n%s", lines, data)
+	}
+}
+
+func TestDiskStore_PenaltiesSurviveRestart(t *testing.T) {
+	dir := t.TempDir()
+	rule := penaltyRule(models.PenaltyConfig{Threshold: 2, Base: time.Hour})
+
+	store, err := newDiskStore(dir, time.Hour, 0)
+	if err != nil {
+		t.Fatalf("Failed to open disk store: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		store.RecordViolation("scraper", rule)
+		store.RecordViolation("forgiven", rule)
+	}
+	store.ClearPenalty("forgiven")
+
+	// Simulate a crash: only the log holds the penalties
+	store.stopOnce.Do(func() { close(store.stopCh) })
+	store.wal.Close()
+
+	reopened, err := newDiskStore(dir, time.Hour, 0)
+	if err != nil {
+		t.Fatalf("Failed to reopen disk store: %v", err)
+	}
+	defer reopened.Close()
+
+	state, _ := reopened.Penalty("scraper", rule)
+	if state.Violations != 2 || state.Remaining < 59*time.Minute {
+		t.Errorf("Expected the key to stay boxed for an hour after restart, got %+v", state)
+	}
+	if state, _ := reopened.Penalty("forgiven", rule); state.Violations != 0 || state.Remaining != 0 {
+		t.Errorf("Expected the cleared penalty to stay cleared after restart, got %+v", state)
+	}
+}
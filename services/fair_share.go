@@ -0,0 +1,188 @@
+package services
+
+import (
+	"strings"
+	"time"
+
+	"github.com/Appy29/rate-limiter/models"
+	"github.com/go-redis/redis/v8"
+)
+
+// Fair share splits a global pool (e.g. total calls to a partner API) among the
+// tenants that used it recently. Every tenant draws from the pool's token bucket
+// and from its own share bucket, sized and refilled at 1/n of the pool for n
+// active tenants: few active tenants get more, and a noisy one cannot starve the
+// rest. In Redis the pool, its active set and the shares live on the pool's shard.
+
+const (
+	fairShareKeyPrefix       = "fair_share:"
+	defaultFairShareWindow   = time.Minute
+	fairShareAlgorithm       = "fair_share"
+	fairShareActiveKeySuffix = ":active"
+	fairShareTenantKeyPrefix = ":tenant:"
+)
+
+// PoolStatus is a backend-neutral view of a tenant's share of a pool
+type PoolStatus struct {
+	Active int64        // tenants currently splitting the pool
+	Pool   BucketStatus // the whole pool
+	Share  BucketStatus // the tenant's share
+}
+
+// fairShareScript atomically marks the tenant active, then consumes from the pool
+// and the tenant's share only if both have enough tokens above their reserve and the
+// tenant's period limits allow it. State is written even when rejected.
+// Returns {allowed, active tenants}.
+// KEYS: pool bucket, active set, tenant share, then the tenant's period counters.
+// ARGV: tokens, now, capacity, rate, refill_tokens, initial_tokens, ttl_ms, window_ms, reserve_fraction, tenant,
+// then limit and expire_at_ms per counter.
+var fairShareScript = redis.NewScript(bucketStateLua + tokenBucketLua + usageLua + `
+local pool_key = KEYS[1]
+local active_key = KEYS[2]
+local share_key = KEYS[3]
+local tokens_needed = tonumber(ARGV[1])
+local now_us = current_time_us(tonumber(ARGV[2]))
+local capacity = tonumber(ARGV[3])
+local refill_rate_us = tonumber(ARGV[4])
+local refill_tokens = tonumber(ARGV[5])
+local initial_tokens = tonumber(ARGV[6])
+local ttl_ms = tonumber(ARGV[7])
+local window_ms = tonumber(ARGV[8])
+local reserve_fraction = tonumber(ARGV[9])
+local tenant = ARGV[10]
+
+-- Track who is active (scores in ms keep them exact as Lua numbers)
+local now_ms = math.floor(now_us / 1000)
+redis.call('ZADD', active_key, now_ms, tenant)
+redis.call('ZREMRANGEBYSCORE', active_key, '-inf', now_ms - window_ms)
+redis.call('PEXPIRE', active_key, math.max(window_ms, ttl_ms))
+local active = redis.call('ZCARD', active_key)
+
+-- The share is 1/n of the pool, refilled at 1/n of its rate
+local share_capacity = math.max(1, math.floor(capacity / active))
+local share_rate_us = refill_rate_us * active
+
+local pool_tokens, pool_last_us = read_tokens(pool_key)
+if pool_tokens == nil then
+	pool_tokens = initial_tokens
+	pool_last_us = now_us
+end
+pool_tokens, pool_last_us = refill_tokens_at(pool_tokens, pool_last_us, now_us, capacity, refill_rate_us, refill_tokens)
+
+local share_tokens, share_last_us = read_tokens(share_key)
+if share_tokens == nil then
+	share_tokens = share_capacity
+	share_last_us = now_us
+end
+share_tokens, share_last_us = refill_tokens_at(share_tokens, share_last_us, now_us, share_capacity, share_rate_us, refill_tokens)
+share_tokens = math.min(share_capacity, share_tokens) -- the share shrinks as tenants join
+
+local allowed = 0
+if pool_tokens - tokens_needed >= math.ceil(reserve_fraction * capacity)
+	and share_tokens - tokens_needed >= math.ceil(reserve_fraction * share_capacity)
+	and usage_allows(4, 11, tokens_needed) then
+	pool_tokens = pool_tokens - tokens_needed
+	share_tokens = share_tokens - tokens_needed
+	usage_charge(4, 11, tokens_needed)
+	allowed = 1
+end
+
+write_tokens(pool_key, capacity, pool_tokens, refill_rate_us, refill_tokens, pool_last_us, now_us, ttl_ms)
+write_tokens(share_key, share_capacity, share_tokens, share_rate_us, refill_tokens, share_last_us, now_us, ttl_ms)
+
+return {allowed, active}
+`)
+
+// fairSharePolicy is the policy of one tenant's share when active tenants split the pool
+func fairSharePolicy(pool models.RateLimitConfig, active int64) models.RateLimitConfig {
+	active = max(1, active)
+
+	share := pool
+	share.Capacity = max(1, pool.BurstSize()/active)
+	share.Burst = 0
+	share.InitialTokens = nil
+	share.RefillRate = pool.RefillRate * time.Duration(active)
+	return share
+}
+
+// currentShare reports a stored share at the current split. The stored bucket keeps
+// the size of the tenant's last request until its next one resizes it, so once tenants
+// join or expire its capacity (and possibly level) would be stale.
+func currentShare(status BucketStatus, share models.RateLimitConfig) BucketStatus {
+	if status.HasState {
+		status.Capacity = share.Capacity
+		status.Level = min(status.Level, share.Capacity)
+	}
+	return status
+}
+
+// fairShareWindow is how long a tenant counts as active after its last request
+func fairShareWindow(pool models.RateLimitConfig) time.Duration {
+	if pool.ActiveWindow > 0 {
+		return pool.ActiveWindow
+	}
+	return defaultFairShareWindow
+}
+
+// fairShareKeys names the pool bucket, its active set and a tenant's share bucket
+func fairShareKeys(pool string, tenant string) (poolKey string, activeKey string, shareKey string) {
+	poolKey = fairShareKeyPrefix + pool
+	return poolKey, poolKey + fairShareActiveKeySuffix, poolKey + fairShareTenantKeyPrefix + tenant
+}
+
+// fairSharePoolOf returns the pool of a pool or share bucket key
+func fairSharePoolOf(bucketKey string) string {
+	pool, _, _ := strings.Cut(strings.TrimPrefix(bucketKey, fairShareKeyPrefix), fairShareTenantKeyPrefix)
+	return pool
+}
+
+// fairSharePool resolves the pool a key's policy draws from, at the request's priority.
+// A policy without a pool is a pool of its own.
+func (rrs *RedisRateLimiterService) fairSharePool(key string, policy models.RateLimitConfig) QuotaLevel {
+	pool := policy.Pool
+	if pool == "" {
+		pool = key
+	}
+
+	poolPolicy := rrs.ResolvePolicy(pool)
+	poolPolicy.Priority = policy.Priority
+	return QuotaLevel{Key: pool, Policy: poolPolicy}
+}
+
+// decide runs the algorithm for the key on the given store
+func (rrs *RedisRateLimiterService) decide(store Store, key string, policy models.RateLimitConfig, tokens int64, algorithm string) (bool, error) {
+	if algorithm == fairShareAlgorithm {
+		return store.ConsumeFairShare(rrs.fairSharePool(key, policy), QuotaLevel{Key: key, Policy: policy}, tokens)
+	}
+	return evaluate(store, key, policy, tokens, algorithm)
+}
+
+// getFairShareStatus reports the key's share of its pool, and the share as a bucket
+// for keys limited with fair share (fallback if the store errors)
+func (rrs *RedisRateLimiterService) getFairShareStatus(key string, policy models.RateLimitConfig) (*models.FairShareStatus, models.AlgorithmStatus) {
+	pool := rrs.fairSharePool(key, policy)
+
+	status, err := rrs.store.FairShareStatus(pool, key)
+	if err != nil {
+		status, _ = rrs.fallback.FairShareStatus(pool, key)
+	}
+
+	fairShare := &models.FairShareStatus{
+		Pool:           pool.Key,
+		ActiveTenants:  status.Active,
+		Share:          status.Share.Capacity,
+		TokensLeft:     status.Share.Level,
+		PoolTokensLeft: status.Pool.Level,
+	}
+	share := models.AlgorithmStatus{
+		Algorithm:      fairShareAlgorithm,
+		TokensLeft:     status.Share.Level,
+		Capacity:       status.Share.Capacity,
+		RefillRate:     fairSharePolicy(pool.Policy, status.Active).RefillRate,
+		NextRefillTime: status.Share.Next,
+		IsBlocked:      status.Share.HasState && status.Share.Level <= 0,
+		HasState:       status.Share.HasState,
+		ExpiresAt:      expiresAt(status.Share),
+	}
+	return fairShare, share
+}
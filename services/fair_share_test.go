@@ -0,0 +1,62 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Appy29/rate-limiter/models"
+)
+
+func TestMemoryStore_ConsumeFairShare(t *testing.T) {
+	store := newMemoryStore(newBoundedStore[*tokenBucket](0, 0, 0), newBoundedStore[*leakyBucket](0, 0, 0))
+	pool := QuotaLevel{Key: "partner_api", Policy: models.RateLimitConfig{Capacity: 12, RefillRate: time.Hour, RefillTokens: 1}}
+
+	// Alone, a tenant's share is the whole pool
+	if allowed, _ := store.ConsumeFairShare(pool, QuotaLevel{Key: "quiet"}, 1); !allowed {
+		t.Fatal("Expected the first tenant to be allowed")
+	}
+
+	// With two active tenants each gets half
+	if allowed, _ := store.ConsumeFairShare(pool, QuotaLevel{Key: "noisy"}, 6); !allowed {
+		t.Fatal("Expected the noisy tenant to use its half of the pool")
+	}
+	if allowed, _ := store.ConsumeFairShare(pool, QuotaLevel{Key: "noisy"}, 1); allowed {
+		t.Error("Expected the noisy tenant to be held to its share")
+	}
+
+	// ... so the pool still has room for the quiet tenant
+	if allowed, _ := store.ConsumeFairShare(pool, QuotaLevel{Key: "quiet"}, 4); !allowed {
+		t.Error("Expected the noisy tenant not to starve the quiet one")
+	}
+
+	status, _ := store.FairShareStatus(pool, "noisy")
+	if status.Active != 2 || status.Share.Capacity != 6 || status.Share.Level != 0 || status.Pool.Level != 1 {
+		t.Errorf("Expected 2 tenants sharing 6 each with 0 and 1 pool token left, got %+v", status)
+	}
+
+	// A third tenant joining shrinks the others' shares before their next request
+	store.ConsumeFairShare(pool, QuotaLevel{Key: "late"}, 0)
+	if status, _ := store.FairShareStatus(pool, "quiet"); status.Active != 3 || status.Share.Capacity != 4 {
+		t.Errorf("Expected the quiet tenant's share to be reported at 4 of 12 for 3 tenants, got %+v", status)
+	}
+
+	// Tenants drop out of the split once idle for the active window
+	pool.Policy.ActiveWindow = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	if status, _ := store.FairShareStatus(pool, "noisy"); status.Active != 0 {
+		t.Errorf("Expected no active tenants after the window, got %d", status.Active)
+	}
+}
+
+func TestFairSharePolicy(t *testing.T) {
+	pool := models.RateLimitConfig{Capacity: 100, Burst: 200, RefillRate: time.Second}
+
+	share := fairSharePolicy(pool, 4)
+	if share.BurstSize() != 50 || share.RefillRate != 4*time.Second {
+		t.Errorf("Expected a quarter of the burst at a quarter of the rate, got %d per %v", share.BurstSize(), share.RefillRate)
+	}
+
+	if share := fairSharePolicy(pool, 1000); share.Capacity != 1 {
+		t.Errorf("Expected a share of at least one token, got %d", share.Capacity)
+	}
+}
@@ -0,0 +1,136 @@
+package services
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Appy29/rate-limiter/config"
+)
+
+// RedisHealthMonitor pings every Redis instance in the background and keeps the
+// RedisManager health view up to date, so shard selection can skip dead nodes
+type RedisHealthMonitor struct {
+	manager *RedisManager
+	metrics MetricsInterface
+
+	interval           time.Duration
+	timeout            time.Duration
+	healthyThreshold   int
+	unhealthyThreshold int
+
+	// Consecutive probe results per instance (hysteresis)
+	successes []int
+	failures  []int
+
+	// probe is swapped out in tests
+	probe func(ctx context.Context, index int) error
+
+	stopCh   chan struct{}
+	stopOnce sync.Once
+	mutex    sync.Mutex
+}
+
+// NewRedisHealthMonitor creates a new health monitor for the manager's instances
+func NewRedisHealthMonitor(manager *RedisManager, metrics MetricsInterface, cfg *config.Config) *RedisHealthMonitor {
+	hm := &RedisHealthMonitor{
+		manager:            manager,
+		metrics:            metrics,
+		interval:           cfg.HealthCheck.Interval,
+		timeout:            cfg.HealthCheck.Timeout,
+		healthyThreshold:   cfg.HealthCheck.HealthyThreshold,
+		unhealthyThreshold: cfg.HealthCheck.UnhealthyThreshold,
+		successes:          make([]int, manager.InstanceCount()),
+		failures:           make([]int, manager.InstanceCount()),
+		probe:              manager.pingInstance,
+		stopCh:             make(chan struct{}),
+	}
+
+	// Fall back to sane defaults when the config section is empty
+	if hm.interval <= 0 {
+		hm.interval = 5 * time.Second
+	}
+	if hm.timeout <= 0 {
+		hm.timeout = time.Second
+	}
+	if hm.healthyThreshold <= 0 {
+		hm.healthyThreshold = 1
+	}
+	if hm.unhealthyThreshold <= 0 {
+		hm.unhealthyThreshold = 1
+	}
+
+	return hm
+}
+
+// Start runs the probe loop in the background until Stop is called
+func (hm *RedisHealthMonitor) Start() {
+	go func() {
+		ticker := time.NewTicker(hm.interval)
+		defer ticker.Stop()
+
+		hm.CheckNow()
+		for {
+			select {
+			case <-ticker.C:
+				hm.CheckNow()
+			case <-hm.stopCh:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the probe loop
+func (hm *RedisHealthMonitor) Stop() {
+	hm.stopOnce.Do(func() {
+		close(hm.stopCh)
+	})
+}
+
+// CheckNow probes every instance once and applies the hysteresis thresholds
+func (hm *RedisHealthMonitor) CheckNow() {
+	hm.mutex.Lock()
+	defer hm.mutex.Unlock()
+
+	anyHealthy := false
+
+	for i := 0; i < hm.manager.InstanceCount(); i++ {
+		name := hm.manager.InstanceName(i)
+
+		ctx, cancel := context.WithTimeout(context.Background(), hm.timeout)
+		start := time.Now()
+		err := hm.probe(ctx, i)
+		latency := time.Since(start)
+		cancel()
+
+		if err == nil {
+			hm.successes[i]++
+			hm.failures[i] = 0
+			hm.metrics.RecordRedisLatency(latency)
+			hm.metrics.RecordInstanceLatency(name, latency)
+		} else {
+			hm.failures[i]++
+			hm.successes[i] = 0
+		}
+
+		wasHealthy := hm.manager.IsInstanceHealthy(i)
+		switch {
+		case !wasHealthy && hm.successes[i] >= hm.healthyThreshold:
+			log.Printf("Redis instance %s is healthy again", name)
+			hm.manager.SetInstanceHealthy(i, true)
+		case wasHealthy && hm.failures[i] >= hm.unhealthyThreshold:
+			log.Printf("Redis instance %s marked unhealthy: %v", name, err)
+			hm.manager.SetInstanceHealthy(i, false)
+		}
+
+		healthy := hm.manager.IsInstanceHealthy(i)
+		hm.metrics.UpdateInstanceHealth(name, healthy)
+		if healthy {
+			anyHealthy = true
+		}
+	}
+
+	hm.metrics.UpdateRedisHealth(anyHealthy)
+}
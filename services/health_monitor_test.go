@@ -0,0 +1,121 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// newTestHealthMonitor creates a monitor whose probe result is controlled by the test
+func newTestHealthMonitor(probeErr *error) (*RedisHealthMonitor, *RedisManager, *mockMetrics) {
+	cfg := createTestConfig()
+	cfg.HealthCheck.Interval = time.Hour
+	cfg.HealthCheck.Timeout = time.Second
+	cfg.HealthCheck.HealthyThreshold = 2
+	cfg.HealthCheck.UnhealthyThreshold = 3
+
+	manager := NewRedisManager([]string{"localhost:6379"}, "", 0)
+	metrics := &mockMetrics{}
+	monitor := NewRedisHealthMonitor(manager, metrics, cfg)
+	monitor.probe = func(ctx context.Context, index int) error {
+		return *probeErr
+	}
+
+	return monitor, manager, metrics
+}
+
+func TestHealthMonitor_Hysteresis(t *testing.T) {
+	var probeErr error
+	monitor, manager, metrics := newTestHealthMonitor(&probeErr)
+
+	// Two failures are below the unhealthy threshold
+	probeErr = errors.New("connection refused")
+	monitor.CheckNow()
+	monitor.CheckNow()
+	if !manager.IsInstanceHealthy(0) {
+		t.Fatal("Expected instance to stay healthy before reaching the unhealthy threshold")
+	}
+
+	// Third failure flips it
+	monitor.CheckNow()
+	if manager.IsInstanceHealthy(0) {
+		t.Fatal("Expected instance to be unhealthy after 3 consecutive failures")
+	}
+	if manager.GetClient("user1") != nil {
+		t.Error("Expected GetClient to skip the unhealthy instance")
+	}
+	if metrics.redisHealth["redis-1"] {
+		t.Error("Expected per-instance health gauge to be 0")
+	}
+
+	// One success is not enough to recover
+	probeErr = nil
+	monitor.CheckNow()
+	if manager.IsInstanceHealthy(0) {
+		t.Fatal("Expected instance to stay unhealthy before reaching the healthy threshold")
+	}
+
+	monitor.CheckNow()
+	if !manager.IsInstanceHealthy(0) {
+		t.Fatal("Expected instance to recover after 2 consecutive successes")
+	}
+	if !metrics.redisHealth["overall"] {
+		t.Error("Expected overall Redis health to be reported healthy")
+	}
+}
+
+func TestRedisManager_DoesNotRerouteFromUnhealthyInstance(t *testing.T) {
+	manager := NewRedisManager([]string{"localhost:6379", "localhost:6380"}, "", 0)
+
+	key := "user1"
+	primary := manager.GetClientIndex(key)
+	manager.SetInstanceHealthy(primary, false)
+
+	// The key is not rerouted to the healthy shard, which has none of its state
+	if index := manager.selectIndex(key); index != -1 {
+		t.Errorf("Expected no instance while the owning shard is unhealthy, got %d", index)
+	}
+
+	manager.SetInstanceHealthy(primary, true)
+	if index := manager.selectIndex(key); index != primary {
+		t.Errorf("Expected the owning instance %d once healthy, got %d", primary, index)
+	}
+}
+
+func TestRedisManager_ProbesBypassCircuitBreaker(t *testing.T) {
+	server := miniredis.RunT(t)
+	manager := NewRedisManager([]string{server.Addr()}, "", 0)
+	defer manager.Close()
+	manager.EnableCircuitBreakers(CircuitBreakerSettings{MinRequests: 1, Cooldown: 5 * time.Second, HalfOpenRequests: 1}, nil)
+
+	breaker := manager.breakers[0]
+	now := time.Now()
+	breaker.now = func() time.Time { return now }
+	breaker.Record(true)
+	if breaker.State() != BreakerOpen {
+		t.Fatalf("Expected the breaker to open, got %s", breaker.State())
+	}
+
+	// An open breaker does not fail the probe that decides the instance's health
+	if err := manager.pingInstance(context.Background(), 0); err != nil {
+		t.Fatalf("Expected the probe to reach Redis while the breaker is open, got %v", err)
+	}
+	if breaker.State() != BreakerOpen {
+		t.Errorf("Expected the probe not to be counted by the breaker, got %s", breaker.State())
+	}
+
+	// Probes leave the half-open trial slot to real traffic
+	now = now.Add(6 * time.Second)
+	if err := manager.pingInstance(context.Background(), 0); err != nil {
+		t.Fatalf("Expected the probe to succeed while half-open, got %v", err)
+	}
+	if breaker.State() != BreakerHalfOpen {
+		t.Errorf("Expected the probe not to close the breaker, got %s", breaker.State())
+	}
+	if err := breaker.Allow(); err != nil {
+		t.Errorf("Expected the trial slot to still be free, got %v", err)
+	}
+}
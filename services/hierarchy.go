@@ -0,0 +1,283 @@
+package services
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/Appy29/rate-limiter/models"
+	"github.com/go-redis/redis/v8"
+)
+
+// Quota hierarchies nest token buckets: a request from a user consumes from the
+// user's bucket and from every enclosing quota (team, org), or from none of them.
+// The innermost level is the key's own token bucket, the one plain requests use, so a
+// key gets one bucket whether or not its token names a team or org. Enclosing quotas
+// are kept apart from plain per-key buckets under quotaKeyPrefix.
+// Keys limited by another algorithm keep it: the enclosing quotas are consumed first and
+// refunded when the key's own leaky bucket or fair share rejects.
+//
+// In Redis every level lives on the shard of its own key, so a busy org does not pull
+// the buckets of all its users onto one shard. Levels sharing a shard are updated by one
+// script; across shards the levels are consumed innermost first, and tokens (and period
+// usage) taken on earlier shards are refunded when a later one rejects. That is not
+// atomic: between the consume and the refund, concurrent requests see the refunded
+// tokens as taken and may be rejected, and a crash in between loses them until the
+// buckets refill. A hierarchy can never admit more than its quotas allow.
+
+const (
+	quotaKeyPrefix = "quota:"
+	maxQuotaDepth  = 8 // guards against long or cyclic parent chains
+)
+
+// QuotaLevel is one bucket of a quota hierarchy
+type QuotaLevel struct {
+	Key       string
+	Policy    models.RateLimitConfig
+	Enclosing bool // a team or org quota rather than the key's own bucket
+}
+
+// bucketKey names the level's bucket: the key's own bucket, or a quota bucket for enclosing levels
+func (level QuotaLevel) bucketKey() string {
+	if level.Enclosing {
+		return quotaKeyPrefix + level.Key
+	}
+	return tokenBucketKey(level.Key)
+}
+
+// hierarchyLevelsLua reads and refills the levels of a hierarchy script.
+// KEYS: one bucket per level, then the levels' period counters.
+// ARGV: tokens, now, level count, then capacity, rate, refill_tokens, initial_tokens,
+// ttl_ms, floor per level, then limit and expire_at_ms per counter.
+const hierarchyLevelsLua = `
+local level_count = tonumber(ARGV[3])
+local first_counter_key = level_count + 1
+local first_counter_arg = 4 + level_count * 6
+
+local function read_levels(now_us)
+	local levels = {}
+	for i = 1, level_count do
+		local key = KEYS[i]
+		local base = 3 + (i - 1) * 6
+		local level = {
+			key = key,
+			capacity = tonumber(ARGV[base + 1]),
+			refill_rate_us = tonumber(ARGV[base + 2]),
+			refill_tokens = tonumber(ARGV[base + 3]),
+			ttl_ms = tonumber(ARGV[base + 5]),
+			floor = tonumber(ARGV[base + 6]),
+		}
+
+		local tokens, last_refill_us = read_tokens(key)
+		if tokens == nil then
+			tokens = tonumber(ARGV[base + 4])
+			last_refill_us = now_us
+		end
+		level.tokens, level.last_refill_us = refill_tokens_at(tokens, last_refill_us, now_us, level.capacity, level.refill_rate_us, level.refill_tokens)
+
+		levels[i] = level
+	end
+	return levels
+end
+`
+
+// tokenBucketHierarchyScript atomically refills every level and consumes from all
+// of them only if none is in debt, each has enough tokens above its floor and no
+// period limit would be exceeded. State is written even when rejected.
+var tokenBucketHierarchyScript = redis.NewScript(bucketStateLua + tokenBucketLua + usageLua + hierarchyLevelsLua + `
+local tokens_needed = tonumber(ARGV[1])
+local now_us = current_time_us(tonumber(ARGV[2]))
+local levels = read_levels(now_us)
+
+local allowed = 1
+for _, level in ipairs(levels) do
+	if level.tokens < 0 or level.tokens - tokens_needed < level.floor then
+		allowed = 0
+	end
+end
+if allowed == 1 and usage_allows(first_counter_key, first_counter_arg, tokens_needed) then
+	usage_charge(first_counter_key, first_counter_arg, tokens_needed)
+else
+	allowed = 0
+end
+
+for _, level in ipairs(levels) do
+	if allowed == 1 then
+		level.tokens = level.tokens - tokens_needed
+	end
+	write_tokens(level.key, level.capacity, level.tokens, level.refill_rate_us, level.refill_tokens, level.last_refill_us, now_us, level.ttl_ms)
+end
+
+return allowed
+`)
+
+// tokenBucketRefundScript gives tokens back to levels that admitted a request another
+// shard then rejected, and takes them off their period counters.
+// A level never refills past its capacity.
+var tokenBucketRefundScript = redis.NewScript(bucketStateLua + tokenBucketLua + usageLua + hierarchyLevelsLua + `
+local tokens_refunded = tonumber(ARGV[1])
+local now_us = current_time_us(tonumber(ARGV[2]))
+
+for _, level in ipairs(read_levels(now_us)) do
+	level.tokens = math.min(level.capacity, level.tokens + tokens_refunded)
+	write_tokens(level.key, level.capacity, level.tokens, level.refill_rate_us, level.refill_tokens, level.last_refill_us, now_us, level.ttl_ms)
+end
+usage_charge(first_counter_key, first_counter_arg, -tokens_refunded)
+
+return 1
+`)
+
+// QuotaChain returns the keys a request consumes from, innermost first.
+// Parents named by the caller (JWT claims) come first, then the policies' parent links
+// are followed. A claim that contradicts a level's policy parent is an error rather
+// than a silently different hierarchy. A key without a hierarchy yields just itself.
+func (rrs *RedisRateLimiterService) QuotaChain(key string, parents []string) ([]string, error) {
+	chain := []string{key}
+	seen := map[string]bool{key: true}
+
+	for current := key; len(chain) < maxQuotaDepth; {
+		parent := rrs.policies.Resolve(current).Parent
+		if len(parents) > 0 {
+			if parent != "" && parent != parents[0] {
+				return nil, &models.ValidationError{
+					Status:  http.StatusForbidden,
+					Code:    models.ErrorCodeQuotaChainMismatch,
+					Message: fmt.Sprintf("token names %q as the parent quota of %q, but its policy names %q", parents[0], current, parent),
+				}
+			}
+			parent, parents = parents[0], parents[1:]
+		}
+		if parent == "" || seen[parent] {
+			break
+		}
+
+		chain = append(chain, parent)
+		seen[parent] = true
+		current = parent
+	}
+
+	return chain, nil
+}
+
+// AcquireHierarchy consumes tokens from every quota in the chain, or from none.
+// The key's own level is evaluated with the request's algorithm.
+// A non-nil error means the backend could not decide; the caller applies the policy fail mode.
+func (rrs *RedisRateLimiterService) AcquireHierarchy(keys []string, tokens int64, algorithm string, priority string) (bool, error) {
+	startTime := time.Now()
+
+	levels := withPriority(rrs.quotaLevels(keys), priority)
+	result, err := withPenalty(rrs.store, levels[0].Key, levels[0].Policy, func() (bool, error) {
+		return rrs.consumeHierarchy(rrs.store, levels, tokens, algorithm)
+	})
+
+	rrs.metrics.RecordRequest(result, !result && err == nil, time.Since(startTime))
+	return result, err
+}
+
+// AcquireHierarchyLocal evaluates the chain against the in-memory fallback buckets
+func (rrs *RedisRateLimiterService) AcquireHierarchyLocal(keys []string, tokens int64, algorithm string, priority string) bool {
+	levels := withPriority(rrs.quotaLevels(keys), priority)
+	result, _ := withPenalty(rrs.fallback, levels[0].Key, levels[0].Policy, func() (bool, error) {
+		return rrs.consumeHierarchy(rrs.fallback, levels, tokens, algorithm)
+	})
+	return result
+}
+
+// consumeHierarchy takes tokens from every level, running the key's own level with the
+// request's algorithm. Token buckets are consumed together by the store.
+func (rrs *RedisRateLimiterService) consumeHierarchy(store Store, levels []QuotaLevel, tokens int64, algorithm string) (bool, error) {
+	if algorithm == "token_bucket" {
+		return store.ConsumeHierarchy(levels, tokens)
+	}
+	return withQuotas(store, levels, tokens, func() (bool, error) {
+		return rrs.decide(store, levels[0].Key, levels[0].Policy, tokens, algorithm)
+	})
+}
+
+// withQuotas takes tokens from the enclosing quotas of the chain, then runs consume for
+// the key's own level. The quotas are refunded when consume does not admit.
+func withQuotas(store Store, levels []QuotaLevel, tokens int64, consume func() (bool, error)) (bool, error) {
+	quotas := levels[1:]
+	if len(quotas) == 0 {
+		return consume()
+	}
+
+	if allowed, err := store.ConsumeHierarchy(quotas, tokens); !allowed || err != nil {
+		return false, err
+	}
+
+	allowed, err := consume()
+	if !allowed {
+		if refundErr := store.RefundHierarchy(quotas, tokens); refundErr != nil {
+			log.Printf("Failed to refund %d tokens to the quotas of %s: %v", tokens, levels[0].Key, refundErr)
+		}
+	}
+	return allowed, err
+}
+
+// HierarchyStatus reports every quota in the chain (fallback if the store errors)
+func (rrs *RedisRateLimiterService) HierarchyStatus(keys []string) []models.QuotaStatus {
+	levels := rrs.quotaLevels(keys)
+
+	statuses, err := rrs.store.HierarchyStatus(levels)
+	if err != nil {
+		statuses, _ = rrs.fallback.HierarchyStatus(levels)
+	}
+
+	quotas := make([]models.QuotaStatus, len(levels))
+	for i, level := range levels {
+		quotas[i] = models.QuotaStatus{
+			Key:            level.Key,
+			TokensLeft:     statuses[i].Level,
+			Capacity:       statuses[i].Capacity,
+			NextRefillTime: statuses[i].Next,
+		}
+	}
+	return quotas
+}
+
+// quotaLevels resolves the policy of every key in the chain
+func (rrs *RedisRateLimiterService) quotaLevels(keys []string) []QuotaLevel {
+	levels := make([]QuotaLevel, len(keys))
+	for i, key := range keys {
+		levels[i] = QuotaLevel{Key: key, Policy: rrs.ResolvePolicy(key), Enclosing: i > 0}
+	}
+	return levels
+}
+
+// withPriority evaluates every level at the request's priority class
+func withPriority(levels []QuotaLevel, priority string) []QuotaLevel {
+	for i := range levels {
+		levels[i].Policy.Priority = priority
+	}
+	return levels
+}
+
+// consumeAll takes tokens from every bucket or from none, down to each bucket's floor (in-memory).
+// Buckets are locked in key order so overlapping hierarchies cannot deadlock.
+func consumeAll(keys []string, buckets []*tokenBucket, floors []int64, tokens int64) bool {
+	order := make([]int, len(buckets))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(a, b int) bool { return keys[order[a]] < keys[order[b]] })
+
+	for _, i := range order {
+		buckets[i].mutex.Lock()
+		defer buckets[i].mutex.Unlock()
+	}
+
+	for i, bucket := range buckets {
+		bucket.refill()
+		if bucket.tokens < 0 || bucket.tokens-float64(tokens) < float64(floors[i]) {
+			return false
+		}
+	}
+
+	for _, bucket := range buckets {
+		bucket.tokens -= float64(tokens)
+	}
+	return true
+}
@@ -0,0 +1,260 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Appy29/rate-limiter/models"
+)
+
+// hierarchyTestLevels is a user (10) in a team (10) in an org (15)
+func hierarchyTestLevels(user string) []QuotaLevel {
+	policy := func(key string, capacity int64) QuotaLevel {
+		return QuotaLevel{Key: key, Policy: models.RateLimitConfig{Key: key, Capacity: capacity, RefillRate: time.Hour, RefillTokens: 1}, Enclosing: key != user}
+	}
+	return []QuotaLevel{policy(user, 10), policy("team:payments", 10), policy("org:acme", 15)}
+}
+
+func TestMemoryStore_ConsumeHierarchy(t *testing.T) {
+	store := newMemoryStore(newBoundedStore[*tokenBucket](0, 0, 0), newBoundedStore[*leakyBucket](0, 0, 0))
+
+	// The user's own limit applies
+	if allowed, _ := store.ConsumeHierarchy(hierarchyTestLevels("alice"), 11); allowed {
+		t.Error("Expected a request above the user's limit to be rejected")
+	}
+	if allowed, _ := store.ConsumeHierarchy(hierarchyTestLevels("alice"), 8); !allowed {
+		t.Fatal("Expected a request within every limit to be allowed")
+	}
+
+	// bob is within the user limit, but the team has only 2 tokens left
+	if allowed, _ := store.ConsumeHierarchy(hierarchyTestLevels("bob"), 3); allowed {
+		t.Error("Expected the team quota to reject bob")
+	}
+
+	// The rejection must not have consumed from any level
+	statuses, _ := store.HierarchyStatus(hierarchyTestLevels("bob"))
+	want := []int64{10, 2, 7}
+	for i, status := range statuses {
+		if status.Level != want[i] {
+			t.Errorf("Expected %d tokens at level %d, got %d", want[i], i, status.Level)
+		}
+	}
+
+	// The user's level is alice's own bucket: requests without the hierarchy draw from it too
+	alice := hierarchyTestLevels("alice")[0]
+	if status, _ := store.TokenBucketStatus("alice", alice.Policy); status.Level != 2 {
+		t.Errorf("Expected the hierarchy to consume alice's own bucket, got %d tokens left", status.Level)
+	}
+	if allowed, _ := store.ConsumeTokens("alice", alice.Policy, 3); allowed {
+		t.Error("Expected a plain request to see the tokens the hierarchy consumed")
+	}
+}
+
+func TestQuotaChain(t *testing.T) {
+	cfg := createTestConfig()
+	cfg.Storage.Backend = StorageMemory
+	service, err := NewRedisRateLimiterService(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	service.policies.Set(models.RateLimitConfig{Key: "alice", Parent: "team:payments"})
+	service.policies.Set(models.RateLimitConfig{Key: "team:payments", Parent: "org:acme"})
+	service.policies.Set(models.RateLimitConfig{Key: "org:acme", Parent: "alice"}) // cycle
+
+	chain, err := service.QuotaChain("alice", nil)
+	if err != nil || len(chain) != 3 || chain[1] != "team:payments" || chain[2] != "org:acme" {
+		t.Errorf("Expected alice -> team:payments -> org:acme from policies, got %v", chain)
+	}
+
+	// Claims that agree with the policies, continued by the policy links past the last claim
+	chain, err = service.QuotaChain("alice", []string{"team:payments"})
+	if err != nil || len(chain) != 3 || chain[2] != "org:acme" {
+		t.Errorf("Expected the claimed team and the policy org, got %v (%v)", chain, err)
+	}
+
+	// A claim that contradicts a policy parent is an error, not a different hierarchy
+	_, err = service.QuotaChain("alice", []string{"team:search"})
+	var verr *models.ValidationError
+	if !errors.As(err, &verr) || verr.Code != models.ErrorCodeQuotaChainMismatch || verr.Status != http.StatusForbidden {
+		t.Errorf("Expected a 403 quota_chain_mismatch error, got %v", err)
+	}
+
+	// Keys without a policy parent take their parents from the claims
+	chain, err = service.QuotaChain("bob", []string{"team:search"})
+	if err != nil || len(chain) != 2 || chain[1] != "team:search" {
+		t.Errorf("Expected bob -> team:search from claims, got %v (%v)", chain, err)
+	}
+
+	if chain, _ := service.QuotaChain("carol", nil); len(chain) != 1 {
+		t.Errorf("Expected no hierarchy for carol, got %v", chain)
+	}
+}
+
+func TestRedisStore_ConsumeHierarchy(t *testing.T) {
+	_, store := newTestRedisStore(t)
+
+	if allowed, err := store.ConsumeHierarchy(hierarchyTestLevels("alice"), 11); allowed || err != nil {
+		t.Errorf("Expected a request above the user's limit to be rejected, got %v (%v)", allowed, err)
+	}
+	if allowed, err := store.ConsumeHierarchy(hierarchyTestLevels("alice"), 8); !allowed || err != nil {
+		t.Fatalf("Expected a request within every limit to be allowed, got %v (%v)", allowed, err)
+	}
+	if allowed, _ := store.ConsumeHierarchy(hierarchyTestLevels("bob"), 3); allowed {
+		t.Error("Expected the team quota to reject bob")
+	}
+
+	statuses, err := store.HierarchyStatus(hierarchyTestLevels("bob"))
+	if err != nil {
+		t.Fatalf("Expected the status to be readable, got %v", err)
+	}
+	want := []int64{10, 2, 7}
+	for i, status := range statuses {
+		if status.Level != want[i] {
+			t.Errorf("Expected %d tokens at level %d, got %d", want[i], i, status.Level)
+		}
+	}
+
+	// Switching between requests with and without the hierarchy does not double alice's capacity
+	alice := hierarchyTestLevels("alice")[0]
+	if allowed, err := store.ConsumeTokens("alice", alice.Policy, 3); allowed || err != nil {
+		t.Errorf("Expected a plain request to see the tokens the hierarchy consumed, got %v (%v)", allowed, err)
+	}
+	if statuses, _ := store.HierarchyStatus(hierarchyTestLevels("alice")); statuses[0].Level != 2 {
+		t.Errorf("Expected the status to report alice's own bucket with 2 tokens, got %d", statuses[0].Level)
+	}
+}
+
+func TestRedisStore_ConsumeHierarchy_AcrossShards(t *testing.T) {
+	servers, store := newTestRedisShards(t, 2)
+	orgShard := store.manager.GetClientIndex("org:acme")
+
+	// Users on the other shard than the org, so every request spans both shards
+	var users []string
+	for i := 0; len(users) < 2; i++ {
+		if user := fmt.Sprintf("user%d", i); store.manager.GetClientIndex(user) != orgShard {
+			users = append(users, user)
+		}
+	}
+
+	levels := func(user string) []QuotaLevel {
+		return []QuotaLevel{hierarchyTestLevels(user)[0], hierarchyTestLevels(user)[2]}
+	}
+
+	if allowed, err := store.ConsumeHierarchy(levels(users[0]), 10); !allowed || err != nil {
+		t.Fatalf("Expected the first user to be admitted, got %v (%v)", allowed, err)
+	}
+
+	// Each level lives on the shard of its own key
+	if !servers[orgShard].Exists("rate_limit:quota:org:acme") || servers[1-orgShard].Exists("rate_limit:quota:org:acme") {
+		t.Error("Expected the org bucket on the org's shard only")
+	}
+	if !servers[1-orgShard].Exists("rate_limit:token_bucket:"+users[0]) || servers[orgShard].Exists("rate_limit:token_bucket:"+users[0]) {
+		t.Error("Expected the user bucket on the user's shard only")
+	}
+
+	// The user's shard admits, the org's shard rejects: the user's tokens are refunded
+	if allowed, err := store.ConsumeHierarchy(levels(users[1]), 6); allowed || err != nil {
+		t.Fatalf("Expected the org quota to reject the second user, got %v (%v)", allowed, err)
+	}
+	statuses, _ := store.HierarchyStatus(levels(users[1]))
+	if statuses[0].Level != 10 || statuses[1].Level != 5 {
+		t.Errorf("Expected 10 user and 5 org tokens after the refund, got %d and %d", statuses[0].Level, statuses[1].Level)
+	}
+
+	// With the org's shard down nothing is consumed anywhere
+	store.manager.SetInstanceHealthy(orgShard, false)
+	if _, err := store.ConsumeHierarchy(levels(users[1]), 1); !errors.Is(err, ErrRedisUnavailable) {
+		t.Errorf("Expected ErrRedisUnavailable, got %v", err)
+	}
+	store.manager.SetInstanceHealthy(orgShard, true)
+	if statuses, _ := store.HierarchyStatus(levels(users[1])); statuses[0].Level != 10 {
+		t.Errorf("Expected the user's bucket untouched while the org was down, got %d", statuses[0].Level)
+	}
+}
+
+func TestAcquireHierarchy_OtherAlgorithmsConsumeQuotas(t *testing.T) {
+	cfg := createTestConfig()
+	cfg.Storage.Backend = StorageMemory
+	service, err := NewRedisRateLimiterService(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	defer service.Close()
+	service.policies.Set(models.RateLimitConfig{Key: "alice", Algorithm: "leaky_bucket", Capacity: 3, RefillRate: time.Hour})
+	service.policies.Set(models.RateLimitConfig{Key: "bob", Algorithm: "leaky_bucket", Capacity: 10, RefillRate: time.Hour})
+	service.policies.Set(models.RateLimitConfig{Key: "team:payments", Capacity: 5, RefillRate: time.Hour})
+
+	chain := func(user string) []string { return []string{user, "team:payments"} }
+	team := func() int64 { return service.HierarchyStatus(chain("alice"))[1].TokensLeft }
+
+	if allowed, err := service.AcquireHierarchy(chain("alice"), 2, "leaky_bucket", ""); !allowed || err != nil {
+		t.Fatalf("Expected alice to be admitted, got %v (%v)", allowed, err)
+	}
+	if team() != 3 {
+		t.Fatalf("Expected the team quota to be consumed by a leaky bucket request, got %d left", team())
+	}
+
+	// alice's own queue rejects: the team's tokens are refunded
+	if allowed, _ := service.AcquireHierarchy(chain("alice"), 2, "leaky_bucket", ""); allowed {
+		t.Fatal("Expected alice's leaky bucket to reject")
+	}
+	if team() != 3 {
+		t.Errorf("Expected the team's tokens to be refunded, got %d left", team())
+	}
+
+	// bob's queue has room, but the team quota does not
+	if allowed, _ := service.AcquireHierarchy(chain("bob"), 4, "leaky_bucket", ""); allowed {
+		t.Error("Expected the team quota to reject bob")
+	}
+	if status, _ := service.store.LeakyBucketStatus("bob", service.ResolvePolicy("bob")); status.HasState && status.Level != 0 {
+		t.Errorf("Expected nothing queued for bob, got %d", status.Level)
+	}
+
+	// Shaping mode is held to the quotas too
+	service.policies.Set(models.RateLimitConfig{Key: "bob", Algorithm: "leaky_bucket", Mode: models.LeakyModeShape, Capacity: 10, RefillRate: time.Hour})
+	if _, allowed, _ := service.Schedule(chain("bob"), 4, ""); allowed {
+		t.Error("Expected the team quota to reject bob's schedule")
+	}
+	if _, allowed, _ := service.Schedule(chain("bob"), 3, ""); !allowed || team() != 0 {
+		t.Errorf("Expected bob's schedule to take the team's last 3 tokens, got %v with %d left", allowed, team())
+	}
+}
+
+func TestRedisStore_RefundHierarchy(t *testing.T) {
+	_, store := newTestRedisStore(t)
+	quotas := hierarchyTestLevels("alice")[1:]
+
+	if allowed, err := store.ConsumeHierarchy(quotas, 4); !allowed || err != nil {
+		t.Fatalf("Expected the quotas to admit, got %v (%v)", allowed, err)
+	}
+	if err := store.RefundHierarchy(quotas, 4); err != nil {
+		t.Fatalf("Expected the refund to succeed, got %v", err)
+	}
+	// A second refund cannot fill the buckets past their capacity
+	if err := store.RefundHierarchy(quotas, 4); err != nil {
+		t.Fatalf("Expected the refund to succeed, got %v", err)
+	}
+
+	statuses, _ := store.HierarchyStatus(quotas)
+	if statuses[0].Level != 10 || statuses[1].Level != 15 {
+		t.Errorf("Expected the team and org back at 10 and 15 tokens, got %d and %d", statuses[0].Level, statuses[1].Level)
+	}
+}
+
+func TestMemoryStore_KeysCannotReachQuotaBuckets(t *testing.T) {
+	store := newMemoryStore(newBoundedStore[*tokenBucket](0, 0, 0), newBoundedStore[*leakyBucket](0, 0, 0))
+	levels := hierarchyTestLevels("alice")
+
+	// A key named like the team's quota bucket drains only its own bucket
+	attacker := models.RateLimitConfig{Capacity: 100, RefillRate: time.Hour}
+	if allowed, _ := store.ConsumeTokens(quotaKeyPrefix+"team:payments", attacker, 100); !allowed {
+		t.Fatal("Expected the key's own bucket to admit")
+	}
+
+	if allowed, _ := store.ConsumeHierarchy(levels, 10); !allowed {
+		t.Error("Expected the team quota to be untouched by the other key")
+	}
+}
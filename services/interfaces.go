@@ -8,10 +8,24 @@ import (
 
 // RateLimiterInterface defines the contract for rate limiting operations
 type RateLimiterInterface interface {
-	Acquire(key string, tokens int64, algorithm string) bool
+	Acquire(key string, tokens int64, algorithm string, priority string) (bool, error)
+	AcquireLocal(key string, tokens int64, algorithm string, priority string) bool
+	Schedule(keys []string, requests int64, priority string) (time.Time, bool, error) // rejected: when a retry could fit, or zero
+	ScheduleLocal(keys []string, requests int64, priority string) (time.Time, bool)
+	ResolvePolicy(key string) models.RateLimitConfig
+	ResolveCost(req models.AcquireRequest) (int64, error)
+	Feedback(report models.FeedbackRequest) (models.FeedbackResponse, error)
+	QuotaChain(key string, parents []string) ([]string, error)
+	AcquireHierarchy(keys []string, tokens int64, algorithm string, priority string) (bool, error)
+	AcquireHierarchyLocal(keys []string, tokens int64, algorithm string, priority string) bool
+	HierarchyStatus(keys []string) []models.QuotaStatus
+	GetUsage(keys []string, at time.Time) ([]models.PeriodUsage, error)
+	Penalty(key string) *models.PenaltyStatus
+	ClearPenalty(key string) error
 	GetStatus(key string) models.StatusResponse
 	GetMetrics() map[string]interface{}
 	GetPrometheusMetrics() string
+	GetHealth() models.HealthResponse
 }
 
 // TokenBucketInterface defines the interface for token bucket operations
@@ -23,6 +37,7 @@ type TokenBucketInterface interface {
 // LeakyBucketInterface defines the interface for leaky bucket operations
 type LeakyBucketInterface interface {
 	TryAdd(requests int64) bool
+	TrySchedule(requests int64) (time.Time, bool)
 	GetStatus() (queueLength int64, capacity int64, nextLeak time.Time)
 }
 
@@ -31,4 +46,7 @@ var (
 	_ RateLimiterInterface = (*RedisRateLimiterService)(nil)
 	_ TokenBucketInterface = (*tokenBucket)(nil)
 	_ LeakyBucketInterface = (*leakyBucket)(nil)
+	_ Store                = (*redisStore)(nil)
+	_ Store                = (*memoryStore)(nil)
+	_ Store                = (*diskStore)(nil)
 )
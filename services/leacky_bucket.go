@@ -2,7 +2,7 @@ package services
 
 import (
 	"context"
-	"encoding/json"
+	"fmt"
 	"sync"
 	"time"
 
@@ -20,12 +20,167 @@ type leakyBucket struct {
 
 // LeakyBucketRedis handles Redis-based leaky bucket operations
 type LeakyBucketRedis struct {
-	client   *redis.Client
-	key      string
-	capacity int64
-	leakRate time.Duration
+	client     *redis.Client
+	key        string
+	capacity   int64
+	leakRate   time.Duration
+	serverTime bool          // use the Redis server clock instead of the local one
+	ttl        time.Duration // how long idle state is kept
+	reserve    int64         // queue slots held back from this request's priority class
+	maxWait    time.Duration // shaping mode: longest a request may be scheduled ahead (0 = no limit)
+	usage      usageCounters // period counters charged with the requests
 }
 
+// leakyBucketAddScript atomically leaks and queues requests, leaving the reserved slots free.
+// It charges the period counters in KEYS[2] onwards (limits from ARGV[7]).
+var leakyBucketAddScript = redis.NewScript(bucketStateLua + usageLua + `
+local bucket_key = KEYS[1]
+local requests_to_add = tonumber(ARGV[1])
+local capacity = tonumber(ARGV[2])
+local leak_rate_us = tonumber(ARGV[3])
+local now_us = current_time_us(tonumber(ARGV[4]))
+local ttl_ms = tonumber(ARGV[5])
+local reserve = tonumber(ARGV[6])
+
+-- Get current bucket data
+local current_queue, last_leak_us = read_bucket(bucket_key, 'queue_length', 'last_leak_us')
+if current_queue == nil or last_leak_us == nil then
+	-- New bucket, start empty
+	current_queue = 0
+	last_leak_us = now_us
+end
+
+-- Calculate how many requests have leaked out
+local time_passed_us = now_us - last_leak_us
+local leak_periods = math.floor(time_passed_us / leak_rate_us)
+
+if leak_periods > 0 and current_queue > 0 then
+	-- Remove leaked requests (one request per leak period)
+	local requests_to_leak = math.min(leak_periods, current_queue)
+	current_queue = current_queue - requests_to_leak
+	last_leak_us = last_leak_us + (requests_to_leak * leak_rate_us)
+end
+
+-- Check if we can add the new requests without taking reserved slots or passing a period limit
+local allowed = 0
+if current_queue + requests_to_add <= capacity - reserve and usage_allows(2, 7, requests_to_add) then
+	current_queue = current_queue + requests_to_add
+	usage_charge(2, 7, requests_to_add)
+	allowed = 1
+end
+
+-- Save state even if the request failed
+redis.call('HSET', bucket_key,
+	'algorithm', 'leaky_bucket',
+	'capacity', int(capacity),
+	'queue_length', int(current_queue),
+	'leak_rate_us', int(leak_rate_us),
+	'last_leak_us', int(last_leak_us),
+	'last_updated', int(now_us))
+redis.call('PEXPIRE', bucket_key, ttl_ms) -- Drop the state once it is idle for the policy TTL
+
+return allowed
+`)
+
+// leakyBucketScheduleScript atomically leaks and queues requests in shaping mode.
+// A request at position p in the queue starts at last_leak_us + p * leak_rate_us;
+// an idle bucket restarts its schedule now. Requests that would start more than
+// max_wait_us from now are rejected. Period counters are charged as in
+// leakyBucketAddScript. Returns {allowed, delay_us}: the delay is measured on the
+// script's clock, so callers never compare it with a different one. A request rejected
+// for waiting too long reports the delay it would have had.
+var leakyBucketScheduleScript = redis.NewScript(bucketStateLua + usageLua + `
+local bucket_key = KEYS[1]
+local requests_to_add = tonumber(ARGV[1])
+local capacity = tonumber(ARGV[2])
+local leak_rate_us = tonumber(ARGV[3])
+local now_us = current_time_us(tonumber(ARGV[4]))
+local ttl_ms = tonumber(ARGV[5])
+local reserve = tonumber(ARGV[6])
+local max_wait_us = tonumber(ARGV[7])
+
+local current_queue, last_leak_us = read_bucket(bucket_key, 'queue_length', 'last_leak_us')
+if current_queue == nil or last_leak_us == nil then
+	current_queue = 0
+	last_leak_us = now_us
+end
+
+local leak_periods = math.floor((now_us - last_leak_us) / leak_rate_us)
+if leak_periods > 0 and current_queue > 0 then
+	local requests_to_leak = math.min(leak_periods, current_queue)
+	current_queue = current_queue - requests_to_leak
+	last_leak_us = last_leak_us + (requests_to_leak * leak_rate_us)
+end
+
+if current_queue == 0 then
+	last_leak_us = now_us -- idle: the drip schedule restarts now
+end
+
+if current_queue + requests_to_add > capacity - reserve or not usage_allows(2, 8, requests_to_add) then
+	return {0, 0}
+end
+
+local start_us = last_leak_us + current_queue * leak_rate_us
+if max_wait_us > 0 and start_us - now_us > max_wait_us then
+	return {0, start_us - now_us}
+end
+
+current_queue = current_queue + requests_to_add
+usage_charge(2, 8, requests_to_add)
+
+redis.call('HSET', bucket_key,
+	'algorithm', 'leaky_bucket',
+	'capacity', int(capacity),
+	'queue_length', int(current_queue),
+	'leak_rate_us', int(leak_rate_us),
+	'last_leak_us', int(last_leak_us),
+	'last_updated', int(now_us))
+redis.call('PEXPIRE', bucket_key, ttl_ms)
+
+return {1, math.max(0, start_us - now_us)}
+`)
+
+// leakyBucketMergeScript folds locally queued requests into the Redis state
+var leakyBucketMergeScript = redis.NewScript(bucketStateLua + `
+local bucket_key = KEYS[1]
+local local_queue = tonumber(ARGV[1])
+local local_last_leak_us = tonumber(ARGV[2])
+local capacity = tonumber(ARGV[3])
+local leak_rate_us = tonumber(ARGV[4])
+local now_us = current_time_us(tonumber(ARGV[5]))
+local ttl_ms = tonumber(ARGV[6])
+
+local current_queue = local_queue
+local last_leak_us = local_last_leak_us
+
+local redis_queue, redis_last_leak_us = read_bucket(bucket_key, 'queue_length', 'last_leak_us')
+if redis_queue ~= nil and redis_last_leak_us ~= nil then
+	-- Bring the Redis state up to date before comparing
+	local leak_periods = math.floor((now_us - redis_last_leak_us) / leak_rate_us)
+	if leak_periods > 0 and redis_queue > 0 then
+		local requests_to_leak = math.min(leak_periods, redis_queue)
+		redis_queue = redis_queue - requests_to_leak
+		redis_last_leak_us = redis_last_leak_us + (requests_to_leak * leak_rate_us)
+	end
+
+	if redis_queue > current_queue then
+		current_queue = redis_queue
+		last_leak_us = redis_last_leak_us
+	end
+end
+
+redis.call('HSET', bucket_key,
+	'algorithm', 'leaky_bucket',
+	'capacity', int(capacity),
+	'queue_length', int(current_queue),
+	'leak_rate_us', int(leak_rate_us),
+	'last_leak_us', int(last_leak_us),
+	'last_updated', int(now_us))
+redis.call('PEXPIRE', bucket_key, ttl_ms)
+
+return current_queue
+`)
+
 // NewLeakyBucket creates a new in-memory leaky bucket (fallback only)
 func NewLeakyBucket(capacity int64, leakRate time.Duration) *leakyBucket {
 	return &leakyBucket{
@@ -36,6 +191,16 @@ func NewLeakyBucket(capacity int64, leakRate time.Duration) *leakyBucket {
 	}
 }
 
+// restoreLeakyBucket recreates an in-memory leaky bucket from persisted state
+func restoreLeakyBucket(capacity int64, leakRate time.Duration, queue int64, lastLeak time.Time) *leakyBucket {
+	return &leakyBucket{
+		capacity: capacity,
+		queue:    min(capacity, queue),
+		leakRate: leakRate,
+		lastLeak: lastLeak,
+	}
+}
+
 // NewLeakyBucketRedis creates a new Redis-based leaky bucket
 func NewLeakyBucketRedis(client *redis.Client, key string, capacity int64, leakRate time.Duration) *LeakyBucketRedis {
 	return &LeakyBucketRedis{
@@ -43,135 +208,93 @@ func NewLeakyBucketRedis(client *redis.Client, key string, capacity int64, leakR
 		key:      "rate_limit:leaky_bucket:" + key,
 		capacity: capacity,
 		leakRate: leakRate,
+		ttl:      recoveryTime(capacity, leakRate, 1),
 	}
 }
 
-// TryAdd attempts to add requests to Redis-based leaky bucket
-func (lbr *LeakyBucketRedis) TryAdd(requests int64) bool {
+// TryAdd attempts to add requests to Redis-based leaky bucket.
+// The error is non-nil only when Redis could not make a decision.
+func (lbr *LeakyBucketRedis) TryAdd(requests int64) (bool, error) {
 	if requests < 0 {
-		return false
+		return false, nil
 	}
 
 	ctx := context.Background()
 
-	// Redis Lua script for atomic leaky bucket operations
-	luaScript := `
-		local bucket_key = KEYS[1]
-		local requests_to_add = tonumber(ARGV[1])
-		local capacity = tonumber(ARGV[2])
-		local leak_rate_ns = tonumber(ARGV[3])
-		local now_ns = tonumber(ARGV[4])
-		
-		-- Get current bucket data
-		local bucket_data = redis.call('GET', bucket_key)
-		local current_queue, last_leak_ns
-		
-		if bucket_data then
-			local data = cjson.decode(bucket_data)
-			current_queue = data.queue_length
-			last_leak_ns = data.last_leak_ns
-		else
-			-- New bucket, start empty
-			current_queue = 0
-			last_leak_ns = now_ns
-		end
-		
-		-- Calculate how many requests have leaked out
-		local time_passed_ns = now_ns - last_leak_ns
-		local leak_periods = math.floor(time_passed_ns / leak_rate_ns)
-		
-		if leak_periods > 0 and current_queue > 0 then
-			-- Remove leaked requests (one request per leak period)
-			local requests_to_leak = math.min(leak_periods, current_queue)
-			current_queue = current_queue - requests_to_leak
-			last_leak_ns = last_leak_ns + (requests_to_leak * leak_rate_ns)
-		end
-		
-		-- Check if we can add the new requests
-		if current_queue + requests_to_add <= capacity then
-			current_queue = current_queue + requests_to_add
-			
-			-- Save updated bucket data
-			local updated_data = {
-				algorithm = "leaky_bucket",
-				capacity = capacity,
-				queue_length = current_queue,
-				leak_rate_ns = leak_rate_ns,
-				last_leak_ns = last_leak_ns,
-				last_updated = now_ns
-			}
-			
-			redis.call('SET', bucket_key, cjson.encode(updated_data))
-			redis.call('EXPIRE', bucket_key, 3600) -- Expire in 1 hour if unused
-			
-			return 1 -- Success
-		else
-			-- Save current state even if request failed
-			local updated_data = {
-				algorithm = "leaky_bucket",
-				capacity = capacity,
-				queue_length = current_queue,
-				leak_rate_ns = leak_rate_ns,
-				last_leak_ns = last_leak_ns,
-				last_updated = now_ns
-			}
-			
-			redis.call('SET', bucket_key, cjson.encode(updated_data))
-			redis.call('EXPIRE', bucket_key, 3600)
-			
-			return 0 -- Failed
-		end
-	`
-
-	// Execute the Lua script
-	leakRateNs := lbr.leakRate.Nanoseconds()
-	nowNs := time.Now().UnixNano()
-
-	result, err := lbr.client.Eval(ctx, luaScript, []string{lbr.key}, requests, lbr.capacity, leakRateNs, nowNs).Result()
+	// EVALSHA the preloaded script; go-redis falls back to EVAL (which reloads it) on NOSCRIPT
+	leakRateUs := scriptRate(lbr.leakRate)
+	nowUs := scriptNow(lbr.serverTime)
+
+	keys := append([]string{lbr.key}, lbr.usage.keys...)
+	args := append([]interface{}{requests, lbr.capacity, leakRateUs, nowUs, lbr.ttl.Milliseconds(), lbr.reserve}, lbr.usage.args...)
+	result, err := leakyBucketAddScript.Run(ctx, lbr.client, keys, args...).Int64()
 
 	if err != nil {
-		return false
+		return false, fmt.Errorf("leaky bucket eval failed for %s: %w", lbr.key, err)
 	}
 
-	return result.(int64) == 1
+	return result == 1, nil
 }
 
-// GetStatus returns current status from Redis
-func (lbr *LeakyBucketRedis) GetStatus() (queueLength int64, capacity int64, nextLeak time.Time) {
+// TrySchedule admits requests into the Redis-based drip schedule (shaping mode)
+// and returns how long until the first of them may start. Requests rejected for
+// waiting longer than maxWait return the delay they would have had.
+// The error is non-nil only when Redis could not make a decision.
+func (lbr *LeakyBucketRedis) TrySchedule(requests int64) (time.Duration, bool, error) {
+	if requests < 0 {
+		return 0, false, nil
+	}
+
 	ctx := context.Background()
 
-	bucketData, err := lbr.client.Get(ctx, lbr.key).Result()
+	keys := append([]string{lbr.key}, lbr.usage.keys...)
+	args := append([]interface{}{requests, lbr.capacity, scriptRate(lbr.leakRate), scriptNow(lbr.serverTime), lbr.ttl.Milliseconds(), lbr.reserve, lbr.maxWait.Microseconds()}, lbr.usage.args...)
+	result, err := leakyBucketScheduleScript.Run(ctx, lbr.client, keys, args...).Int64Slice()
 	if err != nil {
-		// No data in Redis, return default values
-		return 0, lbr.capacity, time.Now().Add(lbr.leakRate)
+		return 0, false, fmt.Errorf("leaky bucket schedule failed for %s: %w", lbr.key, err)
 	}
+	if len(result) != 2 {
+		return 0, false, nil
+	}
+
+	return time.Duration(result[1]) * time.Microsecond, result[0] == 1, nil
+}
+
+// MergeLocal folds requests queued locally during an outage into the Redis state.
+// The longer of the two queues wins so recovery never grants a free burst.
+func (lbr *LeakyBucketRedis) MergeLocal(localQueue int64, localLastLeak time.Time) (int64, error) {
+	ctx := context.Background()
 
-	// Parse bucket data
-	var data struct {
-		Algorithm   string  `json:"algorithm"`
-		Capacity    int64   `json:"capacity"`
-		QueueLength int64   `json:"queue_length"`
-		LeakRateNs  int64   `json:"leak_rate_ns"`
-		LastLeakNs  float64 `json:"last_leak_ns"`
-		LastUpdated float64 `json:"last_updated"`
+	result, err := leakyBucketMergeScript.Run(ctx, lbr.client, []string{lbr.key},
+		localQueue, localLastLeak.UnixMicro(), lbr.capacity, scriptRate(lbr.leakRate), scriptNow(lbr.serverTime), lbr.ttl.Milliseconds()).Int64()
+	if err != nil {
+		return 0, fmt.Errorf("leaky bucket merge failed for %s: %w", lbr.key, err)
 	}
 
-	if err := json.Unmarshal([]byte(bucketData), &data); err != nil {
+	return result, nil
+}
+
+// GetStatus returns current status from Redis
+func (lbr *LeakyBucketRedis) GetStatus() (queueLength int64, capacity int64, nextLeak time.Time) {
+	ctx := context.Background()
+
+	data, exists, err := readBucketState(ctx, lbr.client, lbr.key, leakyBucketFields)
+	if err != nil || !exists || data.Rate <= 0 {
+		// No data in Redis, return default values
 		return 0, lbr.capacity, time.Now().Add(lbr.leakRate)
 	}
 
-	// Calculate current state (simulate leaking)
-	now := time.Now()
-	lastLeakNs := int64(data.LastLeakNs)
-	timePassed := now.UnixNano() - lastLeakNs
-	leakPeriods := timePassed / data.LeakRateNs
-	currentQueue := data.QueueLength - leakPeriods
+	// Calculate current state (simulate leaking) on the same clock as the script
+	now := redisNow(ctx, lbr.client, lbr.serverTime)
+	timePassed := now.Sub(data.Last)
+	leakPeriods := int64(timePassed / data.Rate)
+	currentQueue := data.Level - leakPeriods
 
 	if currentQueue < 0 {
 		currentQueue = 0
 	}
 
-	nextLeakTime := time.Unix(0, lastLeakNs).Add(time.Duration(data.LeakRateNs))
+	nextLeakTime := data.Last.Add(data.Rate)
 
 	return currentQueue, data.Capacity, nextLeakTime
 }
@@ -179,13 +302,23 @@ func (lbr *LeakyBucketRedis) GetStatus() (queueLength int64, capacity int64, nex
 // HasState checks if this leaky bucket has state in Redis
 func (lbr *LeakyBucketRedis) HasState() bool {
 	ctx := context.Background()
-	_, err := lbr.client.Get(ctx, lbr.key).Result()
-	return err == nil
+	count, err := lbr.client.Exists(ctx, lbr.key).Result()
+	return err == nil && count > 0
+}
+
+// ExpiresAt returns when the idle state expires in Redis (zero if there is no state)
+func (lbr *LeakyBucketRedis) ExpiresAt() time.Time {
+	return keyExpiresAt(context.Background(), lbr.client, lbr.key)
 }
 
 // TryAdd attempts to add requests to the bucket (in-memory)
 // Returns true if successful, false if bucket overflows
 func (lb *leakyBucket) TryAdd(requests int64) bool {
+	return lb.tryAdd(requests, 0)
+}
+
+// tryAdd adds requests only if reserve slots stay free afterwards (in-memory)
+func (lb *leakyBucket) tryAdd(requests int64, reserve int64) bool {
 	if requests < 0 {
 		return false
 	}
@@ -196,8 +329,8 @@ func (lb *leakyBucket) TryAdd(requests int64) bool {
 	// First, process any leaked requests based on time elapsed
 	lb.leak()
 
-	// Check if adding these requests would overflow the bucket
-	if lb.queue+requests > lb.capacity {
+	// Check if adding these requests would overflow the bucket or take reserved slots
+	if lb.queue+requests > lb.capacity-reserve {
 		return false
 	}
 
@@ -206,10 +339,61 @@ func (lb *leakyBucket) TryAdd(requests int64) bool {
 	return true
 }
 
+// TrySchedule admits requests into the drip schedule (shaping mode, in-memory).
+// Returns when the first of them may start; requests are spaced one leak interval apart.
+func (lb *leakyBucket) TrySchedule(requests int64) (time.Time, bool) {
+	return lb.trySchedule(requests, 0, 0)
+}
+
+// trySchedule schedules requests only if reserve slots stay free afterwards and they
+// start within maxWait (0 = no limit). Requests rejected for waiting too long return
+// when they would have started (in-memory).
+func (lb *leakyBucket) trySchedule(requests int64, reserve int64, maxWait time.Duration) (time.Time, bool) {
+	if requests < 0 {
+		return time.Time{}, false
+	}
+
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+
+	lb.leak()
+
+	if lb.queue == 0 {
+		lb.lastLeak = time.Now() // idle: the drip schedule restarts now
+	}
+
+	if lb.queue+requests > lb.capacity-reserve {
+		return time.Time{}, false
+	}
+
+	startAt := lb.lastLeak.Add(time.Duration(lb.queue) * lb.leakRate)
+	if maxWait > 0 && time.Until(startAt) > maxWait {
+		return startAt, false
+	}
+
+	lb.queue += requests
+	return startAt, true
+}
+
+// setLimits resizes the queue and changes its leak interval, leaking at the old rate first (in-memory).
+// A queue longer than the new capacity drains before new requests are admitted.
+func (lb *leakyBucket) setLimits(capacity int64, leakRate time.Duration) {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+
+	if capacity == lb.capacity && leakRate == lb.leakRate {
+		return
+	}
+
+	lb.leak()
+	lb.capacity = capacity
+	lb.leakRate = leakRate
+}
+
 // GetStatus returns current status of the bucket (in-memory)
 func (lb *leakyBucket) GetStatus() (queueLength int64, capacity int64, nextLeak time.Time) {
-	lb.mutex.RLock()
-	defer lb.mutex.RUnlock()
+	lb.mutex.Lock() // leak mutates the bucket
+	defer lb.mutex.Unlock()
 
 	// Process leaks before returning status
 	lb.leak()
@@ -217,6 +401,25 @@ func (lb *leakyBucket) GetStatus() (queueLength int64, capacity int64, nextLeak
 	return lb.queue, lb.capacity, lb.lastLeak.Add(lb.leakRate)
 }
 
+// drained reports whether every queued request has leaked out (in-memory)
+func (lb *leakyBucket) drained() bool {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+
+	lb.leak()
+	return lb.queue == 0
+}
+
+// snapshot returns the leaked queue length and leak timestamp (in-memory)
+func (lb *leakyBucket) snapshot() (queueLength int64, lastLeak time.Time) {
+	lb.mutex.Lock()
+	defer lb.mutex.Unlock()
+
+	lb.leak()
+
+	return lb.queue, lb.lastLeak
+}
+
 // leak processes requests based on elapsed time (in-memory)
 func (lb *leakyBucket) leak() {
 	now := time.Now()
@@ -123,3 +123,54 @@ func TestLeakyBucket_Concurrency(t *testing.T) {
 		t.Errorf("Expected queue length <= 100, got %d", queueLen)
 	}
 }
+
+// TestLeakyBucket_TrySchedule tests that shaping mode spaces requests one leak interval apart
+func TestLeakyBucket_TrySchedule(t *testing.T) {
+	leakRate := 100 * time.Millisecond
+	bucket := NewLeakyBucket(3, leakRate)
+
+	first, ok := bucket.TrySchedule(1)
+	if !ok {
+		t.Fatal("Expected first request to be scheduled")
+	}
+	if delay := time.Until(first); delay > 10*time.Millisecond {
+		t.Errorf("Expected first request to start immediately, got delay %v", delay)
+	}
+
+	for i := 1; i < 3; i++ {
+		startAt, ok := bucket.TrySchedule(1)
+		if !ok {
+			t.Fatalf("Expected request %d to be scheduled", i+1)
+		}
+		if gap := startAt.Sub(first); gap != time.Duration(i)*leakRate {
+			t.Errorf("Expected request %d to start %v after the first, got %v", i+1, time.Duration(i)*leakRate, gap)
+		}
+	}
+
+	if _, ok := bucket.TrySchedule(1); ok {
+		t.Error("Expected TrySchedule to reject when the schedule is full")
+	}
+}
+
+// TestLeakyBucket_TryScheduleMaxWait tests that shaping mode rejects requests scheduled too far ahead
+func TestLeakyBucket_TryScheduleMaxWait(t *testing.T) {
+	bucket := NewLeakyBucket(10, time.Second)
+
+	for i := 0; i < 3; i++ {
+		if _, ok := bucket.trySchedule(1, 0, 2*time.Second); !ok {
+			t.Fatalf("Expected request %d to start within the max wait", i+1)
+		}
+	}
+
+	startAt, ok := bucket.trySchedule(1, 0, 2*time.Second)
+	if ok {
+		t.Fatal("Expected a request 3s out to be rejected with a 2s max wait")
+	}
+	if delay := time.Until(startAt); delay < 2900*time.Millisecond || delay > 3*time.Second {
+		t.Errorf("Expected the rejected request's start 3s out, got %v", delay)
+	}
+
+	if queueLength, _, _ := bucket.GetStatus(); queueLength != 3 {
+		t.Errorf("Expected the rejected request not to be queued, got %d queued", queueLength)
+	}
+}
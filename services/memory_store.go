@@ -0,0 +1,491 @@
+package services
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Appy29/rate-limiter/models"
+)
+
+// tokenBucketKeyPrefix keeps the keys' own token buckets apart from the quota and fair
+// share buckets in the same in-memory store, like the rate_limit:token_bucket: keys in
+// Redis. Without it a key named quota:<team> would share the team's quota bucket.
+const tokenBucketKeyPrefix = "token_bucket:"
+
+// tokenBucketKey names the key's own in-memory token bucket
+func tokenBucketKey(key string) string {
+	return tokenBucketKeyPrefix + key
+}
+
+// memoryStore evaluates algorithms on process-local buckets.
+// It is the primary store for the "memory" backend and the fallback for the others.
+type memoryStore struct {
+	tokenBuckets *boundedStore[*tokenBucket]
+	leakyBuckets *boundedStore[*leakyBucket]
+
+	usage      *boundedStore[map[string]usageCounter] // key -> window ID -> counter
+	usageMutex sync.Mutex                             // guards the counters across check and charge
+
+	active      map[string]map[string]time.Time // fair share pool -> tenant -> last request
+	activeMutex sync.Mutex
+
+	penalties    *boundedStore[*penaltyRecord]
+	penaltyMutex sync.Mutex // guards the records across read and update
+
+	adaptive      map[string]int64 // AIMD limits; only keys with an adaptive policy have one
+	adaptiveMutex sync.Mutex
+
+	stopCh   chan struct{} // nil unless a sweeper runs
+	stopOnce sync.Once
+}
+
+// penaltyRecord is a key's in-memory penalty state
+type penaltyRecord struct {
+	violations int64
+	last       time.Time // last violation
+	until      time.Time // end of the penalty box
+	expireAt   time.Time // when the box is over and every violation has decayed
+}
+
+// newMemoryStore creates a Store over the given bounded bucket stores.
+// Period counters and penalties are bounded like the token buckets but never dropped
+// for being idle, since a key that is quiet for a day still owes its monthly usage.
+func newMemoryStore(tokenBuckets *boundedStore[*tokenBucket], leakyBuckets *boundedStore[*leakyBucket]) *memoryStore {
+	return &memoryStore{
+		tokenBuckets: tokenBuckets,
+		leakyBuckets: leakyBuckets,
+		usage:        newBoundedStoreLike[map[string]usageCounter](tokenBuckets, 0),
+		active:       make(map[string]map[string]time.Time),
+		penalties:    newBoundedStoreLike[*penaltyRecord](tokenBuckets, 0),
+		adaptive:     make(map[string]int64),
+	}
+}
+
+// ConsumeTokens runs the in-memory token bucket for the key
+func (ms *memoryStore) ConsumeTokens(key string, policy models.RateLimitConfig, tokens int64) (bool, error) {
+	return ms.charge([]QuotaLevel{{Key: key, Policy: policy}}, tokens, func() bool {
+		return ms.getOrCreateTokenBucket(tokenBucketKey(key), policy).tryConsume(tokens, policy.TokenFloor())
+	}), nil
+}
+
+// AddRequests runs the in-memory leaky bucket for the key
+func (ms *memoryStore) AddRequests(key string, policy models.RateLimitConfig, requests int64) (bool, error) {
+	return ms.charge([]QuotaLevel{{Key: key, Policy: policy}}, requests, func() bool {
+		return ms.getOrCreateLeakyBucket(key, policy).tryAdd(requests, policy.ReservedTokens(policy.Capacity))
+	}), nil
+}
+
+// ScheduleRequests runs the in-memory leaky bucket for the key in shaping mode
+func (ms *memoryStore) ScheduleRequests(key string, policy models.RateLimitConfig, requests int64) (time.Duration, bool, error) {
+	var startAt time.Time
+	allowed := ms.charge([]QuotaLevel{{Key: key, Policy: policy}}, requests, func() (allowed bool) {
+		startAt, allowed = ms.getOrCreateLeakyBucket(key, policy).trySchedule(requests, policy.ReservedTokens(policy.Capacity), policy.ScheduleMaxWait())
+		return allowed
+	})
+	return max(0, time.Until(startAt)), allowed, nil
+}
+
+// TokenBucketStatus reports the in-memory token bucket for the key
+func (ms *memoryStore) TokenBucketStatus(key string, policy models.RateLimitConfig) (BucketStatus, error) {
+	return ms.bucketStatus(tokenBucketKey(key), policy), nil
+}
+
+// bucketStatus reports any in-memory token bucket by its store key
+func (ms *memoryStore) bucketStatus(bucketKey string, policy models.RateLimitConfig) BucketStatus {
+	bucket, exists := ms.tokenBuckets.Get(bucketKey)
+	if !exists {
+		return newEmptyTokenBucketStatus(policy)
+	}
+
+	tokensLeft, capacity, nextRefill := bucket.GetStatus()
+	return BucketStatus{Level: tokensLeft, Capacity: capacity, Next: nextRefill, HasState: true}
+}
+
+// LeakyBucketStatus reports the in-memory leaky bucket for the key
+func (ms *memoryStore) LeakyBucketStatus(key string, policy models.RateLimitConfig) (BucketStatus, error) {
+	bucket, exists := ms.leakyBuckets.Get(key)
+	if !exists {
+		return newEmptyLeakyBucketStatus(policy), nil
+	}
+
+	queueLength, capacity, nextLeak := bucket.GetStatus()
+	return BucketStatus{Level: queueLength, Capacity: capacity, Next: nextLeak, HasState: true}, nil
+}
+
+// ConsumeHierarchy consumes from every in-memory level or from none
+func (ms *memoryStore) ConsumeHierarchy(levels []QuotaLevel, tokens int64) (bool, error) {
+	if tokens < 0 || len(levels) == 0 {
+		return false, nil
+	}
+
+	keys := make([]string, len(levels))
+	buckets := make([]*tokenBucket, len(levels))
+	floors := make([]int64, len(levels))
+	for i, level := range levels {
+		keys[i] = level.bucketKey()
+		buckets[i] = ms.getOrCreateTokenBucket(keys[i], level.Policy)
+		floors[i] = level.Policy.TokenFloor()
+	}
+
+	return ms.charge(levels, tokens, func() bool {
+		return consumeAll(keys, buckets, floors, tokens)
+	}), nil
+}
+
+// RefundHierarchy gives tokens back to every in-memory level and its period counters
+func (ms *memoryStore) RefundHierarchy(levels []QuotaLevel, tokens int64) error {
+	for _, level := range levels {
+		ms.getOrCreateTokenBucket(level.bucketKey(), level.Policy).refund(tokens)
+	}
+
+	ms.usageMutex.Lock()
+	defer ms.usageMutex.Unlock()
+
+	for _, level := range levels {
+		counters, _ := ms.usage.Get(level.Key)
+		for windowID, counter := range counters {
+			counter.value = max(0, counter.value-tokens)
+			counters[windowID] = counter
+		}
+	}
+	return nil
+}
+
+// HierarchyStatus reports every in-memory level
+func (ms *memoryStore) HierarchyStatus(levels []QuotaLevel) ([]BucketStatus, error) {
+	statuses := make([]BucketStatus, len(levels))
+	for i, level := range levels {
+		statuses[i] = ms.bucketStatus(level.bucketKey(), level.Policy)
+	}
+	return statuses, nil
+}
+
+// charge runs decide and, when it admits, adds tokens to the period counters of every
+// level. decide is not run when a period limit would be exceeded. The counters stay
+// locked throughout, so concurrent requests cannot overrun a limit together.
+func (ms *memoryStore) charge(levels []QuotaLevel, tokens int64, decide func() bool) bool {
+	now := time.Now()
+
+	windows := make([][]UsageWindow, len(levels))
+	metered := false
+	for i, level := range levels {
+		windows[i] = usageWindows(level.Policy, now)
+		metered = metered || len(windows[i]) > 0
+	}
+	if !metered {
+		return decide()
+	}
+
+	ms.usageMutex.Lock()
+	defer ms.usageMutex.Unlock()
+
+	for i, level := range levels {
+		counters, _ := ms.usage.Get(level.Key)
+		for _, window := range windows[i] {
+			if tokens > 0 && window.Limit > 0 && counters[window.ID].value+tokens > window.Limit {
+				return false
+			}
+		}
+	}
+
+	if !decide() {
+		return false
+	}
+
+	for i, level := range levels {
+		if len(windows[i]) == 0 {
+			continue
+		}
+
+		counters := ms.usage.GetOrCreate(level.Key, func() map[string]usageCounter {
+			return make(map[string]usageCounter)
+		})
+		for _, window := range windows[i] {
+			counter := counters[window.ID]
+			counter.value += tokens
+			counter.expireAt = window.expireAt()
+			counters[window.ID] = counter
+		}
+		dropExpiredUsage(counters, now)
+	}
+	return true
+}
+
+// Usage reads the level's in-memory period counters
+func (ms *memoryStore) Usage(level QuotaLevel, windows []UsageWindow) ([]int64, error) {
+	ms.usageMutex.Lock()
+	defer ms.usageMutex.Unlock()
+
+	counters, _ := ms.usage.Get(level.Key)
+	counts := make([]int64, len(windows))
+	for i, window := range windows {
+		counts[i] = counters[window.ID].value
+	}
+	return counts, nil
+}
+
+// takeUsage removes and returns the key's counters (for merging into another store)
+func (ms *memoryStore) takeUsage(key string) map[string]usageCounter {
+	ms.usageMutex.Lock()
+	defer ms.usageMutex.Unlock()
+
+	counters, _ := ms.usage.Get(key)
+	ms.usage.Delete(key)
+	return counters
+}
+
+// returnUsage adds counters taken with takeUsage back to the key
+func (ms *memoryStore) returnUsage(key string, counters map[string]usageCounter) {
+	ms.usageMutex.Lock()
+	defer ms.usageMutex.Unlock()
+
+	current := ms.usage.GetOrCreate(key, func() map[string]usageCounter {
+		return make(map[string]usageCounter)
+	})
+	for windowID, counter := range counters {
+		merged := current[windowID]
+		merged.value += counter.value
+		merged.expireAt = counter.expireAt
+		current[windowID] = merged
+	}
+}
+
+// usageKeys returns the keys with usage counters that match the filter
+func (ms *memoryStore) usageKeys(filter func(key string) bool) []string {
+	return ms.usage.Keys(filter)
+}
+
+// dropExpiredUsage forgets counters past their retention (caller holds the lock)
+func dropExpiredUsage(counters map[string]usageCounter, now time.Time) {
+	for windowID, counter := range counters {
+		if now.After(counter.expireAt) {
+			delete(counters, windowID)
+		}
+	}
+}
+
+// ConsumeFairShare marks the tenant active and consumes from the in-memory pool and share, or from neither
+func (ms *memoryStore) ConsumeFairShare(pool QuotaLevel, tenant QuotaLevel, tokens int64) (bool, error) {
+	if tokens < 0 {
+		return false, nil
+	}
+
+	active := ms.activeTenants(pool.Key, tenant.Key, fairShareWindow(pool.Policy))
+	share := fairSharePolicy(pool.Policy, active)
+
+	poolKey, _, shareKey := fairShareKeys(pool.Key, tenant.Key)
+	keys := []string{poolKey, shareKey}
+	buckets := []*tokenBucket{ms.getOrCreateTokenBucket(poolKey, pool.Policy), ms.getOrCreateTokenBucket(shareKey, share)}
+	floors := []int64{pool.Policy.ReservedTokens(pool.Policy.BurstSize()), share.ReservedTokens(share.Capacity)}
+
+	return ms.charge([]QuotaLevel{tenant}, tokens, func() bool {
+		return consumeAll(keys, buckets, floors, tokens)
+	}), nil
+}
+
+// FairShareStatus reports the in-memory pool and the tenant's share
+func (ms *memoryStore) FairShareStatus(pool QuotaLevel, tenant string) (PoolStatus, error) {
+	active := ms.activeTenants(pool.Key, "", fairShareWindow(pool.Policy))
+	share := fairSharePolicy(pool.Policy, active)
+
+	poolKey, _, shareKey := fairShareKeys(pool.Key, tenant)
+	poolStatus := ms.bucketStatus(poolKey, pool.Policy)
+	shareStatus := ms.bucketStatus(shareKey, share)
+	return PoolStatus{Active: active, Pool: poolStatus, Share: currentShare(shareStatus, share)}, nil
+}
+
+// activeTenants marks the tenant active (unless empty) and counts the pool's tenants seen within the window
+func (ms *memoryStore) activeTenants(pool string, tenant string, window time.Duration) int64 {
+	ms.activeMutex.Lock()
+	defer ms.activeMutex.Unlock()
+
+	now := time.Now()
+	tenants := ms.active[pool]
+	if tenants == nil {
+		tenants = make(map[string]time.Time)
+		ms.active[pool] = tenants
+	}
+	if tenant != "" {
+		tenants[tenant] = now
+	}
+
+	for name, lastSeen := range tenants {
+		if now.Sub(lastSeen) > window {
+			delete(tenants, name)
+		}
+	}
+	if len(tenants) == 0 {
+		delete(ms.active, pool)
+	}
+	return int64(len(tenants))
+}
+
+// RecordViolation counts a rejection of the key in memory and extends its penalty box
+func (ms *memoryStore) RecordViolation(key string, rule models.PenaltyConfig) (PenaltyState, error) {
+	ms.penaltyMutex.Lock()
+	defer ms.penaltyMutex.Unlock()
+
+	now := time.Now()
+	record := ms.penalties.GetOrCreate(key, func() *penaltyRecord { return &penaltyRecord{} })
+	record.violations = decayViolations(record.violations, record.last, now, rule.Window) + 1
+	record.last = now
+
+	if box := penaltyBox(rule, record.violations); box > 0 && now.Add(box).After(record.until) {
+		record.until = now.Add(box)
+	}
+	record.expireAt = now.Add(max(0, record.until.Sub(now)) + time.Duration(record.violations)*rule.Window)
+
+	return PenaltyState{Violations: record.violations, Remaining: max(0, record.until.Sub(now))}, nil
+}
+
+// Penalty reads the key's in-memory penalty state, forgetting it once fully decayed
+func (ms *memoryStore) Penalty(key string, rule models.PenaltyConfig) (PenaltyState, error) {
+	ms.penaltyMutex.Lock()
+	defer ms.penaltyMutex.Unlock()
+
+	now := time.Now()
+	record, exists := ms.penalties.Get(key)
+	if !exists {
+		return PenaltyState{}, nil
+	}
+
+	violations := decayViolations(record.violations, record.last, now, rule.Window)
+	if violations == 0 && !now.Before(record.until) {
+		ms.penalties.Delete(key)
+		return PenaltyState{}, nil
+	}
+	return PenaltyState{Violations: violations, Remaining: max(0, record.until.Sub(now))}, nil
+}
+
+// ClearPenalty forgets the key's in-memory penalty state
+func (ms *memoryStore) ClearPenalty(key string) error {
+	ms.penaltyMutex.Lock()
+	defer ms.penaltyMutex.Unlock()
+
+	ms.penalties.Delete(key)
+	return nil
+}
+
+// AdaptiveLimit reads the key's in-memory AIMD limit
+func (ms *memoryStore) AdaptiveLimit(key string) (int64, bool, error) {
+	ms.adaptiveMutex.Lock()
+	defer ms.adaptiveMutex.Unlock()
+
+	limit, exists := ms.adaptive[key]
+	return limit, exists, nil
+}
+
+// AdjustAdaptiveLimit moves the key's in-memory AIMD limit by one step
+func (ms *memoryStore) AdjustAdaptiveLimit(key string, step AdaptiveStep) (int64, error) {
+	ms.adaptiveMutex.Lock()
+	defer ms.adaptiveMutex.Unlock()
+
+	limit, exists := ms.adaptive[key]
+	if !exists {
+		limit = step.Initial
+	}
+
+	limit = step.next(limit)
+	ms.adaptive[key] = limit
+	return limit, nil
+}
+
+// penaltySnapshot returns a copy of the key's penalty record
+func (ms *memoryStore) penaltySnapshot(key string) (penaltyRecord, bool) {
+	ms.penaltyMutex.Lock()
+	defer ms.penaltyMutex.Unlock()
+
+	record, exists := ms.penalties.Get(key)
+	if !exists {
+		return penaltyRecord{}, false
+	}
+	return *record, true
+}
+
+// restorePenalty installs a persisted penalty record
+func (ms *memoryStore) restorePenalty(key string, record penaltyRecord) {
+	ms.penaltyMutex.Lock()
+	defer ms.penaltyMutex.Unlock()
+
+	ms.penalties.Delete(key)
+	ms.penalties.GetOrCreate(key, func() *penaltyRecord { return &record })
+}
+
+// sweep drops the state that no longer changes anything: token buckets back at full,
+// drained leaky buckets, expired period counters and penalties that have run out.
+// Returns how many entries it dropped. A request that fetched a bucket just before it
+// was dropped is charged to the dropped bucket, as when a bucket is evicted for being idle.
+func (ms *memoryStore) sweep(now time.Time) int {
+	removed := ms.tokenBuckets.Sweep(func(bucket *tokenBucket) bool { return bucket.recovered() })
+	removed += ms.leakyBuckets.Sweep(func(bucket *leakyBucket) bool { return bucket.drained() })
+
+	ms.usageMutex.Lock()
+	removed += ms.usage.Sweep(func(counters map[string]usageCounter) bool {
+		dropExpiredUsage(counters, now)
+		return len(counters) == 0
+	})
+	ms.usageMutex.Unlock()
+
+	ms.penaltyMutex.Lock()
+	removed += ms.penalties.Sweep(func(record *penaltyRecord) bool {
+		return !now.Before(record.until) && !now.Before(record.expireAt)
+	})
+	ms.penaltyMutex.Unlock()
+
+	return removed
+}
+
+// startSweeper sweeps the store every interval until it is closed.
+// Stores that never evict need it, or every key ever seen stays in memory.
+func (ms *memoryStore) startSweeper(interval time.Duration) {
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	ms.stopCh = make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case now := <-ticker.C:
+				ms.sweep(now)
+			case <-ms.stopCh:
+				return
+			}
+		}
+	}()
+}
+
+// Close stops the sweeper, if any
+func (ms *memoryStore) Close() error {
+	ms.stopOnce.Do(func() {
+		if ms.stopCh != nil {
+			close(ms.stopCh)
+		}
+	})
+	return nil
+}
+
+// Bucket creation methods
+func (ms *memoryStore) getOrCreateTokenBucket(key string, policy models.RateLimitConfig) *tokenBucket {
+	bucket := ms.tokenBuckets.GetOrCreate(key, func() *tokenBucket {
+		bucket := NewTokenBucket(policy.BurstSize(), policy.RefillRate)
+		bucket.tokens = float64(policy.StartTokens())
+		if policy.RefillTokens > 0 {
+			bucket.refillTokens = policy.RefillTokens
+		}
+		return bucket
+	})
+	bucket.setLimits(policy.BurstSize(), policy.RefillRate) // adaptive limits change over time
+	return bucket
+}
+
+func (ms *memoryStore) getOrCreateLeakyBucket(key string, policy models.RateLimitConfig) *leakyBucket {
+	bucket := ms.leakyBuckets.GetOrCreate(key, func() *leakyBucket {
+		return NewLeakyBucket(policy.Capacity, policy.RefillRate)
+	})
+	bucket.setLimits(policy.Capacity, policy.RefillRate)
+	return bucket
+}
@@ -3,6 +3,9 @@ package services
 import (
 	"fmt"
 	"runtime"
+	"sort"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -12,6 +15,9 @@ type MetricsInterface interface {
 	RecordRequest(success bool, rateLimited bool, responseTime time.Duration)
 	RecordRedisLatency(latency time.Duration)
 	UpdateRedisHealth(healthy bool)
+	RecordInstanceLatency(instance string, latency time.Duration)
+	UpdateInstanceHealth(instance string, healthy bool)
+	RecordBreakerTransition(instance string, from string, to string)
 	GetMetrics() map[string]interface{}
 	GetPrometheusMetrics() string
 }
@@ -33,13 +39,26 @@ type MetricsCollector struct {
 	redisHealthy   int32 // using int32 for atomic operations (0=false, 1=true)
 	lastRedisCheck int64 // Unix timestamp
 
+	// Per-instance Redis gauges, keyed by instance name
+	instances      map[string]*instanceMetrics
+	instancesMutex sync.RWMutex
+
 	// Service start time
 	startTime time.Time
 }
 
+// instanceMetrics holds the latest health probe result for one Redis instance
+type instanceMetrics struct {
+	healthy      bool
+	latency      time.Duration
+	breakerState string           // current circuit breaker state
+	transitions  map[string]int64 // breaker transitions by target state
+}
+
 // NewMetricsCollector creates a new metrics collector
 func NewMetricsCollector() MetricsInterface {
 	return &MetricsCollector{
+		instances: make(map[string]*instanceMetrics),
 		startTime: time.Now(),
 	}
 }
@@ -74,6 +93,55 @@ func (mc *MetricsCollector) UpdateRedisHealth(healthy bool) {
 	atomic.StoreInt64(&mc.lastRedisCheck, time.Now().Unix())
 }
 
+// RecordInstanceLatency records the latest probe latency for a Redis instance
+func (mc *MetricsCollector) RecordInstanceLatency(instance string, latency time.Duration) {
+	mc.instancesMutex.Lock()
+	defer mc.instancesMutex.Unlock()
+
+	mc.getOrCreateInstance(instance).latency = latency
+}
+
+// UpdateInstanceHealth updates the health gauge for a Redis instance
+func (mc *MetricsCollector) UpdateInstanceHealth(instance string, healthy bool) {
+	mc.instancesMutex.Lock()
+	defer mc.instancesMutex.Unlock()
+
+	mc.getOrCreateInstance(instance).healthy = healthy
+}
+
+// RecordBreakerTransition records a circuit breaker state change for a Redis instance
+func (mc *MetricsCollector) RecordBreakerTransition(instance string, from string, to string) {
+	mc.instancesMutex.Lock()
+	defer mc.instancesMutex.Unlock()
+
+	stats := mc.getOrCreateInstance(instance)
+	stats.breakerState = to
+	stats.transitions[to]++
+}
+
+// getOrCreateInstance returns the gauges for an instance (caller holds the lock)
+func (mc *MetricsCollector) getOrCreateInstance(instance string) *instanceMetrics {
+	stats, exists := mc.instances[instance]
+	if !exists {
+		stats = &instanceMetrics{
+			breakerState: BreakerClosed.String(),
+			transitions:  make(map[string]int64),
+		}
+		mc.instances[instance] = stats
+	}
+	return stats
+}
+
+// sortedInstanceNames returns instance names in stable order (caller holds the lock)
+func (mc *MetricsCollector) sortedInstanceNames() []string {
+	names := make([]string, 0, len(mc.instances))
+	for name := range mc.instances {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 // GetMetrics returns metrics in a structured format
 func (mc *MetricsCollector) GetMetrics() map[string]interface{} {
 	// Load all atomic values
@@ -104,6 +172,24 @@ func (mc *MetricsCollector) GetMetrics() map[string]interface{} {
 		avgRedisLatency = float64(redisLatencyTotal) / float64(redisRequestCount) / 1e6 // Convert to milliseconds
 	}
 
+	mc.instancesMutex.RLock()
+	instances := make(map[string]interface{}, len(mc.instances))
+	for name, stats := range mc.instances {
+		// Copied under the lock: the caller encodes it while breakers keep recording
+		transitions := make(map[string]int64, len(stats.transitions))
+		for state, count := range stats.transitions {
+			transitions[state] = count
+		}
+
+		instances[name] = map[string]interface{}{
+			"healthy":             stats.healthy,
+			"latency_ms":          float64(stats.latency.Nanoseconds()) / 1e6,
+			"breaker_state":       stats.breakerState,
+			"breaker_transitions": transitions,
+		}
+	}
+	mc.instancesMutex.RUnlock()
+
 	return map[string]interface{}{
 		"service": map[string]interface{}{
 			"name":    "rate-limiter",
@@ -126,6 +212,7 @@ func (mc *MetricsCollector) GetMetrics() map[string]interface{} {
 			"last_health_check":    lastRedisCheck,
 			"avg_latency_ms":       avgRedisLatency,
 			"total_redis_requests": redisRequestCount,
+			"instances":            instances,
 		},
 		"memory": map[string]interface{}{
 			"alloc_mb": bToMb(getCurrentMemoryUsage()),
@@ -214,7 +301,60 @@ rate_limiter_uptime_seconds %.2f
 		avgRedisLatency,
 		bToMb(getCurrentMemoryUsage()),
 		time.Since(mc.startTime).Seconds(),
-	)
+	) + mc.instancePrometheusMetrics()
+}
+
+// instancePrometheusMetrics renders the per-instance Redis gauges
+func (mc *MetricsCollector) instancePrometheusMetrics() string {
+	mc.instancesMutex.RLock()
+	defer mc.instancesMutex.RUnlock()
+
+	names := mc.sortedInstanceNames()
+
+	var b strings.Builder
+	b.WriteString("\n# HELP rate_limiter_redis_instance_healthy Redis instance health (1=healthy, 0=unhealthy)\n")
+	b.WriteString("# TYPE rate_limiter_redis_instance_healthy gauge\n")
+	for _, name := range names {
+		healthy := 0
+		if mc.instances[name].healthy {
+			healthy = 1
+		}
+		fmt.Fprintf(&b, "rate_limiter_redis_instance_healthy{instance=%q} %d\n", name, healthy)
+	}
+
+	b.WriteString("\n# HELP rate_limiter_redis_instance_latency_ms Last health probe latency in milliseconds\n")
+	b.WriteString("# TYPE rate_limiter_redis_instance_latency_ms gauge\n")
+	for _, name := range names {
+		latency := float64(mc.instances[name].latency.Nanoseconds()) / 1e6
+		fmt.Fprintf(&b, "rate_limiter_redis_instance_latency_ms{instance=%q} %.2f\n", name, latency)
+	}
+
+	b.WriteString("\n# HELP rate_limiter_redis_breaker_state Circuit breaker state (0=closed, 1=half_open, 2=open)\n")
+	b.WriteString("# TYPE rate_limiter_redis_breaker_state gauge\n")
+	for _, name := range names {
+		fmt.Fprintf(&b, "rate_limiter_redis_breaker_state{instance=%q} %d\n", name, breakerStateValue(mc.instances[name].breakerState))
+	}
+
+	b.WriteString("\n# HELP rate_limiter_redis_breaker_transitions_total Circuit breaker transitions by target state\n")
+	b.WriteString("# TYPE rate_limiter_redis_breaker_transitions_total counter\n")
+	for _, name := range names {
+		for _, state := range []BreakerState{BreakerClosed, BreakerHalfOpen, BreakerOpen} {
+			fmt.Fprintf(&b, "rate_limiter_redis_breaker_transitions_total{instance=%q,to=%q} %d\n",
+				name, state.String(), mc.instances[name].transitions[state.String()])
+		}
+	}
+
+	return b.String()
+}
+
+// breakerStateValue maps a breaker state name to its gauge value
+func breakerStateValue(state string) int {
+	for _, s := range []BreakerState{BreakerClosed, BreakerHalfOpen, BreakerOpen} {
+		if s.String() == state {
+			return int(s)
+		}
+	}
+	return 0
 }
 
 // Helper functions for memory metrics
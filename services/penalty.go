@@ -0,0 +1,168 @@
+package services
+
+import (
+	"log"
+	"math"
+	"time"
+
+	"github.com/Appy29/rate-limiter/models"
+	"github.com/go-redis/redis/v8"
+)
+
+// Penalty boxes punish keys that keep getting rate limited. A bucket refills at
+// its normal pace no matter how hard it is hammered, so rejections are counted per
+// key and repeat offenders are rejected outright for a growing time. Violations
+// decay by one per quiet window, so a key that behaves recovers on its own.
+
+const penaltyKeyPrefix = "penalty:"
+
+// Penalty defaults for zero fields of a policy's PenaltyConfig
+const (
+	defaultPenaltyThreshold  = 10
+	defaultPenaltyWindow     = time.Minute
+	defaultPenaltyBase       = time.Second
+	defaultPenaltyMultiplier = 2
+	defaultPenaltyMax        = time.Hour
+)
+
+// PenaltyState is a key's recent violations and what is left of its penalty box.
+// Remaining is measured on the store's clock, so it is safe to compare across clocks.
+type PenaltyState struct {
+	Violations int64
+	Remaining  time.Duration // zero if the key is not boxed
+}
+
+// penaltyRecordScript counts a violation, decaying older ones first, and extends the box.
+// Returns {violations, remaining_us}.
+// ARGV: now, threshold, window_us, base_us, multiplier, max_us.
+var penaltyRecordScript = redis.NewScript(bucketStateLua + `
+local key = KEYS[1]
+local now_us = current_time_us(tonumber(ARGV[1]))
+local threshold = tonumber(ARGV[2])
+local window_us = tonumber(ARGV[3])
+local base_us = tonumber(ARGV[4])
+local multiplier = tonumber(ARGV[5])
+local max_us = tonumber(ARGV[6])
+
+local values = redis.call('HMGET', key, 'violations', 'last_us', 'until_us')
+local violations = tonumber(values[1]) or 0
+local last_us = tonumber(values[2]) or now_us
+local until_us = tonumber(values[3]) or 0
+
+-- One violation is forgiven per quiet window
+violations = math.max(0, violations - math.floor(math.max(0, now_us - last_us) / window_us)) + 1
+
+if violations >= threshold then
+	local box_us = math.min(max_us, base_us * multiplier ^ (violations - threshold))
+	until_us = math.max(until_us, now_us + box_us)
+end
+
+redis.call('HSET', key, 'violations', int(violations), 'last_us', int(now_us), 'until_us', int(until_us))
+-- Keep the state until the box is over and every violation has decayed
+redis.call('PEXPIRE', key, math.ceil((math.max(0, until_us - now_us) + violations * window_us) / 1000))
+
+return {violations, math.max(0, until_us - now_us)}
+`)
+
+// penaltyRule returns the policy's penalty settings with defaults filled in
+func penaltyRule(config models.PenaltyConfig) models.PenaltyConfig {
+	if config.Threshold <= 0 {
+		config.Threshold = defaultPenaltyThreshold
+	}
+	if config.Window <= 0 {
+		config.Window = defaultPenaltyWindow
+	}
+	if config.Base <= 0 {
+		config.Base = defaultPenaltyBase
+	}
+	if config.Multiplier <= 0 {
+		config.Multiplier = defaultPenaltyMultiplier
+	}
+	if config.Max <= 0 {
+		config.Max = defaultPenaltyMax
+	}
+	return config
+}
+
+// penaltyBox is how long the violations-th violation boxes the key (0 below the threshold)
+func penaltyBox(rule models.PenaltyConfig, violations int64) time.Duration {
+	if violations < rule.Threshold {
+		return 0
+	}
+
+	box := float64(rule.Base) * math.Pow(rule.Multiplier, float64(violations-rule.Threshold))
+	if box >= float64(rule.Max) {
+		return rule.Max
+	}
+	return time.Duration(box)
+}
+
+// decayViolations forgives one violation per window since the last one
+func decayViolations(violations int64, last time.Time, now time.Time, window time.Duration) int64 {
+	if elapsed := now.Sub(last); elapsed > 0 {
+		violations -= int64(elapsed / window)
+	}
+	return max(0, violations)
+}
+
+// withPenalty rejects keys in the penalty box without running decide, and counts
+// a violation whenever decide rejects. Keys without a penalty policy skip both.
+func withPenalty(store Store, key string, policy models.RateLimitConfig, decide func() (bool, error)) (bool, error) {
+	if policy.Penalty == nil {
+		return decide()
+	}
+	rule := penaltyRule(*policy.Penalty)
+
+	state, err := store.Penalty(key, rule)
+	if err != nil {
+		return false, err
+	}
+	if state.Remaining > 0 {
+		return false, nil
+	}
+
+	allowed, err := decide()
+	if !allowed && err == nil {
+		if state, err := store.RecordViolation(key, rule); err != nil {
+			log.Printf("Failed to record violation for %s: %v", key, err)
+		} else if state.Remaining > 0 {
+			log.Printf("Penalty box for %s for %s after %d violations", key, state.Remaining, state.Violations)
+		}
+	}
+	return allowed, err
+}
+
+// Penalty reports the key's violations and penalty box (nil if it has none)
+func (rrs *RedisRateLimiterService) Penalty(key string) *models.PenaltyStatus {
+	policy := rrs.ResolvePolicy(key)
+	if policy.Penalty == nil {
+		return nil
+	}
+	rule := penaltyRule(*policy.Penalty)
+
+	state, err := rrs.store.Penalty(key, rule)
+	if err != nil {
+		state, _ = rrs.fallback.Penalty(key, rule)
+	}
+	if state.Violations == 0 && state.Remaining <= 0 {
+		return nil
+	}
+
+	status := &models.PenaltyStatus{Violations: state.Violations}
+	if state.Remaining > 0 {
+		boxedUntil := time.Now().Add(state.Remaining)
+		status.BoxedUntil = &boxedUntil
+	}
+	return status
+}
+
+// ClearPenalty forgets the key's violations and releases it from the penalty box
+func (rrs *RedisRateLimiterService) ClearPenalty(key string) error {
+	if err := rrs.store.ClearPenalty(key); err != nil {
+		return err
+	}
+	_ = rrs.fallback.ClearPenalty(key)
+
+	log.Printf("Penalty cleared for %s", key)
+	return nil
+}
@@ -0,0 +1,79 @@
+package services
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Appy29/rate-limiter/models"
+)
+
+func TestWithPenalty(t *testing.T) {
+	store := newMemoryStore(newBoundedStore[*tokenBucket](0, 0, 0), newBoundedStore[*leakyBucket](0, 0, 0))
+	policy := models.RateLimitConfig{Penalty: &models.PenaltyConfig{Threshold: 3, Base: time.Minute, Max: 3 * time.Minute}}
+	rule := penaltyRule(*policy.Penalty)
+
+	calls := 0
+	reject := func() (bool, error) {
+		calls++
+		return false, nil
+	}
+
+	// Rejections below the threshold only count
+	for i := 0; i < 2; i++ {
+		withPenalty(store, "scraper", policy, reject)
+	}
+	if state, _ := store.Penalty("scraper", rule); state.Violations != 2 || state.Remaining != 0 {
+		t.Fatalf("Expected 2 violations and no box, got %+v", state)
+	}
+
+	// The third one boxes the key, and boxed requests never reach the bucket
+	withPenalty(store, "scraper", policy, reject)
+	if allowed, _ := withPenalty(store, "scraper", policy, func() (bool, error) { return true, nil }); allowed {
+		t.Error("Expected a boxed key to be rejected")
+	}
+	if calls != 3 {
+		t.Errorf("Expected the bucket to be skipped while boxed, got %d calls", calls)
+	}
+
+	// Clearing releases the key
+	store.ClearPenalty("scraper")
+	if allowed, _ := withPenalty(store, "scraper", policy, func() (bool, error) { return true, nil }); !allowed {
+		t.Error("Expected a cleared key to be allowed")
+	}
+}
+
+func TestPenaltyBox(t *testing.T) {
+	rule := penaltyRule(models.PenaltyConfig{Threshold: 3, Base: time.Second, Max: 5 * time.Second})
+
+	want := map[int64]time.Duration{2: 0, 3: time.Second, 4: 2 * time.Second, 5: 4 * time.Second, 6: 5 * time.Second}
+	for violations, box := range want {
+		if got := penaltyBox(rule, violations); got != box {
+			t.Errorf("Expected a %v box after %d violations, got %v", box, violations, got)
+		}
+	}
+}
+
+func TestDecayViolations(t *testing.T) {
+	now := time.Now()
+
+	if got := decayViolations(5, now.Add(-150*time.Second), now, time.Minute); got != 3 {
+		t.Errorf("Expected 2 of 5 violations forgiven after 2.5 windows, got %d left", got)
+	}
+	if got := decayViolations(2, now.Add(-time.Hour), now, time.Minute); got != 0 {
+		t.Errorf("Expected violations never to go negative, got %d", got)
+	}
+}
+
+func TestMemoryStore_PenaltiesAreBounded(t *testing.T) {
+	store := newMemoryStore(newBoundedStore[*tokenBucket](16, 0, 1), newBoundedStore[*leakyBucket](16, 0, 1))
+	rule := penaltyRule(models.PenaltyConfig{})
+
+	// A spray of distinct keys cannot grow the penalties past the bucket limit
+	for i := 0; i < 1000; i++ {
+		store.RecordViolation("spray_"+strconv.Itoa(i), rule)
+	}
+	if got := store.penalties.Len(); got != 16 {
+		t.Errorf("Expected at most 16 penalty records, got %d", got)
+	}
+}
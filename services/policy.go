@@ -0,0 +1,122 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/Appy29/rate-limiter/config"
+	"github.com/Appy29/rate-limiter/models"
+)
+
+// PolicyStore resolves the rate limiting policy that applies to a key
+type PolicyStore struct {
+	defaults models.RateLimitConfig
+	policies map[string]models.RateLimitConfig
+}
+
+// NewPolicyStore creates a policy store from config defaults and the optional policy file
+func NewPolicyStore(cfg *config.Config) *PolicyStore {
+	ps := &PolicyStore{
+		defaults: models.RateLimitConfig{
+			Algorithm:    cfg.RateLimit.Algorithm,
+			Capacity:     cfg.RateLimit.DefaultCapacity,
+			RefillRate:   cfg.RateLimit.DefaultRefill,
+			RefillTokens: 1,
+			FailMode:     cfg.Policy.FailMode,
+		},
+		policies: make(map[string]models.RateLimitConfig),
+	}
+
+	if !models.IsAlgorithm(ps.defaults.Algorithm) {
+		ps.defaults.Algorithm = "token_bucket"
+	}
+	if !isValidFailMode(ps.defaults.FailMode) {
+		ps.defaults.FailMode = models.FailModeLocal
+	}
+
+	if cfg.Policy.File != "" {
+		policies, err := loadPolicyFile(cfg.Policy.File)
+		if err != nil {
+			log.Printf("Failed to load policy file %s: %v", cfg.Policy.File, err)
+		}
+		for _, policy := range policies {
+			ps.Set(policy)
+		}
+	}
+
+	return ps
+}
+
+// Resolve returns the policy for the key, falling back to the defaults
+func (ps *PolicyStore) Resolve(key string) models.RateLimitConfig {
+	if policy, exists := ps.policies[key]; exists {
+		return policy
+	}
+
+	policy := ps.defaults
+	policy.Key = key
+	return policy
+}
+
+// Set registers a policy, filling unset fields from the defaults
+func (ps *PolicyStore) Set(policy models.RateLimitConfig) {
+	if policy.Algorithm != "" && !models.IsAlgorithm(policy.Algorithm) {
+		log.Printf("Policy %s: ignoring unknown algorithm %q", policy.Key, policy.Algorithm)
+		policy.Algorithm = ""
+	}
+	if policy.Algorithm == "" {
+		policy.Algorithm = ps.defaults.Algorithm
+		if policy.Pool != "" {
+			policy.Algorithm = fairShareAlgorithm // keys in a global pool share it fairly by default
+		}
+	}
+	if policy.Capacity <= 0 {
+		policy.Capacity = ps.defaults.Capacity
+	}
+	if policy.RefillRate <= 0 {
+		policy.RefillRate = ps.defaults.RefillRate
+	}
+	if policy.RefillTokens <= 0 {
+		policy.RefillTokens = ps.defaults.RefillTokens
+	}
+	if !isValidFailMode(policy.FailMode) {
+		policy.FailMode = ps.defaults.FailMode
+	}
+	if policy.Mode != models.LeakyModeShape {
+		policy.Mode = models.LeakyModeMeter
+	}
+	for _, quota := range policy.Periods {
+		if quota.Period != models.PeriodDay && quota.Period != models.PeriodMonth {
+			log.Printf("Policy %s: ignoring unknown quota period %q", policy.Key, quota.Period)
+		}
+	}
+
+	ps.policies[policy.Key] = policy
+}
+
+// loadPolicyFile reads a JSON array of per-key policies
+func loadPolicyFile(path string) ([]models.RateLimitConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var policies []models.RateLimitConfig
+	if err := json.Unmarshal(data, &policies); err != nil {
+		return nil, fmt.Errorf("invalid policy file: %w", err)
+	}
+
+	return policies, nil
+}
+
+// isValidFailMode checks if the fail mode is one we know how to apply
+func isValidFailMode(mode string) bool {
+	switch mode {
+	case models.FailModeAllow, models.FailModeDeny, models.FailModeLocal:
+		return true
+	default:
+		return false
+	}
+}
@@ -1,86 +1,242 @@
 package services
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"sync"
+	"log"
 	"time"
 
 	"github.com/Appy29/rate-limiter/config"
 	"github.com/Appy29/rate-limiter/models"
 )
 
-// RedisRateLimiterService manages rate limiting using separate algorithm files
+// ErrRedisUnavailable is returned when no Redis instance can serve a key
+var ErrRedisUnavailable = errors.New("no redis instance available")
+
+// RedisRateLimiterService manages rate limiting on a pluggable Store (Redis by default)
 type RedisRateLimiterService struct {
-	redisManager *RedisManager
+	store        Store
+	backend      string        // name of the selected storage backend
+	redisManager *RedisManager // nil unless the Redis backend is used
+	redisStore   *redisStore   // nil unless the Redis backend is used
 	config       *config.Config
 	metrics      MetricsInterface
-
-	// In-memory fallback - only when Redis is completely unavailable
-	tokenBuckets map[string]*tokenBucket
-	leakyBuckets map[string]*leakyBucket
-	mutex        sync.RWMutex
+	policies     *PolicyStore
+	costs        *CostTable
+	adaptive     *adaptiveLimits // AIMD limits of adaptive keys, cached from the store
+	healthCheck  *RedisHealthMonitor
+
+	// In-memory fallback - only when the backend is unavailable (bounded, evicting)
+	fallback     *memoryStore
+	tokenBuckets *boundedStore[*tokenBucket]
+	leakyBuckets *boundedStore[*leakyBucket]
 }
 
-// NewRedisRateLimiterService creates a new Redis-backed rate limiter
-func NewRedisRateLimiterService(cfg *config.Config) *RedisRateLimiterService {
-	redisManager := NewRedisManager(cfg.Redis.Instances, cfg.Redis.Password, cfg.Redis.DB)
-
-	return &RedisRateLimiterService{
-		redisManager: redisManager,
+// NewRedisRateLimiterService creates a new rate limiter on the configured storage backend.
+// It fails if the backend cannot be opened; it never silently falls back to another one.
+func NewRedisRateLimiterService(cfg *config.Config) (*RedisRateLimiterService, error) {
+	rrs := &RedisRateLimiterService{
 		config:       cfg,
 		metrics:      NewMetricsCollector(),
-		tokenBuckets: make(map[string]*tokenBucket),
-		leakyBuckets: make(map[string]*leakyBucket),
+		policies:     NewPolicyStore(cfg),
+		costs:        NewCostTable(cfg),
+		tokenBuckets: newBoundedStore[*tokenBucket](cfg.Fallback.MaxBuckets, cfg.Fallback.IdleTTL, cfg.Fallback.Shards),
+		leakyBuckets: newBoundedStore[*leakyBucket](cfg.Fallback.MaxBuckets, cfg.Fallback.IdleTTL, cfg.Fallback.Shards),
+	}
+	rrs.fallback = newMemoryStore(rrs.tokenBuckets, rrs.leakyBuckets)
+
+	switch cfg.Storage.Backend {
+	case StorageMemory:
+		// Not the fallback: its idle TTL and LRU would reset long-window buckets and
+		// usage. State is dropped by the sweeper once it no longer limits anything.
+		store := newMemoryStore(
+			newUnboundedStore[*tokenBucket](cfg.Fallback.Shards),
+			newUnboundedStore[*leakyBucket](cfg.Fallback.Shards),
+		)
+		store.startSweeper(cfg.Storage.SnapshotInterval)
+		rrs.backend = StorageMemory
+		rrs.store = store
+	case StorageDisk:
+		store, err := newDiskStore(cfg.Storage.Path, cfg.Storage.SnapshotInterval, cfg.Fallback.Shards)
+		if err != nil {
+			return nil, fmt.Errorf("open disk store at %q: %w", cfg.Storage.Path, err)
+		}
+		rrs.backend = StorageDisk
+		rrs.store = store
+	default:
+		if cfg.Storage.Backend != "" && cfg.Storage.Backend != StorageRedis {
+			log.Printf("Unknown storage backend %q, using %s", cfg.Storage.Backend, StorageRedis)
+		}
+		rrs.backend = StorageRedis
+		rrs.setupRedis()
+		rrs.redisStore = newRedisStore(rrs.redisManager, cfg.Clock.Source)
+		rrs.store = rrs.redisStore
 	}
+	rrs.adaptive = newAdaptiveLimits(rrs.store)
+
+	return rrs, nil
 }
 
-// Acquire attempts to acquire tokens using specified algorithm
-func (rrs *RedisRateLimiterService) Acquire(key string, tokens int64, algorithm string) bool {
-	startTime := time.Now()
+// setupRedis creates the shard manager with its breakers, health monitor and recovery hook
+func (rrs *RedisRateLimiterService) setupRedis() {
+	cfg := rrs.config
+	metrics := rrs.metrics
 
-	var result bool
-	var rateLimited bool
+	rrs.redisManager = NewRedisManager(cfg.Redis.Instances, cfg.Redis.Password, cfg.Redis.DB)
+	rrs.healthCheck = NewRedisHealthMonitor(rrs.redisManager, metrics, cfg)
 
-	fmt.Printf("DEBUG: Acquiring for key='%s', algorithm='%s'\n", key, algorithm)
+	// Preload the Lua scripts so requests only send their SHA
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	if err := rrs.redisManager.LoadScripts(ctx); err != nil {
+		log.Printf("Failed to preload Lua scripts, they will be loaded on first use: %v", err)
+	}
+	cancel()
+
+	// Fail fast on struggling shards instead of waiting for network timeouts
+	rrs.redisManager.EnableCircuitBreakers(CircuitBreakerSettings{
+		ErrorThreshold:   cfg.CircuitBreaker.ErrorThreshold,
+		MinRequests:      cfg.CircuitBreaker.MinRequests,
+		Window:           cfg.CircuitBreaker.Window,
+		Cooldown:         cfg.CircuitBreaker.Cooldown,
+		HalfOpenRequests: cfg.CircuitBreaker.HalfOpenRequests,
+	}, func(name string, from, to BreakerState) {
+		metrics.RecordBreakerTransition(name, from.String(), to.String())
+	})
+
+	// A restarted instance has an empty script cache; reload before traffic returns
+	rrs.redisManager.OnInstanceRecovered(rrs.reloadScripts)
+
+	// Merge fallback state back into a shard once it recovers
+	rrs.redisManager.OnInstanceRecovered(rrs.reconcileFallback)
+
+	// Keep the shard health view fresh in the background
+	rrs.healthCheck.Start()
+}
 
-	// Get Redis client based on key by hasing
-	client := rrs.redisManager.GetClient(key)
-
-	if client == nil {
-		fmt.Printf("DEBUG: Redis unavailable - using in-memory fallback\n")
-		result = rrs.acquireInMemoryFallback(key, tokens, algorithm)
-		rateLimited = !result
-	} else {
-		switch algorithm {
-		case "leaky_bucket":
-			leakyBucketRedis := NewLeakyBucketRedis(client, key, rrs.config.RateLimit.DefaultCapacity, rrs.config.RateLimit.DefaultRefill)
-			result = leakyBucketRedis.TryAdd(tokens)
-		case "token_bucket":
-			fallthrough
-		default:
-			tokenBucketRedis := NewTokenBucketRedis(client, key, rrs.config.RateLimit.DefaultCapacity, rrs.config.RateLimit.DefaultRefill)
-			result = tokenBucketRedis.TryConsume(tokens)
-		}
-		rateLimited = !result
+// reloadScripts registers the Lua scripts on a recovered instance
+func (rrs *RedisRateLimiterService) reloadScripts(index int) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	if err := rrs.redisManager.loadInstanceScripts(ctx, index); err != nil {
+		log.Printf("Failed to reload Lua scripts: %v", err)
 	}
+}
 
-	rrs.metrics.RecordRequest(result, rateLimited, time.Since(startTime))
-	return result
+// Close stops background work and closes the storage backend
+func (rrs *RedisRateLimiterService) Close() error {
+	if rrs.healthCheck != nil {
+		rrs.healthCheck.Stop()
+	}
+	return rrs.store.Close()
+}
+
+// Acquire attempts to acquire tokens using specified algorithm.
+// A non-nil error means the backend could not decide; the caller applies the policy fail mode.
+func (rrs *RedisRateLimiterService) Acquire(key string, tokens int64, algorithm string, priority string) (bool, error) {
+	startTime := time.Now()
+
+	fmt.Printf("DEBUG: Acquiring for key='%s', algorithm='%s'\n", key, algorithm)
+
+	policy := rrs.ResolvePolicy(key)
+	policy.Priority = priority
+	result, err := withPenalty(rrs.store, key, policy, func() (bool, error) {
+		return rrs.decide(rrs.store, key, policy, tokens, algorithm)
+	})
+
+	// Backend errors are recorded as errors, not as rate limits
+	rrs.metrics.RecordRequest(result, !result && err == nil, time.Since(startTime))
+	return result, err
 }
 
-// acquireInMemoryFallback - only used when Redis is completely unavailable
-func (rrs *RedisRateLimiterService) acquireInMemoryFallback(key string, tokens int64, algorithm string) bool {
+// AcquireLocal evaluates the request against the in-memory fallback buckets.
+// Used by callers applying the "local" fail mode when Acquire returns an error.
+func (rrs *RedisRateLimiterService) AcquireLocal(key string, tokens int64, algorithm string, priority string) bool {
 	fmt.Printf("DEBUG: Using in-memory fallback for %s\n", algorithm)
-	switch algorithm {
-	case "leaky_bucket":
-		bucket := rrs.getOrCreateLeakyBucket(key)
-		return bucket.TryAdd(tokens)
-	case "token_bucket":
-		fallthrough
-	default:
-		bucket := rrs.getOrCreateTokenBucket(key)
-		return bucket.TryConsume(tokens)
+
+	policy := rrs.ResolvePolicy(key)
+	policy.Priority = priority
+	result, _ := withPenalty(rrs.fallback, key, policy, func() (bool, error) {
+		return rrs.decide(rrs.fallback, key, policy, tokens, algorithm)
+	})
+	return result
+}
+
+// Schedule admits requests into the key's leaky bucket drip schedule (shaping mode)
+// and returns when the first of them may start, on this process's clock. Requests
+// that would wait longer than the policy's max wait are rejected, returning when a
+// retry could fit (zero time for other rejections).
+// keys is the key's quota chain, innermost first; the enclosing quotas are consumed
+// when the requests are scheduled.
+// A non-nil error means the backend could not decide; the caller applies the policy fail mode.
+func (rrs *RedisRateLimiterService) Schedule(keys []string, requests int64, priority string) (time.Time, bool, error) {
+	startTime := time.Now()
+
+	startAt, allowed, err := rrs.schedule(rrs.store, keys, requests, priority)
+
+	rrs.metrics.RecordRequest(allowed, !allowed && err == nil, time.Since(startTime))
+	return startAt, allowed, err
+}
+
+// ScheduleLocal schedules against the in-memory fallback buckets
+func (rrs *RedisRateLimiterService) ScheduleLocal(keys []string, requests int64, priority string) (time.Time, bool) {
+	startAt, allowed, _ := rrs.schedule(rrs.fallback, keys, requests, priority)
+	return startAt, allowed
+}
+
+// schedule runs Schedule against a store
+func (rrs *RedisRateLimiterService) schedule(store Store, keys []string, requests int64, priority string) (time.Time, bool, error) {
+	levels := withPriority(rrs.quotaLevels(keys), priority)
+	key, policy := levels[0].Key, levels[0].Policy
+
+	// The store reports a delay, so a Redis server clock never meets the local one
+	var delay time.Duration
+	allowed, err := withPenalty(store, key, policy, func() (bool, error) {
+		return withQuotas(store, levels, requests, func() (allowed bool, err error) {
+			delay, allowed, err = store.ScheduleRequests(key, policy, requests)
+			return allowed, err
+		})
+	})
+	return scheduledAt(policy, delay, allowed), allowed, err
+}
+
+// scheduledAt turns a store's schedule delay into a local time: the start of an
+// admitted request, or when a request rejected for waiting too long could retry
+func scheduledAt(policy models.RateLimitConfig, delay time.Duration, allowed bool) time.Time {
+	if allowed {
+		return time.Now().Add(delay)
 	}
+	if delay > policy.ScheduleMaxWait() {
+		return time.Now().Add(delay - policy.ScheduleMaxWait())
+	}
+	return time.Time{}
+}
+
+// ResolvePolicy returns the policy that applies to the key, scaled to its adaptive limit
+func (rrs *RedisRateLimiterService) ResolvePolicy(key string) models.RateLimitConfig {
+	return rrs.adaptive.apply(rrs.policies.Resolve(key))
+}
+
+// ResolveCost returns the tokens a request is charged according to the cost table
+func (rrs *RedisRateLimiterService) ResolveCost(req models.AcquireRequest) (int64, error) {
+	return rrs.costs.Cost(req.Operation, req.RequestedTokens())
+}
+
+// Feedback applies a health report from the protected service to the key's adaptive limit
+func (rrs *RedisRateLimiterService) Feedback(report models.FeedbackRequest) (models.FeedbackResponse, error) {
+	policy := rrs.policies.Resolve(report.Key)
+	if policy.Adaptive == nil {
+		return models.FeedbackResponse{}, ErrNotAdaptive
+	}
+
+	healthy, limit, err := rrs.adaptive.feedback(policy, report)
+	if err != nil {
+		return models.FeedbackResponse{}, err
+	}
+	log.Printf("Adaptive limit for %s is now %d (healthy: %v)", report.Key, limit, healthy)
+
+	return models.FeedbackResponse{Key: report.Key, Healthy: healthy, Limit: limit}, nil
 }
 
 // GetStatus returns comprehensive status for all algorithms
@@ -91,32 +247,23 @@ func (rrs *RedisRateLimiterService) GetStatus(key string) models.StatusResponse
 	tokenBucketStatus := rrs.getTokenBucketStatus(key)
 	leakyBucketStatus := rrs.getLeakyBucketStatus(key)
 
-	// Determine primary algorithm based on which has been used
+	// The primary algorithm is the one the key's policy pins
+	policy := rrs.ResolvePolicy(key)
+	primaryAlgorithm := policy.PolicyAlgorithm()
+
+	var fairShare *models.FairShareStatus
+	var shareStatus models.AlgorithmStatus
+	if policy.Pool != "" || primaryAlgorithm == fairShareAlgorithm {
+		fairShare, shareStatus = rrs.getFairShareStatus(key, policy)
+	}
+
 	var primaryStatus models.AlgorithmStatus
-	var primaryAlgorithm string
-
-	if tokenBucketStatus.HasState && leakyBucketStatus.HasState {
-		// Both exist - choose the one with activity (not at full capacity)
-		if tokenBucketStatus.TokensLeft < tokenBucketStatus.Capacity {
-			primaryAlgorithm = "token_bucket"
-			primaryStatus = tokenBucketStatus
-		} else if leakyBucketStatus.TokensLeft < leakyBucketStatus.Capacity {
-			primaryAlgorithm = "leaky_bucket"
-			primaryStatus = leakyBucketStatus
-		} else {
-			// Both at full capacity, default to token bucket
-			primaryAlgorithm = "token_bucket"
-			primaryStatus = tokenBucketStatus
-		}
-	} else if tokenBucketStatus.HasState {
-		primaryAlgorithm = "token_bucket"
-		primaryStatus = tokenBucketStatus
-	} else if leakyBucketStatus.HasState {
-		primaryAlgorithm = "leaky_bucket"
+	switch primaryAlgorithm {
+	case "leaky_bucket":
 		primaryStatus = leakyBucketStatus
-	} else {
-		// No state found, return default token bucket
-		primaryAlgorithm = "token_bucket"
+	case fairShareAlgorithm:
+		primaryStatus = shareStatus
+	default:
 		primaryStatus = tokenBucketStatus
 	}
 
@@ -131,6 +278,7 @@ func (rrs *RedisRateLimiterService) GetStatus(key string) models.StatusResponse
 		RefillRate:     primaryStatus.RefillRate,
 		NextRefillTime: primaryStatus.NextRefillTime,
 		IsBlocked:      primaryStatus.IsBlocked,
+		ExpiresAt:      primaryStatus.ExpiresAt,
 	}
 
 	// Add detailed status for algorithms that have state
@@ -140,199 +288,72 @@ func (rrs *RedisRateLimiterService) GetStatus(key string) models.StatusResponse
 	if leakyBucketStatus.HasState {
 		response.LeakyBucketStatus = &leakyBucketStatus
 	}
+	response.FairShare = fairShare
+	response.Penalty = rrs.Penalty(key)
 
 	return response
 }
 
-// getTokenBucketStatus gets status using token_bucket.go
+// getTokenBucketStatus gets token bucket status from the store (fallback if it errors)
 func (rrs *RedisRateLimiterService) getTokenBucketStatus(key string) models.AlgorithmStatus {
-	client := rrs.redisManager.GetClient(key)
+	policy := rrs.ResolvePolicy(key)
 
-	if client == nil {
-		// Redis unavailable - check in-memory fallback
-		return rrs.getInMemoryTokenBucketStatus(key)
+	status, err := rrs.store.TokenBucketStatus(key, policy)
+	if err != nil {
+		// Backend unavailable - check in-memory fallback
+		status, _ = rrs.fallback.TokenBucketStatus(key, policy)
 	}
 
-	// Use the TokenBucketRedis from token_bucket.go
-	tokenBucketRedis := NewTokenBucketRedis(client, key, rrs.config.RateLimit.DefaultCapacity, rrs.config.RateLimit.DefaultRefill)
-
-	if !tokenBucketRedis.HasState() {
-		// No state in Redis
-		return models.AlgorithmStatus{
-			Algorithm:      "token_bucket",
-			TokensLeft:     rrs.config.RateLimit.DefaultCapacity,
-			Capacity:       rrs.config.RateLimit.DefaultCapacity,
-			RefillRate:     rrs.config.RateLimit.DefaultRefill,
-			NextRefillTime: time.Now().Add(rrs.config.RateLimit.DefaultRefill),
-			IsBlocked:      false,
-			HasState:       false,
-		}
-	}
-
-	// Get status from Redis via token_bucket.go
-	tokensLeft, capacity, nextRefill := tokenBucketRedis.GetStatus()
-
 	return models.AlgorithmStatus{
 		Algorithm:      "token_bucket",
-		TokensLeft:     tokensLeft,
-		Capacity:       capacity,
-		RefillRate:     rrs.config.RateLimit.DefaultRefill,
-		NextRefillTime: nextRefill,
-		IsBlocked:      tokensLeft == 0,
-		HasState:       true,
+		TokensLeft:     status.Level,
+		Capacity:       status.Capacity,
+		RefillRate:     policy.RefillRate,
+		NextRefillTime: status.Next,
+		IsBlocked:      status.HasState && status.Level <= 0, // negative while repaying debt
+		HasState:       status.HasState,
+		ExpiresAt:      expiresAt(status),
 	}
 }
 
-// getLeakyBucketStatus gets status using leaky_bucket.go
+// getLeakyBucketStatus gets leaky bucket status from the store (fallback if it errors)
 func (rrs *RedisRateLimiterService) getLeakyBucketStatus(key string) models.AlgorithmStatus {
-	client := rrs.redisManager.GetClient(key)
-
-	if client == nil {
-		// Redis unavailable - check in-memory fallback
-		return rrs.getInMemoryLeakyBucketStatus(key)
-	}
+	policy := rrs.ResolvePolicy(key)
 
-	// Use the LeakyBucketRedis from leaky_bucket.go
-	leakyBucketRedis := NewLeakyBucketRedis(client, key, rrs.config.RateLimit.DefaultCapacity, rrs.config.RateLimit.DefaultRefill)
-
-	if !leakyBucketRedis.HasState() {
-		// No state in Redis
-		return models.AlgorithmStatus{
-			Algorithm:      "leaky_bucket",
-			TokensLeft:     rrs.config.RateLimit.DefaultCapacity,
-			Capacity:       rrs.config.RateLimit.DefaultCapacity,
-			RefillRate:     rrs.config.RateLimit.DefaultRefill,
-			NextRefillTime: time.Now().Add(rrs.config.RateLimit.DefaultRefill),
-			IsBlocked:      false,
-			HasState:       false,
-		}
+	status, err := rrs.store.LeakyBucketStatus(key, policy)
+	if err != nil {
+		// Backend unavailable - check in-memory fallback
+		status, _ = rrs.fallback.LeakyBucketStatus(key, policy)
 	}
 
-	// Get status from Redis via leaky_bucket.go
-	queueLength, capacity, nextLeak := leakyBucketRedis.GetStatus()
-	availableSpace := capacity - queueLength
-
 	return models.AlgorithmStatus{
 		Algorithm:      "leaky_bucket",
-		TokensLeft:     availableSpace,
-		Capacity:       capacity,
-		RefillRate:     rrs.config.RateLimit.DefaultRefill,
-		NextRefillTime: nextLeak,
-		IsBlocked:      queueLength >= capacity,
-		HasState:       true,
-	}
-}
-
-// ===== IN-MEMORY FALLBACK METHODS (only when Redis is unavailable) =====
-
-func (rrs *RedisRateLimiterService) getInMemoryTokenBucketStatus(key string) models.AlgorithmStatus {
-	rrs.mutex.RLock()
-	bucket, exists := rrs.tokenBuckets[key]
-	rrs.mutex.RUnlock()
-
-	if exists {
-		tokensLeft, capacity, nextRefill := bucket.GetStatus()
-		return models.AlgorithmStatus{
-			Algorithm:      "token_bucket",
-			TokensLeft:     tokensLeft,
-			Capacity:       capacity,
-			RefillRate:     rrs.config.RateLimit.DefaultRefill,
-			NextRefillTime: nextRefill,
-			IsBlocked:      tokensLeft == 0,
-			HasState:       true,
-		}
-	}
-
-	return models.AlgorithmStatus{
-		Algorithm:      "token_bucket",
-		TokensLeft:     rrs.config.RateLimit.DefaultCapacity,
-		Capacity:       rrs.config.RateLimit.DefaultCapacity,
-		RefillRate:     rrs.config.RateLimit.DefaultRefill,
-		NextRefillTime: time.Now().Add(rrs.config.RateLimit.DefaultRefill),
-		IsBlocked:      false,
-		HasState:       false,
-	}
-}
-
-func (rrs *RedisRateLimiterService) getInMemoryLeakyBucketStatus(key string) models.AlgorithmStatus {
-	rrs.mutex.RLock()
-	bucket, exists := rrs.leakyBuckets[key]
-	rrs.mutex.RUnlock()
-
-	if exists {
-		queueLength, capacity, nextLeak := bucket.GetStatus()
-		return models.AlgorithmStatus{
-			Algorithm:      "leaky_bucket",
-			TokensLeft:     capacity - queueLength,
-			Capacity:       capacity,
-			RefillRate:     rrs.config.RateLimit.DefaultRefill,
-			NextRefillTime: nextLeak,
-			IsBlocked:      queueLength >= capacity,
-			HasState:       true,
-		}
-	}
-
-	return models.AlgorithmStatus{
-		Algorithm:      "leaky_bucket",
-		TokensLeft:     rrs.config.RateLimit.DefaultCapacity,
-		Capacity:       rrs.config.RateLimit.DefaultCapacity,
-		RefillRate:     rrs.config.RateLimit.DefaultRefill,
-		NextRefillTime: time.Now().Add(rrs.config.RateLimit.DefaultRefill),
-		IsBlocked:      false,
-		HasState:       false,
-	}
-}
-
-// Bucket creation methods (fallback only when Redis is unavailable)
-func (rrs *RedisRateLimiterService) getOrCreateTokenBucket(key string) *tokenBucket {
-	rrs.mutex.RLock()
-	if bucket, exists := rrs.tokenBuckets[key]; exists {
-		rrs.mutex.RUnlock()
-		return bucket
+		TokensLeft:     status.Capacity - status.Level,
+		Capacity:       status.Capacity,
+		RefillRate:     policy.RefillRate,
+		NextRefillTime: status.Next,
+		IsBlocked:      status.Level >= status.Capacity,
+		HasState:       status.HasState,
+		ExpiresAt:      expiresAt(status),
 	}
-	rrs.mutex.RUnlock()
-
-	rrs.mutex.Lock()
-	defer rrs.mutex.Unlock()
-
-	if bucket, exists := rrs.tokenBuckets[key]; exists {
-		return bucket
-	}
-
-	bucket := NewTokenBucket(
-		rrs.config.RateLimit.DefaultCapacity,
-		rrs.config.RateLimit.DefaultRefill,
-	)
-	rrs.tokenBuckets[key] = bucket
-	return bucket
 }
 
-func (rrs *RedisRateLimiterService) getOrCreateLeakyBucket(key string) *leakyBucket {
-	rrs.mutex.RLock()
-	if bucket, exists := rrs.leakyBuckets[key]; exists {
-		rrs.mutex.RUnlock()
-		return bucket
+// expiresAt returns the state expiry for the API, or nil when the state does not expire
+func expiresAt(status BucketStatus) *time.Time {
+	if status.ExpiresAt.IsZero() {
+		return nil
 	}
-	rrs.mutex.RUnlock()
-
-	rrs.mutex.Lock()
-	defer rrs.mutex.Unlock()
-
-	if bucket, exists := rrs.leakyBuckets[key]; exists {
-		return bucket
-	}
-
-	bucket := NewLeakyBucket(
-		rrs.config.RateLimit.DefaultCapacity,
-		rrs.config.RateLimit.DefaultRefill,
-	)
-	rrs.leakyBuckets[key] = bucket
-	return bucket
+	return &status.ExpiresAt
 }
 
 // GetMetrics returns basic metrics about the rate limiter
 func (rrs *RedisRateLimiterService) GetMetrics() map[string]interface{} {
-	healthStatus := rrs.redisManager.GetHealthStatus()
+	healthStatus := map[string]bool{}
+	redisInstances := 0
+	if rrs.redisManager != nil {
+		healthStatus = rrs.redisManager.GetHealthView()
+		redisInstances = rrs.redisManager.InstanceCount()
+	}
 	healthyCount := 0
 	for _, healthy := range healthStatus {
 		if healthy {
@@ -340,10 +361,10 @@ func (rrs *RedisRateLimiterService) GetMetrics() map[string]interface{} {
 		}
 	}
 
-	rrs.mutex.RLock()
-	tokenBucketCount := len(rrs.tokenBuckets)
-	leakyBucketCount := len(rrs.leakyBuckets)
-	rrs.mutex.RUnlock()
+	tokenBucketCount := rrs.tokenBuckets.Len()
+	leakyBucketCount := rrs.leakyBuckets.Len()
+	tokenCapacityEvictions, tokenIdleEvictions := rrs.tokenBuckets.Evictions()
+	leakyCapacityEvictions, leakyIdleEvictions := rrs.leakyBuckets.Evictions()
 
 	// Get metrics from our metrics collector
 	metricsData := rrs.metrics.GetMetrics()
@@ -356,22 +377,79 @@ func (rrs *RedisRateLimiterService) GetMetrics() map[string]interface{} {
 
 	// Add rate limiter specific info
 	result["rate_limiter"] = map[string]interface{}{
-		"using_redis":            true,
-		"redis_instances":        len(rrs.redisManager.clients),
+		"using_redis":            rrs.redisManager != nil,
+		"storage_backend":        rrs.backend,
+		"redis_instances":        redisInstances,
 		"healthy_instances":      healthyCount,
-		"using_fallback":         healthyCount == 0,
-		"algorithm":              "unified_redis", // Both algorithms use Redis
+		"using_fallback":         rrs.redisManager != nil && healthyCount == 0,
+		"algorithm":              "unified_" + rrs.backend, // Both algorithms use the same backend
 		"default_capacity":       rrs.config.RateLimit.DefaultCapacity,
 		"default_refill_rate":    rrs.config.RateLimit.DefaultRefill.String(),
 		"redis_health":           healthStatus,
 		"fallback_token_buckets": tokenBucketCount,
 		"fallback_leaky_buckets": leakyBucketCount,
+		"fallback_max_buckets":   rrs.config.Fallback.MaxBuckets,
+		"fallback_evictions": map[string]interface{}{
+			"token_bucket": map[string]int64{"capacity": tokenCapacityEvictions, "idle": tokenIdleEvictions},
+			"leaky_bucket": map[string]int64{"capacity": leakyCapacityEvictions, "idle": leakyIdleEvictions},
+		},
 	}
 
 	return result
 }
 
+// GetHealth returns the health view and breaker state of every Redis instance
+func (rrs *RedisRateLimiterService) GetHealth() models.HealthResponse {
+	response := models.HealthResponse{
+		Status: "ok",
+		Redis:  make(map[string]models.InstanceHealth),
+	}
+
+	if rrs.redisManager == nil {
+		return response
+	}
+
+	for i := 0; i < rrs.redisManager.InstanceCount(); i++ {
+		instance := models.InstanceHealth{
+			Healthy: rrs.redisManager.IsInstanceHealthy(i),
+			Breaker: rrs.redisManager.BreakerState(i).String(),
+		}
+		if !instance.Healthy || instance.Breaker != BreakerClosed.String() {
+			response.Status = "degraded"
+		}
+		response.Redis[rrs.redisManager.InstanceName(i)] = instance
+	}
+
+	return response
+}
+
 // GetPrometheusMetrics returns metrics in Prometheus format
 func (rrs *RedisRateLimiterService) GetPrometheusMetrics() string {
-	return rrs.metrics.GetPrometheusMetrics()
+	return rrs.metrics.GetPrometheusMetrics() + rrs.fallbackPrometheusMetrics()
+}
+
+// fallbackPrometheusMetrics renders the size and eviction counters of the fallback stores
+func (rrs *RedisRateLimiterService) fallbackPrometheusMetrics() string {
+	tokenCapacityEvictions, tokenIdleEvictions := rrs.tokenBuckets.Evictions()
+	leakyCapacityEvictions, leakyIdleEvictions := rrs.leakyBuckets.Evictions()
+
+	prometheus := `
+# HELP rate_limiter_fallback_buckets In-memory fallback buckets currently held
+# TYPE rate_limiter_fallback_buckets gauge
+rate_limiter_fallback_buckets{algorithm="token_bucket"} %d
+rate_limiter_fallback_buckets{algorithm="leaky_bucket"} %d
+
+# HELP rate_limiter_fallback_evictions_total In-memory fallback buckets evicted
+# TYPE rate_limiter_fallback_evictions_total counter
+rate_limiter_fallback_evictions_total{algorithm="token_bucket",reason="capacity"} %d
+rate_limiter_fallback_evictions_total{algorithm="token_bucket",reason="idle"} %d
+rate_limiter_fallback_evictions_total{algorithm="leaky_bucket",reason="capacity"} %d
+rate_limiter_fallback_evictions_total{algorithm="leaky_bucket",reason="idle"} %d
+`
+
+	return fmt.Sprintf(prometheus,
+		rrs.tokenBuckets.Len(), rrs.leakyBuckets.Len(),
+		tokenCapacityEvictions, tokenIdleEvictions,
+		leakyCapacityEvictions, leakyIdleEvictions,
+	)
 }
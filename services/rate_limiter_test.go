@@ -1,11 +1,16 @@
 package services
 
 import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/Appy29/rate-limiter/config"
+	"github.com/Appy29/rate-limiter/models"
 )
 
 // mockMetrics for testing
@@ -17,6 +22,8 @@ type mockMetrics struct {
 	redisLatency time.Duration
 	redisHealth  map[string]bool
 	mu           sync.Mutex
+
+	breakerTransitions []string
 }
 
 func (m *mockMetrics) RecordRequest(allowed, rateLimited bool, duration time.Duration) {
@@ -51,6 +58,28 @@ func (m *mockMetrics) UpdateRedisHealth(healthy bool) {
 	m.redisHealth["overall"] = healthy
 }
 
+func (m *mockMetrics) RecordInstanceLatency(instance string, latency time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.redisLatency = latency
+}
+
+func (m *mockMetrics) UpdateInstanceHealth(instance string, healthy bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.redisHealth == nil {
+		m.redisHealth = make(map[string]bool)
+	}
+	m.redisHealth[instance] = healthy
+}
+
+func (m *mockMetrics) RecordBreakerTransition(instance string, from string, to string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.breakerTransitions = append(m.breakerTransitions, instance+":"+from+"->"+to)
+}
+
 func (m *mockMetrics) GetMetrics() map[string]interface{} {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -88,8 +117,8 @@ var (
 func createTestServiceWithMocks(redisAvailable bool) *RedisRateLimiterService {
 	cfg := createTestConfig()
 
-	// Create service normally
-	service := NewRedisRateLimiterService(cfg)
+	// Create service normally (the Redis backend connects lazily and cannot fail here)
+	service, _ := NewRedisRateLimiterService(cfg)
 
 	// Replace metrics with mock
 	service.metrics = &mockMetrics{}
@@ -102,7 +131,7 @@ func createTestServiceWithMocks(redisAvailable bool) *RedisRateLimiterService {
 		invalidCfg.Redis.Instances = []string{"invalid:9999"} // Non-existent Redis
 
 		// Create new service with invalid config
-		serviceWithFailingRedis := NewRedisRateLimiterService(invalidCfg)
+		serviceWithFailingRedis, _ := NewRedisRateLimiterService(invalidCfg)
 		serviceWithFailingRedis.metrics = &mockMetrics{}
 		return serviceWithFailingRedis
 	}
@@ -138,7 +167,10 @@ func createTestConfig() *config.Config {
 
 func TestNewRedisRateLimiterService(t *testing.T) {
 	cfg := createTestConfig()
-	service := NewRedisRateLimiterService(cfg)
+	service, err := NewRedisRateLimiterService(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
 
 	if service == nil {
 		t.Fatal("Expected service to be initialized, got nil")
@@ -161,6 +193,23 @@ func TestNewRedisRateLimiterService(t *testing.T) {
 	}
 }
 
+func TestNewRedisRateLimiterService_DiskStoreFailsToOpen(t *testing.T) {
+	// A file where the data directory should be
+	path := filepath.Join(t.TempDir(), "not_a_dir")
+	if err := os.WriteFile(path, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := createTestConfig()
+	cfg.Storage.Backend = StorageDisk
+	cfg.Storage.Path = path
+
+	if service, err := NewRedisRateLimiterService(cfg); err == nil {
+		service.Close()
+		t.Fatal("Expected an error instead of falling back to the memory store")
+	}
+}
+
 func TestGetStatus_RedisAvailable(t *testing.T) {
 	service := createTestServiceWithMocks(true) // Redis available
 
@@ -191,12 +240,12 @@ func TestGetMetrics(t *testing.T) {
 	service := createTestServiceWithMocks(true)
 
 	// Create some state by making requests
-	service.Acquire("user1", 5, "token_bucket")
-	service.Acquire("user2", 3, "leaky_bucket")
+	service.Acquire("user1", 5, "token_bucket", "")
+	service.Acquire("user2", 3, "leaky_bucket", "")
 
 	// Force some fallback state when Redis is unavailable
 	fallbackService := createTestServiceWithMocks(false)
-	fallbackService.Acquire("fallback_user", 1, "token_bucket")
+	fallbackService.Acquire("fallback_user", 1, "token_bucket", "")
 
 	metrics := service.GetMetrics()
 
@@ -233,3 +282,133 @@ func TestGetMetrics(t *testing.T) {
 		t.Errorf("Expected default_capacity 100, got %v", rlm["default_capacity"])
 	}
 }
+
+func TestMetricsCollector_BreakerTransitionsAreCopied(t *testing.T) {
+	collector := NewMetricsCollector()
+	collector.RecordBreakerTransition("redis-0", "closed", "open")
+
+	metrics := collector.GetMetrics()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			collector.RecordBreakerTransition("redis-0", "open", "half_open")
+		}
+	}()
+
+	// Encoding the snapshot while the breaker keeps recording must not race (run with -race)
+	for i := 0; i < 100; i++ {
+		if _, err := json.Marshal(metrics); err != nil {
+			t.Fatalf("Failed to encode metrics: %v", err)
+		}
+	}
+	wg.Wait()
+
+	instance := metrics["redis"].(map[string]interface{})["instances"].(map[string]interface{})["redis-0"]
+	if got := instance.(map[string]interface{})["breaker_transitions"].(map[string]int64)["half_open"]; got != 0 {
+		t.Errorf("Expected the snapshot not to see later transitions, got %d", got)
+	}
+}
+
+func TestAcquire_MemoryBackend(t *testing.T) {
+	cfg := createTestConfig()
+	cfg.Storage.Backend = StorageMemory
+	cfg.RateLimit.DefaultCapacity = 5
+
+	service, err := NewRedisRateLimiterService(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	defer service.Close()
+
+	if service.redisManager != nil {
+		t.Error("Expected no Redis manager for the memory backend")
+	}
+
+	for _, algorithm := range []string{"token_bucket", "leaky_bucket"} {
+		allowed, err := service.Acquire("memory_user", 5, algorithm, "")
+		if err != nil || !allowed {
+			t.Errorf("%s: expected first acquire to succeed, got allowed=%v err=%v", algorithm, allowed, err)
+		}
+
+		allowed, err = service.Acquire("memory_user", 1, algorithm, "")
+		if err != nil || allowed {
+			t.Errorf("%s: expected acquire beyond capacity to be limited, got allowed=%v err=%v", algorithm, allowed, err)
+		}
+	}
+
+	status := service.GetStatus("memory_user")
+	if !status.HasTokenBucketState() || !status.HasLeakyBucketState() {
+		t.Error("Expected status to report state for both algorithms")
+	}
+	if status.TokenBucketStatus.TokensLeft != 0 {
+		t.Errorf("Expected 0 tokens left, got %d", status.TokenBucketStatus.TokensLeft)
+	}
+}
+
+func TestAcquire_MemoryBackendIgnoresFallbackLimits(t *testing.T) {
+	cfg := createTestConfig()
+	cfg.Storage.Backend = StorageMemory
+	cfg.RateLimit.DefaultCapacity = 5
+	cfg.Fallback.MaxBuckets = 16
+	cfg.Fallback.Shards = 16
+	cfg.Fallback.IdleTTL = time.Nanosecond
+
+	service, err := NewRedisRateLimiterService(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	defer service.Close()
+	service.policies.Set(models.RateLimitConfig{Key: "quick_user", Capacity: 1, RefillRate: time.Millisecond})
+
+	// Far more keys than the fallback holds, each idle for longer than its TTL
+	for i := 0; i < 100; i++ {
+		service.Acquire(fmt.Sprintf("user_%d", i), 5, "token_bucket", "")
+	}
+	service.Acquire("quick_user", 1, "token_bucket", "")
+	time.Sleep(20 * time.Millisecond)
+
+	for i := 0; i < 100; i++ {
+		if allowed, _ := service.Acquire(fmt.Sprintf("user_%d", i), 1, "token_bucket", ""); allowed {
+			t.Fatalf("user_%d: expected the drained bucket to be kept, got a fresh one", i)
+		}
+	}
+
+	store := service.store.(*memoryStore)
+	store.sweep(time.Now())
+	if _, exists := store.tokenBuckets.Get(tokenBucketKey("quick_user")); exists {
+		t.Error("Expected the sweep to drop the refilled bucket")
+	}
+	if _, exists := store.tokenBuckets.Get(tokenBucketKey("user_0")); !exists {
+		t.Error("Expected the sweep to keep the drained bucket")
+	}
+}
+
+func TestGetStatus_PolicyAlgorithm(t *testing.T) {
+	cfg := createTestConfig()
+	cfg.Storage.Backend = StorageMemory
+
+	service, err := NewRedisRateLimiterService(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	defer service.Close()
+	service.policies.Set(models.RateLimitConfig{Key: "leaky_user", Algorithm: "leaky_bucket", Capacity: 5})
+
+	// The token bucket is drained, but the policy's leaky bucket is what limits the key
+	service.Acquire("leaky_user", 5, "token_bucket", "")
+	service.Acquire("leaky_user", 1, "leaky_bucket", "")
+
+	status := service.GetStatus("leaky_user")
+	if status.Algorithm != "leaky_bucket" {
+		t.Fatalf("Expected the policy's algorithm leaky_bucket, got %s", status.Algorithm)
+	}
+	if status.TokensLeft != 4 {
+		t.Errorf("Expected 4 slots left in the leaky bucket, got %d", status.TokensLeft)
+	}
+	if !status.HasTokenBucketState() {
+		t.Error("Expected the token bucket state to still be reported")
+	}
+}
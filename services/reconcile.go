@@ -0,0 +1,112 @@
+package services
+
+import (
+	"log"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// reconcileFallback merges the in-memory fallback buckets owned by a recovered
+// Redis instance back into Redis, then evicts them from memory.
+// Keys are owned by the instance their home key hashes to; they are never rerouted while it is down.
+// Quota hierarchy levels and fair share pools and shares are merged like plain buckets.
+func (rrs *RedisRateLimiterService) reconcileFallback(index int) {
+	client := rrs.redisManager.getInstanceClient(index)
+	name := rrs.redisManager.InstanceName(index)
+	ownedBy := func(key string) bool {
+		return rrs.redisManager.GetClientIndex(homeKey(key, rrs.ResolvePolicy(key))) == index
+	}
+	ownsBucket := func(bucketKey string) bool {
+		return rrs.redisManager.GetClientIndex(rrs.fallbackHomeKey(bucketKey)) == index
+	}
+
+	merged, failed := 0, 0
+
+	for _, key := range rrs.tokenBuckets.Keys(ownsBucket) {
+		bucket, exists := rrs.tokenBuckets.Get(key)
+		if !exists {
+			continue
+		}
+
+		tokens, lastRefill := bucket.snapshot()
+
+		tokenBucketRedis := rrs.redisTokenBucket(client, key, bucket)
+		if _, err := tokenBucketRedis.MergeLocal(tokens, lastRefill); err != nil {
+			log.Printf("Reconcile %s: keeping local token bucket for %s: %v", name, key, err)
+			failed++
+			continue
+		}
+
+		rrs.tokenBuckets.Delete(key)
+		merged++
+	}
+
+	for _, key := range rrs.leakyBuckets.Keys(ownedBy) {
+		bucket, exists := rrs.leakyBuckets.Get(key)
+		if !exists {
+			continue
+		}
+
+		policy := rrs.ResolvePolicy(key)
+		queueLength, lastLeak := bucket.snapshot()
+
+		leakyBucketRedis := rrs.redisStore.leakyBucket(client, key, policy)
+		if _, err := leakyBucketRedis.MergeLocal(queueLength, lastLeak); err != nil {
+			log.Printf("Reconcile %s: keeping local leaky bucket for %s: %v", name, key, err)
+			failed++
+			continue
+		}
+
+		rrs.leakyBuckets.Delete(key)
+		merged++
+	}
+
+	for _, key := range rrs.fallback.usageKeys(ownedBy) {
+		counters := rrs.fallback.takeUsage(key)
+		if err := rrs.redisStore.mergeUsage(client, key, counters); err != nil {
+			log.Printf("Reconcile %s: keeping local usage for %s: %v", name, key, err)
+			rrs.fallback.returnUsage(key, counters)
+			failed++
+			continue
+		}
+		merged++
+	}
+
+	if merged > 0 || failed > 0 {
+		log.Printf("Reconciled fallback state into %s: %d merged, %d failed", name, merged, failed)
+	}
+}
+
+// fallbackHomeKey is the key whose shard owns a fallback token bucket: the level of a
+// hierarchy bucket, the pool of a fair share bucket, otherwise the key's home key
+func (rrs *RedisRateLimiterService) fallbackHomeKey(bucketKey string) string {
+	switch {
+	case strings.HasPrefix(bucketKey, quotaKeyPrefix):
+		level := strings.TrimPrefix(bucketKey, quotaKeyPrefix)
+		return homeKey(level, rrs.ResolvePolicy(level))
+	case strings.HasPrefix(bucketKey, fairShareKeyPrefix):
+		return fairSharePoolOf(bucketKey)
+	default:
+		key := strings.TrimPrefix(bucketKey, tokenBucketKeyPrefix)
+		return homeKey(key, rrs.ResolvePolicy(key))
+	}
+}
+
+// redisTokenBucket builds the Redis bucket a fallback token bucket merges into
+func (rrs *RedisRateLimiterService) redisTokenBucket(client *redis.Client, key string, local *tokenBucket) *TokenBucketRedis {
+	switch {
+	case strings.HasPrefix(key, quotaKeyPrefix):
+		level := strings.TrimPrefix(key, quotaKeyPrefix)
+		return rrs.redisStore.quotaBucket(client, QuotaLevel{Key: level, Policy: rrs.ResolvePolicy(level)})
+	case strings.HasPrefix(key, fairShareKeyPrefix):
+		// Shares are resized as tenants come and go, so merge at the local bucket's size
+		bucket := rrs.redisStore.tokenBucket(client, key, rrs.ResolvePolicy(fairSharePoolOf(key)))
+		bucket.key = "rate_limit:" + key
+		bucket.capacity, bucket.refillRate = local.limits()
+		return bucket
+	default:
+		key = strings.TrimPrefix(key, tokenBucketKeyPrefix)
+		return rrs.redisStore.tokenBucket(client, key, rrs.ResolvePolicy(key))
+	}
+}
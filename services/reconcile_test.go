@@ -0,0 +1,94 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestRedisManager_NotifiesOnRecovery(t *testing.T) {
+	manager := NewRedisManager([]string{"localhost:6379"}, "", 0)
+
+	recovered := make(chan int, 1)
+	manager.OnInstanceRecovered(func(index int) {
+		recovered <- index
+	})
+
+	// Staying healthy is not a recovery
+	manager.SetInstanceHealthy(0, true)
+	select {
+	case <-recovered:
+		t.Fatal("Expected no recovery callback without a prior outage")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	manager.SetInstanceHealthy(0, false)
+	manager.SetInstanceHealthy(0, true)
+	select {
+	case index := <-recovered:
+		if index != 0 {
+			t.Errorf("Expected recovery of instance 0, got %d", index)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected recovery callback after the instance came back")
+	}
+}
+
+func TestReconcileFallback_KeepsLocalStateWhenMergeFails(t *testing.T) {
+	service := createTestServiceWithMocks(false) // Redis unreachable
+	defer service.Close()
+
+	service.AcquireLocal("offline_user", 5, "token_bucket", "")
+	service.AcquireLocal("offline_user", 2, "leaky_bucket", "")
+
+	index := service.redisManager.GetClientIndex("offline_user")
+	service.reconcileFallback(index)
+
+	if _, exists := service.tokenBuckets.Get(tokenBucketKey("offline_user")); !exists {
+		t.Error("Expected local token bucket to be kept when Redis is still unreachable")
+	}
+	if _, exists := service.leakyBuckets.Get("offline_user"); !exists {
+		t.Error("Expected local leaky bucket to be kept when Redis is still unreachable")
+	}
+}
+
+func TestReconcileFallback_MergesQuotaAndFairShareBuckets(t *testing.T) {
+	server := miniredis.RunT(t)
+	cfg := createTestConfig()
+	cfg.Redis.Instances = []string{server.Addr()}
+	service, err := NewRedisRateLimiterService(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	defer service.Close()
+
+	member := QuotaLevel{Key: "offline_member", Policy: service.ResolvePolicy("offline_member")}
+	level := QuotaLevel{Key: "team:offline", Policy: service.ResolvePolicy("team:offline"), Enclosing: true}
+	pool := QuotaLevel{Key: "partner_api", Policy: service.ResolvePolicy("partner_api")}
+	tenant := QuotaLevel{Key: "offline_user", Policy: service.ResolvePolicy("offline_user")}
+
+	// Consumed locally while the shard was down
+	service.fallback.ConsumeHierarchy([]QuotaLevel{member, level}, 5)
+	service.fallback.ConsumeFairShare(pool, tenant, 7)
+
+	service.reconcileFallback(0)
+
+	poolKey, _, shareKey := fairShareKeys(pool.Key, tenant.Key)
+	for _, key := range []string{quotaKeyPrefix + level.Key, poolKey, shareKey} {
+		if _, exists := service.tokenBuckets.Get(key); exists {
+			t.Errorf("Expected local bucket %s to be evicted after merging", key)
+		}
+		if !server.Exists("rate_limit:" + key) {
+			t.Errorf("Expected %s to be merged into Redis", key)
+		}
+	}
+
+	statuses, _ := service.store.HierarchyStatus([]QuotaLevel{member, level})
+	if statuses[0].Level != 95 || statuses[1].Level != 95 {
+		t.Errorf("Expected both levels to keep the 5 local tokens consumed, got %d and %d left", statuses[0].Level, statuses[1].Level)
+	}
+	if status, _ := service.store.FairShareStatus(pool, tenant.Key); status.Pool.Level != 93 || status.Share.Level != 93 {
+		t.Errorf("Expected the pool and share to keep the 7 local tokens consumed, got %+v", status)
+	}
+}
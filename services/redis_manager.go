@@ -4,6 +4,8 @@ import (
 	"context"
 	"fmt"
 	"hash/crc32"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-redis/redis/v8"
@@ -11,13 +13,19 @@ import (
 
 // RedisManager manages multiple Redis clients with simple hashing
 type RedisManager struct {
-	clients []redis.Client // slice of Redis clients
+	clients  []redis.Client    // slice of Redis clients
+	healthy  []int32           // health view per client, maintained by RedisHealthMonitor (1=healthy)
+	breakers []*CircuitBreaker // optional circuit breaker per client
+
+	recoveryListeners []func(index int) // called when an instance comes back
+	listenersMutex    sync.RWMutex
 }
 
 // NewRedisManager creates a new Redis manager
 func NewRedisManager(instances []string, password string, db int) *RedisManager {
 	rm := &RedisManager{
 		clients: make([]redis.Client, len(instances)),
+		healthy: make([]int32, len(instances)),
 	}
 
 	// Create Redis clients for each instance
@@ -27,21 +35,63 @@ func NewRedisManager(instances []string, password string, db int) *RedisManager
 			Password: password,
 			DB:       db,
 		})
+		rm.healthy[i] = 1 // Assume healthy until the monitor says otherwise
 	}
 
 	return rm
 }
 
-// GetClient returns the Redis client for the given user ID
+// EnableCircuitBreakers wraps every client with its own circuit breaker
+func (rm *RedisManager) EnableCircuitBreakers(settings CircuitBreakerSettings, onStateChange func(name string, from, to BreakerState)) {
+	rm.breakers = make([]*CircuitBreaker, len(rm.clients))
+
+	for i := range rm.clients {
+		index := i
+		rm.breakers[i] = NewCircuitBreaker(rm.InstanceName(i), settings, func(name string, from, to BreakerState) {
+			if onStateChange != nil {
+				onStateChange(name, from, to)
+			}
+			if to == BreakerClosed {
+				rm.notifyRecovered(index)
+			}
+		})
+		rm.clients[i].AddHook(breakerHook{breaker: rm.breakers[i]})
+	}
+}
+
+// OnInstanceRecovered registers a callback for when an instance becomes healthy
+// again or its breaker closes. Callbacks run in their own goroutine.
+func (rm *RedisManager) OnInstanceRecovered(fn func(index int)) {
+	rm.listenersMutex.Lock()
+	defer rm.listenersMutex.Unlock()
+
+	rm.recoveryListeners = append(rm.recoveryListeners, fn)
+}
+
+// notifyRecovered runs the recovery callbacks asynchronously, since the
+// breaker calls us with its lock held and callbacks talk to Redis
+func (rm *RedisManager) notifyRecovered(index int) {
+	rm.listenersMutex.RLock()
+	defer rm.listenersMutex.RUnlock()
+
+	for _, fn := range rm.recoveryListeners {
+		go fn(index)
+	}
+}
+
+// GetClient returns the Redis client for the given user ID.
+// Nil means the instance owning the key is unhealthy or its breaker is open. Keys are
+// never rerouted to another shard: that shard has none of the key's state, so the
+// caller would get a fresh bucket instead of applying the policy fail mode.
 func (rm *RedisManager) GetClient(userID string) *redis.Client {
 	fmt.Printf("DEBUG: GetClient called for userID='%s'\n", userID)
 	fmt.Printf("DEBUG: Number of clients: %d\n", len(rm.clients))
 
-	// Simple hash: use CRC32 to get a number, then mod by number of clients
-	hash := crc32.ChecksumIEEE([]byte(userID))
-	index := int(hash) % len(rm.clients)
+	index := rm.selectIndex(userID)
+	if index < 0 {
+		return nil
+	}
 
-	fmt.Printf("DEBUG: Hash=%d, Index=%d\n", hash, index)
 	fmt.Printf("DEBUG: Returning client at index %d\n", index)
 
 	return &rm.clients[index]
@@ -53,16 +103,115 @@ func (rm *RedisManager) GetClientIndex(userID string) int {
 	return int(hash) % len(rm.clients)
 }
 
+// selectIndex returns the hashed instance for the user, or -1 when it is unavailable
+func (rm *RedisManager) selectIndex(userID string) int {
+	if len(rm.clients) == 0 {
+		return -1
+	}
+
+	index := rm.GetClientIndex(userID)
+	if !rm.IsInstanceAvailable(index) {
+		return -1
+	}
+
+	return index
+}
+
+// InstanceCount returns the number of configured Redis instances
+func (rm *RedisManager) InstanceCount() int {
+	return len(rm.clients)
+}
+
+// InstanceName returns the display name used for an instance in metrics and health output
+func (rm *RedisManager) InstanceName(index int) string {
+	return fmt.Sprintf("redis-%d", index+1)
+}
+
+// IsInstanceHealthy reports the current health view for an instance
+func (rm *RedisManager) IsInstanceHealthy(index int) bool {
+	return atomic.LoadInt32(&rm.healthy[index]) == 1
+}
+
+// IsInstanceAvailable reports whether requests should be routed to an instance
+func (rm *RedisManager) IsInstanceAvailable(index int) bool {
+	return rm.IsInstanceHealthy(index) && rm.BreakerState(index) != BreakerOpen
+}
+
+// BreakerState returns the breaker state for an instance (closed when breakers are disabled)
+func (rm *RedisManager) BreakerState(index int) BreakerState {
+	if rm.breakers == nil {
+		return BreakerClosed
+	}
+	return rm.breakers[index].State()
+}
+
+// SetInstanceHealthy updates the health view for an instance
+func (rm *RedisManager) SetInstanceHealthy(index int, healthy bool) {
+	var value int32
+	if healthy {
+		value = 1
+	}
+
+	if previous := atomic.SwapInt32(&rm.healthy[index], value); previous == 0 && healthy {
+		rm.notifyRecovered(index)
+	}
+}
+
+// getInstanceClient returns the client for an instance regardless of its health
+func (rm *RedisManager) getInstanceClient(index int) *redis.Client {
+	return &rm.clients[index]
+}
+
+// GetHealthView returns the health view maintained by the monitor without pinging
+func (rm *RedisManager) GetHealthView() map[string]bool {
+	status := make(map[string]bool)
+
+	for i := range rm.clients {
+		status[rm.InstanceName(i)] = rm.IsInstanceHealthy(i)
+	}
+
+	return status
+}
+
+// LoadScripts registers the Lua scripts on every instance so calls can use EVALSHA.
+// Instances that fail are skipped; their scripts are loaded on first use instead.
+func (rm *RedisManager) LoadScripts(ctx context.Context) error {
+	var firstErr error
+
+	for i := range rm.clients {
+		if err := rm.loadInstanceScripts(ctx, i); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// loadInstanceScripts registers the Lua scripts on a single instance
+func (rm *RedisManager) loadInstanceScripts(ctx context.Context, index int) error {
+	for _, script := range luaScripts {
+		if err := script.Load(ctx, &rm.clients[index]).Err(); err != nil {
+			return fmt.Errorf("load scripts on %s: %w", rm.InstanceName(index), err)
+		}
+	}
+	return nil
+}
+
+// pingInstance pings a single instance, bypassing its circuit breaker
+func (rm *RedisManager) pingInstance(ctx context.Context, index int) error {
+	return rm.clients[index].Ping(withoutBreaker(ctx)).Err()
+}
+
 // GetHealthStatus returns health status of all clients
 func (rm *RedisManager) GetHealthStatus() map[string]bool {
 	status := make(map[string]bool)
 
-	for i, client := range rm.clients {
+	for i := range rm.clients {
 		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
-		_, err := client.Ping(ctx).Result()
+		err := rm.pingInstance(ctx, i)
 		cancel()
 
-		status[fmt.Sprintf("redis-%d", i+1)] = err == nil
+		status[rm.InstanceName(i)] = err == nil
 	}
 
 	return status
@@ -74,7 +223,7 @@ func (rm *RedisManager) GetDistributionCount(userIDs []string) map[string]int {
 
 	for _, userID := range userIDs {
 		index := rm.GetClientIndex(userID)
-		redisName := fmt.Sprintf("redis-%d", index+1)
+		redisName := rm.InstanceName(index)
 		counts[redisName]++
 	}
 
@@ -83,8 +232,8 @@ func (rm *RedisManager) GetDistributionCount(userIDs []string) map[string]int {
 
 // Close closes all Redis connections
 func (rm *RedisManager) Close() error {
-	for _, client := range rm.clients {
-		if err := client.Close(); err != nil {
+	for i := range rm.clients {
+		if err := rm.clients[i].Close(); err != nil {
 			return err
 		}
 	}
@@ -0,0 +1,504 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/Appy29/rate-limiter/models"
+	"github.com/go-redis/redis/v8"
+)
+
+// redisStore evaluates algorithms with Lua scripts on the shard that owns the key
+type redisStore struct {
+	manager    *RedisManager
+	serverTime bool // scripts and status read the Redis server clock
+}
+
+// newRedisStore creates a Store backed by the manager's Redis shards
+func newRedisStore(manager *RedisManager, clockSource string) *redisStore {
+	return &redisStore{
+		manager:    manager,
+		serverTime: clockSource == ClockRedis,
+	}
+}
+
+// ConsumeTokens runs the token bucket script on the key's shard, charging its period quotas
+func (rs *redisStore) ConsumeTokens(key string, policy models.RateLimitConfig, tokens int64) (bool, error) {
+	client := rs.client(key, policy)
+	if client == nil {
+		return false, ErrRedisUnavailable
+	}
+
+	bucket := rs.tokenBucket(client, key, policy)
+	bucket.usage = levelUsage(QuotaLevel{Key: key, Policy: policy})
+	return bucket.TryConsume(tokens)
+}
+
+// AddRequests runs the leaky bucket script on the key's shard, charging its period quotas
+func (rs *redisStore) AddRequests(key string, policy models.RateLimitConfig, requests int64) (bool, error) {
+	client := rs.client(key, policy)
+	if client == nil {
+		return false, ErrRedisUnavailable
+	}
+
+	bucket := rs.leakyBucket(client, key, policy)
+	bucket.usage = levelUsage(QuotaLevel{Key: key, Policy: policy})
+	return bucket.TryAdd(requests)
+}
+
+// ScheduleRequests runs the leaky bucket shaping script on the key's shard, charging its period quotas
+func (rs *redisStore) ScheduleRequests(key string, policy models.RateLimitConfig, requests int64) (time.Duration, bool, error) {
+	client := rs.client(key, policy)
+	if client == nil {
+		return 0, false, ErrRedisUnavailable
+	}
+
+	bucket := rs.leakyBucket(client, key, policy)
+	bucket.maxWait = policy.ScheduleMaxWait()
+	bucket.usage = levelUsage(QuotaLevel{Key: key, Policy: policy})
+	return bucket.TrySchedule(requests)
+}
+
+// TokenBucketStatus reads the token bucket state from the key's shard
+func (rs *redisStore) TokenBucketStatus(key string, policy models.RateLimitConfig) (BucketStatus, error) {
+	client := rs.client(key, policy)
+	if client == nil {
+		return BucketStatus{}, ErrRedisUnavailable
+	}
+
+	tokenBucketRedis := rs.tokenBucket(client, key, policy)
+	if !tokenBucketRedis.HasState() {
+		return newEmptyTokenBucketStatus(policy), nil
+	}
+
+	tokensLeft, capacity, nextRefill := tokenBucketRedis.GetStatus()
+	return BucketStatus{
+		Level:     tokensLeft,
+		Capacity:  capacity,
+		Next:      nextRefill,
+		HasState:  true,
+		ExpiresAt: tokenBucketRedis.ExpiresAt(),
+	}, nil
+}
+
+// LeakyBucketStatus reads the leaky bucket state from the key's shard
+func (rs *redisStore) LeakyBucketStatus(key string, policy models.RateLimitConfig) (BucketStatus, error) {
+	client := rs.client(key, policy)
+	if client == nil {
+		return BucketStatus{}, ErrRedisUnavailable
+	}
+
+	leakyBucketRedis := rs.leakyBucket(client, key, policy)
+	if !leakyBucketRedis.HasState() {
+		return newEmptyLeakyBucketStatus(policy), nil
+	}
+
+	queueLength, capacity, nextLeak := leakyBucketRedis.GetStatus()
+	return BucketStatus{
+		Level:     queueLength,
+		Capacity:  capacity,
+		Next:      nextLeak,
+		HasState:  true,
+		ExpiresAt: leakyBucketRedis.ExpiresAt(),
+	}, nil
+}
+
+// ConsumeHierarchy runs the hierarchy script on the shard of every level, innermost
+// first, and refunds the shards that admitted when a later one rejects or fails.
+// Nothing is consumed unless every shard is available.
+func (rs *redisStore) ConsumeHierarchy(levels []QuotaLevel, tokens int64) (bool, error) {
+	if tokens < 0 || len(levels) == 0 {
+		return false, nil
+	}
+
+	groups, err := rs.hierarchyGroups(levels)
+	if err != nil {
+		return false, err
+	}
+
+	for i, group := range groups {
+		result, err := rs.runHierarchy(tokenBucketHierarchyScript, group, tokens)
+		if err == nil && result == 1 {
+			continue
+		}
+
+		for _, admitted := range groups[:i] {
+			if _, err := rs.runHierarchy(tokenBucketRefundScript, admitted, tokens); err != nil {
+				log.Printf("Failed to refund %d tokens to %s: %v", tokens, admitted.levels[0].Key, err)
+			}
+		}
+		if err != nil {
+			return false, fmt.Errorf("quota hierarchy eval failed for %s: %w", levels[0].Key, err)
+		}
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// RefundHierarchy runs the refund script on the shard of every level
+func (rs *redisStore) RefundHierarchy(levels []QuotaLevel, tokens int64) error {
+	groups, err := rs.hierarchyGroups(levels)
+	if err != nil {
+		return err
+	}
+
+	for _, group := range groups {
+		if _, err := rs.runHierarchy(tokenBucketRefundScript, group, tokens); err != nil {
+			return fmt.Errorf("quota hierarchy refund failed for %s: %w", group.levels[0].Key, err)
+		}
+	}
+	return nil
+}
+
+// hierarchyGroup is the levels of a hierarchy that live on one shard
+type hierarchyGroup struct {
+	client  *redis.Client
+	levels  []QuotaLevel
+	buckets []*TokenBucketRedis
+}
+
+// hierarchyGroups splits the levels by shard, keeping the innermost first
+func (rs *redisStore) hierarchyGroups(levels []QuotaLevel) ([]hierarchyGroup, error) {
+	var groups []hierarchyGroup
+
+	for _, level := range levels {
+		client := rs.client(level.Key, level.Policy)
+		if client == nil {
+			return nil, ErrRedisUnavailable
+		}
+		bucket := rs.levelBucket(client, level)
+
+		found := false
+		for i := range groups {
+			if groups[i].client == client {
+				groups[i].levels = append(groups[i].levels, level)
+				groups[i].buckets = append(groups[i].buckets, bucket)
+				found = true
+				break
+			}
+		}
+		if !found {
+			groups = append(groups, hierarchyGroup{client: client, levels: []QuotaLevel{level}, buckets: []*TokenBucketRedis{bucket}})
+		}
+	}
+
+	return groups, nil
+}
+
+// runHierarchy runs a hierarchy script over the levels of one shard
+func (rs *redisStore) runHierarchy(script *redis.Script, group hierarchyGroup, tokens int64) (int64, error) {
+	keys := make([]string, len(group.levels))
+	args := []interface{}{tokens, scriptNow(rs.serverTime), len(group.levels)}
+	for i, bucket := range group.buckets {
+		keys[i] = bucket.key
+		args = append(args, bucket.capacity, scriptRate(bucket.refillRate), bucket.refillTokens, bucket.initialTokens, bucket.ttl.Milliseconds(), bucket.floor)
+	}
+
+	usage := levelUsage(group.levels...)
+	keys = append(keys, usage.keys...)
+	args = append(args, usage.args...)
+
+	return script.Run(context.Background(), group.client, keys, args...).Int64()
+}
+
+// HierarchyStatus reads every level from its own shard
+func (rs *redisStore) HierarchyStatus(levels []QuotaLevel) ([]BucketStatus, error) {
+	if len(levels) == 0 {
+		return nil, nil
+	}
+
+	statuses := make([]BucketStatus, len(levels))
+	for i, level := range levels {
+		client := rs.client(level.Key, level.Policy)
+		if client == nil {
+			return nil, ErrRedisUnavailable
+		}
+
+		bucket := rs.levelBucket(client, level)
+		if !bucket.HasState() {
+			statuses[i] = newEmptyTokenBucketStatus(level.Policy)
+			continue
+		}
+
+		tokensLeft, capacity, nextRefill := bucket.GetStatus()
+		statuses[i] = BucketStatus{Level: tokensLeft, Capacity: capacity, Next: nextRefill, HasState: true, ExpiresAt: bucket.ExpiresAt()}
+	}
+	return statuses, nil
+}
+
+// ConsumeFairShare runs the fair share script on the pool's shard, charging the tenant's period quotas
+func (rs *redisStore) ConsumeFairShare(pool QuotaLevel, tenant QuotaLevel, tokens int64) (bool, error) {
+	if tokens < 0 {
+		return false, nil
+	}
+
+	client := rs.manager.GetClient(pool.Key)
+	if client == nil {
+		return false, ErrRedisUnavailable
+	}
+
+	poolKey, activeKey, shareKey := fairShareKeys(pool.Key, tenant.Key)
+	bucket := rs.tokenBucket(client, pool.Key, pool.Policy)
+	keys := []string{"rate_limit:" + poolKey, "rate_limit:" + activeKey, "rate_limit:" + shareKey}
+	args := []interface{}{tokens, scriptNow(rs.serverTime), bucket.capacity, scriptRate(bucket.refillRate), bucket.refillTokens,
+		bucket.initialTokens, bucket.ttl.Milliseconds(), fairShareWindow(pool.Policy).Milliseconds(),
+		pool.Policy.ReservedFraction(), tenant.Key}
+
+	usage := levelUsage(tenant)
+	keys = append(keys, usage.keys...)
+	args = append(args, usage.args...)
+
+	result, err := fairShareScript.Run(context.Background(), client, keys, args...).Int64Slice()
+	if err != nil {
+		return false, fmt.Errorf("fair share eval failed for %s in %s: %w", tenant.Key, pool.Key, err)
+	}
+
+	return len(result) == 2 && result[0] == 1, nil
+}
+
+// FairShareStatus reads the pool, its active set and the tenant's share from the pool's shard
+func (rs *redisStore) FairShareStatus(pool QuotaLevel, tenant string) (PoolStatus, error) {
+	client := rs.manager.GetClient(pool.Key)
+	if client == nil {
+		return PoolStatus{}, ErrRedisUnavailable
+	}
+
+	ctx := context.Background()
+	poolKey, activeKey, shareKey := fairShareKeys(pool.Key, tenant)
+
+	since := redisNow(ctx, client, rs.serverTime).Add(-fairShareWindow(pool.Policy)).UnixMilli()
+	active, err := client.ZCount(ctx, "rate_limit:"+activeKey, strconv.FormatInt(since, 10), "+inf").Result()
+	if err != nil {
+		return PoolStatus{}, fmt.Errorf("fair share status failed for %s: %w", pool.Key, err)
+	}
+
+	status := PoolStatus{Active: active}
+	for _, level := range []struct {
+		key    string
+		policy models.RateLimitConfig
+		status *BucketStatus
+	}{
+		{poolKey, pool.Policy, &status.Pool},
+		{shareKey, fairSharePolicy(pool.Policy, active), &status.Share},
+	} {
+		bucket := rs.tokenBucket(client, level.key, level.policy)
+		bucket.key = "rate_limit:" + level.key
+		if !bucket.HasState() {
+			*level.status = newEmptyTokenBucketStatus(level.policy)
+			continue
+		}
+
+		tokensLeft, capacity, nextRefill := bucket.GetStatus()
+		*level.status = BucketStatus{Level: tokensLeft, Capacity: capacity, Next: nextRefill, HasState: true, ExpiresAt: bucket.ExpiresAt()}
+	}
+	status.Share = currentShare(status.Share, fairSharePolicy(pool.Policy, active))
+	return status, nil
+}
+
+// RecordViolation runs the penalty script on the key's shard
+func (rs *redisStore) RecordViolation(key string, rule models.PenaltyConfig) (PenaltyState, error) {
+	client := rs.manager.GetClient(key)
+	if client == nil {
+		return PenaltyState{}, ErrRedisUnavailable
+	}
+
+	result, err := penaltyRecordScript.Run(context.Background(), client, []string{penaltyRedisKey(key)},
+		scriptNow(rs.serverTime), rule.Threshold, scriptRate(rule.Window), rule.Base.Microseconds(),
+		rule.Multiplier, rule.Max.Microseconds()).Int64Slice()
+	if err != nil {
+		return PenaltyState{}, fmt.Errorf("penalty eval failed for %s: %w", key, err)
+	}
+	if len(result) != 2 {
+		return PenaltyState{}, fmt.Errorf("penalty eval failed for %s: unexpected result %v", key, result)
+	}
+
+	return PenaltyState{Violations: result[0], Remaining: time.Duration(result[1]) * time.Microsecond}, nil
+}
+
+// Penalty reads the key's penalty state from its shard
+func (rs *redisStore) Penalty(key string, rule models.PenaltyConfig) (PenaltyState, error) {
+	client := rs.manager.GetClient(key)
+	if client == nil {
+		return PenaltyState{}, ErrRedisUnavailable
+	}
+
+	ctx := context.Background()
+	values, err := client.HMGet(ctx, penaltyRedisKey(key), "violations", "last_us", "until_us").Result()
+	if err != nil {
+		return PenaltyState{}, fmt.Errorf("penalty read failed for %s: %w", key, err)
+	}
+
+	fields := make([]int64, len(values))
+	for i, value := range values {
+		if text, ok := value.(string); ok {
+			fields[i], _ = strconv.ParseInt(text, 10, 64)
+		}
+	}
+
+	// Read the box on the clock that wrote it
+	now := redisNow(ctx, client, rs.serverTime)
+	violations := decayViolations(fields[0], time.UnixMicro(fields[1]), now, rule.Window)
+	return PenaltyState{Violations: violations, Remaining: max(0, time.UnixMicro(fields[2]).Sub(now))}, nil
+}
+
+// ClearPenalty deletes the key's penalty state from its shard
+func (rs *redisStore) ClearPenalty(key string) error {
+	client := rs.manager.GetClient(key)
+	if client == nil {
+		return ErrRedisUnavailable
+	}
+
+	if err := client.Del(context.Background(), penaltyRedisKey(key)).Err(); err != nil {
+		return fmt.Errorf("penalty clear failed for %s: %w", key, err)
+	}
+	return nil
+}
+
+// AdaptiveLimit reads the key's AIMD limit from its shard
+func (rs *redisStore) AdaptiveLimit(key string) (int64, bool, error) {
+	client := rs.manager.GetClient(key)
+	if client == nil {
+		return 0, false, ErrRedisUnavailable
+	}
+
+	limit, err := client.Get(context.Background(), adaptiveRedisKey(key)).Int64()
+	if err == redis.Nil {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("adaptive limit read failed for %s: %w", key, err)
+	}
+	return limit, true, nil
+}
+
+// AdjustAdaptiveLimit runs the AIMD step script on the key's shard
+func (rs *redisStore) AdjustAdaptiveLimit(key string, step AdaptiveStep) (int64, error) {
+	client := rs.manager.GetClient(key)
+	if client == nil {
+		return 0, ErrRedisUnavailable
+	}
+
+	healthy := 0
+	if step.Healthy {
+		healthy = 1
+	}
+
+	limit, err := adaptiveStepScript.Run(context.Background(), client, []string{adaptiveRedisKey(key)},
+		step.Initial, healthy, step.Increase, step.Decrease, step.Min, step.Max).Int64()
+	if err != nil {
+		return 0, fmt.Errorf("adaptive limit eval failed for %s: %w", key, err)
+	}
+	return limit, nil
+}
+
+// adaptiveRedisKey names the key's AIMD limit
+func adaptiveRedisKey(key string) string {
+	return "rate_limit:" + adaptiveKeyPrefix + key
+}
+
+// penaltyRedisKey names the key's penalty hash
+func penaltyRedisKey(key string) string {
+	return "rate_limit:" + penaltyKeyPrefix + key
+}
+
+// levelBucket builds the Redis token bucket of a hierarchy level:
+// the key's own bucket, or a quota bucket for enclosing levels
+func (rs *redisStore) levelBucket(client *redis.Client, level QuotaLevel) *TokenBucketRedis {
+	if level.Enclosing {
+		return rs.quotaBucket(client, level)
+	}
+	return rs.tokenBucket(client, level.Key, level.Policy)
+}
+
+// quotaBucket builds the Redis token bucket of an enclosing quota level
+func (rs *redisStore) quotaBucket(client *redis.Client, level QuotaLevel) *TokenBucketRedis {
+	bucket := rs.tokenBucket(client, level.Key, level.Policy)
+	bucket.key = "rate_limit:" + quotaKeyPrefix + level.Key
+	return bucket
+}
+
+// Usage reads the level's period counters from its shard
+func (rs *redisStore) Usage(level QuotaLevel, windows []UsageWindow) ([]int64, error) {
+	client := rs.client(level.Key, level.Policy)
+	if client == nil {
+		return nil, ErrRedisUnavailable
+	}
+
+	keys := make([]string, len(windows))
+	for i, window := range windows {
+		keys[i] = "rate_limit:" + usageCounterKey(level.Key, window.ID)
+	}
+
+	values, err := client.MGet(context.Background(), keys...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("usage read failed for %s: %w", level.Key, err)
+	}
+
+	counts := make([]int64, len(values))
+	for i, value := range values {
+		if text, ok := value.(string); ok {
+			counts[i], _ = strconv.ParseInt(text, 10, 64)
+		}
+	}
+	return counts, nil
+}
+
+// mergeUsage adds counters recorded locally during an outage to the key's shard
+func (rs *redisStore) mergeUsage(client *redis.Client, key string, counters map[string]usageCounter) error {
+	ctx := context.Background()
+
+	_, err := client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for windowID, counter := range counters {
+			counterKey := "rate_limit:" + usageCounterKey(key, windowID)
+			pipe.IncrBy(ctx, counterKey, counter.value)
+			pipe.PExpireAt(ctx, counterKey, counter.expireAt)
+		}
+		return nil
+	})
+	return err
+}
+
+// client returns the shard holding the key's buckets and period counters
+func (rs *redisStore) client(key string, policy models.RateLimitConfig) *redis.Client {
+	return rs.manager.GetClient(homeKey(key, policy))
+}
+
+// homeKey picks the shard of a key's state. Tenants of a fair share pool live on the
+// pool's shard, so the pool script can charge their period quotas atomically.
+func homeKey(key string, policy models.RateLimitConfig) string {
+	if policy.Pool != "" {
+		return policy.Pool
+	}
+	return key
+}
+
+// tokenBucket builds the Redis token bucket for a key with the store's settings
+func (rs *redisStore) tokenBucket(client *redis.Client, key string, policy models.RateLimitConfig) *TokenBucketRedis {
+	bucket := NewTokenBucketRedis(client, key, policy.BurstSize(), policy.RefillRate)
+	bucket.initialTokens = policy.StartTokens()
+	bucket.floor = policy.TokenFloor()
+	bucket.serverTime = rs.serverTime
+	bucket.ttl = stateTTL(policy)
+	if policy.RefillTokens > 0 {
+		bucket.refillTokens = policy.RefillTokens
+	}
+	return bucket
+}
+
+// leakyBucket builds the Redis leaky bucket for a key with the store's settings
+func (rs *redisStore) leakyBucket(client *redis.Client, key string, policy models.RateLimitConfig) *LeakyBucketRedis {
+	bucket := NewLeakyBucketRedis(client, key, policy.Capacity, policy.RefillRate)
+	bucket.reserve = policy.ReservedTokens(policy.Capacity)
+	bucket.serverTime = rs.serverTime
+	bucket.ttl = stateTTL(policy)
+	return bucket
+}
+
+// Close closes all Redis connections
+func (rs *redisStore) Close() error {
+	return rs.manager.Close()
+}
@@ -0,0 +1,304 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Appy29/rate-limiter/models"
+	"github.com/alicebob/miniredis/v2"
+)
+
+// newTestRedisStore runs the Redis store against an in-process Redis
+func newTestRedisStore(t *testing.T) (*miniredis.Miniredis, *redisStore) {
+	t.Helper()
+
+	servers, store := newTestRedisShards(t, 1)
+	return servers[0], store
+}
+
+// newTestRedisShards runs the Redis store against several in-process Redis shards
+func newTestRedisShards(t *testing.T, count int) ([]*miniredis.Miniredis, *redisStore) {
+	t.Helper()
+
+	servers := make([]*miniredis.Miniredis, count)
+	addrs := make([]string, count)
+	for i := range servers {
+		servers[i] = miniredis.RunT(t)
+		addrs[i] = servers[i].Addr()
+	}
+
+	store := newRedisStore(NewRedisManager(addrs, "", 0), ClockLocal)
+	t.Cleanup(func() { store.Close() })
+	return servers, store
+}
+
+func TestRedisStore_ScriptTimestampsAreExactMicroseconds(t *testing.T) {
+	server, store := newTestRedisStore(t)
+	client := store.manager.GetClient("user1")
+
+	// An odd microsecond count: as nanoseconds this is past 2^53 and a Lua double would round it
+	nowUs := int64(1760000000123457)
+	err := tokenBucketConsumeScript.Run(context.Background(), client, []string{"rate_limit:token_bucket:user1"},
+		1, 10, scriptRate(time.Second), nowUs, 60000, 1, 10, 0).Err()
+	if err != nil {
+		t.Fatalf("Expected the script to run, got %v", err)
+	}
+
+	if got := server.HGet("rate_limit:token_bucket:user1", "last_refill_us"); got != strconv.FormatInt(nowUs, 10) {
+		t.Errorf("Expected last_refill_us %d, got %s", nowUs, got)
+	}
+	if got := server.HGet("rate_limit:token_bucket:user1", "refill_rate_us"); got != "1000000" {
+		t.Errorf("Expected refill_rate_us 1000000, got %s", got)
+	}
+}
+
+func TestRedisStore_ScriptsMigrateLegacyJSON(t *testing.T) {
+	server, store := newTestRedisStore(t)
+	policy := models.RateLimitConfig{Capacity: 10, RefillRate: time.Second}
+
+	// State as written by older versions: one JSON string with nanosecond timestamps
+	twoSecondsAgo := time.Now().Add(-2 * time.Second)
+	server.Set("rate_limit:token_bucket:legacy", fmt.Sprintf(
+		`{"capacity":10,"tokens":3,"refill_rate_ns":1000000000,"last_refill_ns":%d,"last_updated":%d}`,
+		twoSecondsAgo.UnixNano(), twoSecondsAgo.UnixNano()))
+	server.Set("rate_limit:leaky_bucket:legacy", fmt.Sprintf(
+		`{"capacity":10,"queue_length":6,"leak_rate_ns":1000000000,"last_leak_ns":%d,"last_updated":%d}`,
+		twoSecondsAgo.UnixNano(), twoSecondsAgo.UnixNano()))
+
+	// The Go readers understand the legacy format before any script touched it
+	if status, err := store.TokenBucketStatus("legacy", policy); err != nil || status.Level != 5 {
+		t.Errorf("Expected 3 tokens plus 2 refilled from the legacy state, got %d (%v)", status.Level, err)
+	}
+	if status, err := store.LeakyBucketStatus("legacy", policy); err != nil || status.Level != 4 {
+		t.Errorf("Expected 6 queued minus 2 leaked from the legacy state, got %d (%v)", status.Level, err)
+	}
+
+	if allowed, err := store.ConsumeTokens("legacy", policy, 1); !allowed || err != nil {
+		t.Fatalf("Expected the legacy token bucket to admit, got %v (%v)", allowed, err)
+	}
+	if allowed, err := store.AddRequests("legacy", policy, 1); !allowed || err != nil {
+		t.Fatalf("Expected the legacy leaky bucket to admit, got %v (%v)", allowed, err)
+	}
+
+	// The scripts rewrote both keys as hashes, converting the timestamps to µs
+	for key, field := range map[string]string{
+		"rate_limit:token_bucket:legacy": "last_refill_us",
+		"rate_limit:leaky_bucket:legacy": "last_leak_us",
+	} {
+		if keyType := server.Type(key); keyType != "hash" {
+			t.Errorf("Expected %s to be migrated to a hash, got %s", key, keyType)
+			continue
+		}
+
+		last, _ := strconv.ParseInt(server.HGet(key, field), 10, 64)
+		if drift := time.Since(time.UnixMicro(last)); drift < 0 || drift > 3*time.Second {
+			t.Errorf("Expected %s %s near the legacy timestamp, got %v ago", key, field, drift)
+		}
+	}
+
+	if status, _ := store.TokenBucketStatus("legacy", policy); status.Level != 4 {
+		t.Errorf("Expected 4 tokens left after the migrating request, got %d", status.Level)
+	}
+	if status, _ := store.LeakyBucketStatus("legacy", policy); status.Level != 5 {
+		t.Errorf("Expected 5 queued after the migrating request, got %d", status.Level)
+	}
+}
+
+func TestRedisStore_ServerClockNeverMeetsLocalClock(t *testing.T) {
+	server := miniredis.RunT(t)
+	store := newRedisStore(NewRedisManager([]string{server.Addr()}, "", 0), ClockRedis)
+	t.Cleanup(func() { store.Close() })
+
+	// The Redis server's clock runs an hour ahead of this process
+	server.SetTime(time.Now().Add(time.Hour))
+
+	policy := models.RateLimitConfig{Capacity: 5, RefillRate: time.Second}
+	store.ScheduleRequests("skewed", policy, 1)
+	if delay, allowed, err := store.ScheduleRequests("skewed", policy, 1); !allowed || err != nil || delay != time.Second {
+		t.Errorf("Expected the second request one leak interval out, got %v (%v, %v)", delay, allowed, err)
+	}
+
+	rule := penaltyRule(models.PenaltyConfig{Threshold: 1, Base: time.Minute})
+	if state, _ := store.RecordViolation("skewed", rule); state.Remaining != time.Minute {
+		t.Errorf("Expected a one minute box, got %v", state.Remaining)
+	}
+	if state, _ := store.Penalty("skewed", rule); state.Remaining <= 0 || state.Remaining > time.Minute {
+		t.Errorf("Expected the box to still be running on the server's clock, got %v", state.Remaining)
+	}
+}
+
+func TestRedisStore_ScheduleRejectsBeyondMaxWait(t *testing.T) {
+	_, store := newTestRedisStore(t)
+	policy := models.RateLimitConfig{Capacity: 10, RefillRate: time.Second, Mode: models.LeakyModeShape, MaxWait: 2 * time.Second}
+
+	for i := 0; i < 3; i++ {
+		if _, allowed, err := store.ScheduleRequests("shaped", policy, 1); !allowed || err != nil {
+			t.Fatalf("Expected request %d to start within the max wait, got %v (%v)", i+1, allowed, err)
+		}
+	}
+
+	delay, allowed, err := store.ScheduleRequests("shaped", policy, 1)
+	if allowed || err != nil {
+		t.Fatalf("Expected a request 3s out to be rejected, got %v (%v)", allowed, err)
+	}
+	if delay < 2900*time.Millisecond || delay > 3*time.Second {
+		t.Errorf("Expected the delay the request would have had (3s), got %v", delay)
+	}
+
+	if status, _ := store.LeakyBucketStatus("shaped", policy); status.Level != 3 {
+		t.Errorf("Expected the rejected request not to be queued, got %d queued", status.Level)
+	}
+}
+
+func TestRedisStore_ConsumeFairShare(t *testing.T) {
+	_, store := newTestRedisStore(t)
+	pool := QuotaLevel{Key: "partner_api", Policy: models.RateLimitConfig{Capacity: 12, RefillRate: time.Hour, RefillTokens: 1}}
+
+	// Alone, a tenant's share is the whole pool
+	if allowed, err := store.ConsumeFairShare(pool, QuotaLevel{Key: "quiet"}, 1); !allowed || err != nil {
+		t.Fatalf("Expected the first tenant to be allowed, got %v (%v)", allowed, err)
+	}
+
+	// With two active tenants each gets half
+	if allowed, _ := store.ConsumeFairShare(pool, QuotaLevel{Key: "noisy"}, 6); !allowed {
+		t.Fatal("Expected the noisy tenant to use its half of the pool")
+	}
+	if allowed, _ := store.ConsumeFairShare(pool, QuotaLevel{Key: "noisy"}, 1); allowed {
+		t.Error("Expected the noisy tenant to be held to its share")
+	}
+
+	// ... so the pool still has room for the quiet tenant
+	if allowed, _ := store.ConsumeFairShare(pool, QuotaLevel{Key: "quiet"}, 4); !allowed {
+		t.Error("Expected the noisy tenant not to starve the quiet one")
+	}
+
+	status, err := store.FairShareStatus(pool, "noisy")
+	if err != nil || status.Active != 2 || status.Share.Capacity != 6 || status.Share.Level != 0 || status.Pool.Level != 1 {
+		t.Errorf("Expected 2 tenants sharing 6 each with 0 and 1 pool token left, got %+v (%v)", status, err)
+	}
+
+	// The pool itself is never overdrawn, whatever the shares say
+	if allowed, _ := store.ConsumeFairShare(pool, QuotaLevel{Key: "quiet"}, 2); allowed {
+		t.Error("Expected the quiet tenant to be rejected once the pool is down to 1 token")
+	}
+}
+
+func TestRedisStore_DebtOutlivesCapacityRefill(t *testing.T) {
+	server := miniredis.RunT(t)
+	store := newRedisStore(NewRedisManager([]string{server.Addr()}, "", 0), ClockRedis)
+	t.Cleanup(func() { store.Close() })
+
+	start := time.Now().Truncate(time.Second)
+	server.SetTime(start)
+	policy := models.RateLimitConfig{Capacity: 10, RefillRate: time.Second, Debt: 100}
+
+	// Borrow the full debt: 10 tokens plus 100 below zero
+	if allowed, err := store.ConsumeTokens("borrower", policy, 110); !allowed || err != nil {
+		t.Fatalf("Expected the request to borrow up to the debt, got %v (%v)", allowed, err)
+	}
+
+	// Past the time to refill the capacity, the bucket is still repaying its debt
+	server.FastForward(11 * time.Second)
+	server.SetTime(start.Add(11 * time.Second))
+
+	status, err := store.TokenBucketStatus("borrower", policy)
+	if err != nil {
+		t.Fatalf("Expected the status to be readable, got %v", err)
+	}
+	if !status.HasState || status.Level >= 0 {
+		t.Errorf("Expected the bucket to still be in debt, got %d tokens (state kept: %v)", status.Level, status.HasState)
+	}
+	if allowed, _ := store.ConsumeTokens("borrower", policy, 1); allowed {
+		t.Error("Expected a bucket in debt not to admit")
+	}
+}
+
+func TestRedisStore_FairShareTenantsJoinAndExpire(t *testing.T) {
+	server := miniredis.RunT(t)
+	store := newRedisStore(NewRedisManager([]string{server.Addr()}, "", 0), ClockRedis)
+	t.Cleanup(func() { store.Close() })
+
+	start := time.Now().Truncate(time.Second)
+	at := func(offset time.Duration) { server.SetTime(start.Add(offset)) }
+
+	pool := QuotaLevel{Key: "partner_api", Policy: models.RateLimitConfig{
+		Capacity: 12, RefillRate: time.Hour, RefillTokens: 1, ActiveWindow: 10 * time.Second,
+	}}
+	consume := func(tenant string, tokens int64) bool {
+		t.Helper()
+		allowed, err := store.ConsumeFairShare(pool, QuotaLevel{Key: tenant}, tokens)
+		if err != nil {
+			t.Fatalf("Fair share script failed for %s: %v", tenant, err)
+		}
+		return allowed
+	}
+	share := func(tenant string) PoolStatus {
+		t.Helper()
+		status, err := store.FairShareStatus(pool, tenant)
+		if err != nil {
+			t.Fatalf("Fair share status failed for %s: %v", tenant, err)
+		}
+		return status
+	}
+
+	// a is alone and may use the whole pool
+	at(0)
+	if !consume("a", 1) {
+		t.Fatal("Expected the only tenant to be allowed")
+	}
+
+	// b joins mid-window: the split halves and a's share shrinks with it
+	at(2 * time.Second)
+	if !consume("b", 1) {
+		t.Fatal("Expected the joining tenant to be allowed")
+	}
+	at(3 * time.Second)
+	if !consume("a", 6) {
+		t.Error("Expected a to use the rest of its halved share")
+	}
+	if consume("a", 1) {
+		t.Error("Expected a to be held to half the pool once b joined")
+	}
+	if status := share("a"); status.Active != 2 || status.Share.Capacity != 6 || status.Share.Level != 0 {
+		t.Errorf("Expected a's share to be 6 of 12 with 2 tenants and nothing left, got %+v", status)
+	}
+
+	// c joins: thirds
+	at(4 * time.Second)
+	if !consume("c", 1) {
+		t.Fatal("Expected the third tenant to be allowed")
+	}
+	if status := share("c"); status.Active != 3 || status.Share.Capacity != 4 || status.Share.Level != 3 {
+		t.Errorf("Expected c's share to be 4 with 3 tenants and 3 left, got %+v", status)
+	}
+
+	// b's last request falls out of the window while a and c are still active
+	at(12*time.Second + 500*time.Millisecond)
+	if status := share("c"); status.Active != 2 || status.Share.Capacity != 6 {
+		t.Errorf("Expected b to expire mid-window and c's share to grow to 6, got %+v", status)
+	}
+	if !consume("c", 1) {
+		t.Error("Expected c to be allowed from its grown share")
+	}
+	if members, err := server.ZMembers("rate_limit:fair_share:partner_api:active"); err != nil || len(members) != 2 {
+		t.Errorf("Expected the script to drop b from the active set, got %v (%v)", members, err)
+	}
+
+	// Everyone goes quiet; a newcomer finds itself alone again, limited only by what is left in the pool
+	at(time.Minute)
+	if status := share("d"); status.Active != 0 {
+		t.Errorf("Expected no active tenants after the window, got %d", status.Active)
+	}
+	if !consume("d", 1) {
+		t.Fatal("Expected the newcomer to be allowed")
+	}
+	if status := share("d"); status.Active != 1 || status.Share.Capacity != 12 || status.Pool.Level != 1 {
+		t.Errorf("Expected d alone with the whole pool as its share and 1 pool token left, got %+v", status)
+	}
+	if consume("d", 2) {
+		t.Error("Expected the newcomer to be rejected beyond what is left in the pool")
+	}
+}
@@ -0,0 +1,150 @@
+package services
+
+import (
+	"math"
+	"time"
+
+	"github.com/Appy29/rate-limiter/models"
+	"github.com/go-redis/redis/v8"
+)
+
+// Storage backends selectable through config
+const (
+	StorageRedis  = "redis"  // sharded Redis with Lua scripts (default)
+	StorageMemory = "memory" // process-local, for single-node deployments and tests
+	StorageDisk   = "disk"   // process-local with an on-disk log, survives restarts
+)
+
+// luaScripts are preloaded on every Redis instance at startup and after recovery
+var luaScripts = []*redis.Script{
+	tokenBucketConsumeScript,
+	tokenBucketMergeScript,
+	leakyBucketAddScript,
+	leakyBucketMergeScript,
+	leakyBucketScheduleScript,
+	tokenBucketHierarchyScript,
+	tokenBucketRefundScript,
+	fairShareScript,
+	penaltyRecordScript,
+	adaptiveStepScript,
+}
+
+// Store evaluates rate limiting algorithms atomically against a storage backend.
+// Every backend implements every algorithm, so policies work the same on any of them.
+type Store interface {
+	// ConsumeTokens runs the token bucket algorithm for the key.
+	// Every consuming method also charges the period quotas of the levels it consumes
+	// from, in the same atomic step, and admits nothing if one would be exceeded.
+	ConsumeTokens(key string, policy models.RateLimitConfig, tokens int64) (bool, error)
+	// AddRequests runs the leaky bucket algorithm for the key
+	AddRequests(key string, policy models.RateLimitConfig, requests int64) (bool, error)
+	// TokenBucketStatus reports the token bucket state without consuming
+	TokenBucketStatus(key string, policy models.RateLimitConfig) (BucketStatus, error)
+	// ScheduleRequests runs the leaky bucket in shaping mode, returning how long until the
+	// first request may start (measured on the backend's clock). Requests that would wait
+	// longer than the policy's max wait are rejected with the delay they would have had.
+	ScheduleRequests(key string, policy models.RateLimitConfig, requests int64) (time.Duration, bool, error)
+	// LeakyBucketStatus reports the leaky bucket state without adding
+	LeakyBucketStatus(key string, policy models.RateLimitConfig) (BucketStatus, error)
+	// ConsumeHierarchy takes tokens from every level's token bucket, or from none
+	ConsumeHierarchy(levels []QuotaLevel, tokens int64) (bool, error)
+	// RefundHierarchy gives tokens taken by ConsumeHierarchy back to every level and
+	// its period counters, without refilling a bucket past its capacity
+	RefundHierarchy(levels []QuotaLevel, tokens int64) error
+	// HierarchyStatus reports each level's token bucket without consuming
+	HierarchyStatus(levels []QuotaLevel) ([]BucketStatus, error)
+	// Usage reads the level's period counters
+	Usage(level QuotaLevel, windows []UsageWindow) ([]int64, error)
+	// ConsumeFairShare marks the tenant active and takes tokens from the pool and the tenant's share, or from neither
+	ConsumeFairShare(pool QuotaLevel, tenant QuotaLevel, tokens int64) (bool, error)
+	// FairShareStatus reports the pool and the tenant's share without consuming
+	FairShareStatus(pool QuotaLevel, tenant string) (PoolStatus, error)
+	// RecordViolation counts a rejection of the key and extends its penalty box
+	RecordViolation(key string, rule models.PenaltyConfig) (PenaltyState, error)
+	// Penalty reads the key's decayed violations and penalty box
+	Penalty(key string, rule models.PenaltyConfig) (PenaltyState, error)
+	// ClearPenalty forgets the key's violations and penalty box
+	ClearPenalty(key string) error
+	// AdaptiveLimit reads the key's AIMD limit (false if no feedback has moved it yet)
+	AdaptiveLimit(key string) (int64, bool, error)
+	// AdjustAdaptiveLimit moves the key's AIMD limit by one step and returns the new limit
+	AdjustAdaptiveLimit(key string, step AdaptiveStep) (int64, error)
+	// Close releases the backend's resources
+	Close() error
+}
+
+// BucketStatus is a backend-neutral view of a bucket
+type BucketStatus struct {
+	Level     int64     // tokens left (token bucket) or queue length (leaky bucket)
+	Capacity  int64     // maximum tokens or queue length
+	Next      time.Time // next refill or leak
+	HasState  bool      // whether the backend holds state for the key
+	ExpiresAt time.Time // when the backend drops the idle state (zero if it does not expire)
+}
+
+// minStateTTL keeps very fast buckets from expiring between back-to-back requests
+const minStateTTL = time.Second
+
+// stateTTL is how long a bucket's idle state is kept: the policy override if set,
+// otherwise the time for the bucket to return to its initial state (full or empty),
+// after which dropping the state changes nothing. A token bucket in debt first has
+// to repay it, so the debt counts towards the tokens to refill.
+func stateTTL(policy models.RateLimitConfig) time.Duration {
+	if policy.TTL > 0 {
+		return policy.TTL
+	}
+
+	// The leaky bucket drains one request per interval; a slower token refill takes longer
+	perInterval := 1.0
+	if policy.RefillTokens > 0 && policy.RefillTokens < 1 {
+		perInterval = policy.RefillTokens
+	}
+	return recoveryTime(max(policy.Capacity, policy.BurstSize())+max(0, policy.Debt), policy.RefillRate, perInterval)
+}
+
+// recoveryTime is the time to refill (or drain) a whole bucket at perInterval
+// tokens per interval, at least minStateTTL
+func recoveryTime(capacity int64, interval time.Duration, perInterval float64) time.Duration {
+	if capacity <= 0 || interval <= 0 || perInterval <= 0 {
+		return minStateTTL
+	}
+
+	ttl := float64(capacity) * float64(interval) / perInterval
+	if ttl >= math.MaxInt64 {
+		return time.Duration(math.MaxInt64) // effectively never
+	}
+	if ttl < float64(minStateTTL) {
+		return minStateTTL
+	}
+	return time.Duration(ttl)
+}
+
+// evaluate dispatches a request to the algorithm on the given store
+func evaluate(store Store, key string, policy models.RateLimitConfig, tokens int64, algorithm string) (bool, error) {
+	switch algorithm {
+	case "leaky_bucket":
+		return store.AddRequests(key, policy, tokens)
+	case "token_bucket":
+		fallthrough
+	default:
+		return store.ConsumeTokens(key, policy, tokens)
+	}
+}
+
+// newEmptyTokenBucketStatus is the status of a token bucket that has no state yet
+func newEmptyTokenBucketStatus(policy models.RateLimitConfig) BucketStatus {
+	return BucketStatus{
+		Level:    policy.StartTokens(),
+		Capacity: policy.BurstSize(),
+		Next:     time.Now().Add(tokenInterval(policy.RefillRate, policy.RefillTokens)),
+	}
+}
+
+// newEmptyLeakyBucketStatus is the status of a leaky bucket that has no state yet
+func newEmptyLeakyBucketStatus(policy models.RateLimitConfig) BucketStatus {
+	return BucketStatus{
+		Level:    0,
+		Capacity: policy.Capacity,
+		Next:     time.Now().Add(policy.RefillRate),
+	}
+}
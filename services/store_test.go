@@ -0,0 +1,156 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Appy29/rate-limiter/models"
+)
+
+func TestStateTTL(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy models.RateLimitConfig
+		want   time.Duration
+	}{
+		{"derived from capacity and interval", models.RateLimitConfig{Capacity: 100, RefillRate: time.Second}, 100 * time.Second},
+		{"long window", models.RateLimitConfig{Capacity: 24, RefillRate: time.Hour}, 24 * time.Hour},
+		{"debt is repaid first", models.RateLimitConfig{Capacity: 10, RefillRate: time.Second, Debt: 100}, 110 * time.Second},
+		{"clamped to minimum", models.RateLimitConfig{Capacity: 10, RefillRate: time.Millisecond}, minStateTTL},
+		{"policy override", models.RateLimitConfig{Capacity: 100, RefillRate: time.Second, TTL: time.Minute}, time.Minute},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := stateTTL(tt.policy); got != tt.want {
+				t.Errorf("Expected TTL %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestMemoryStore_BurstAndInitialTokens(t *testing.T) {
+	store := newMemoryStore(
+		newBoundedStore[*tokenBucket](0, 0, 0),
+		newBoundedStore[*leakyBucket](0, 0, 0),
+	)
+
+	initial := int64(2)
+	policy := models.RateLimitConfig{
+		Capacity:      100,
+		RefillRate:    time.Second,
+		RefillTokens:  100, // 100 rps sustained
+		Burst:         500, // bursts to 500
+		InitialTokens: &initial,
+	}
+
+	status, _ := store.TokenBucketStatus("burst_user", policy)
+	if status.Level != 2 || status.Capacity != 500 {
+		t.Errorf("Expected a new key to report 2/500 tokens, got %d/%d", status.Level, status.Capacity)
+	}
+
+	if allowed, _ := store.ConsumeTokens("burst_user", policy, 3); allowed {
+		t.Error("Expected a new key to start with only the initial tokens")
+	}
+	if allowed, _ := store.ConsumeTokens("burst_user", policy, 2); !allowed {
+		t.Error("Expected the initial tokens to be consumable")
+	}
+
+	// Without an initial count a new key starts with the full burst
+	policy.InitialTokens = nil
+	if allowed, _ := store.ConsumeTokens("burst_user_2", policy, 500); !allowed {
+		t.Error("Expected a full burst of 500 to be allowed")
+	}
+}
+
+func TestMemoryStore_PriorityReserve(t *testing.T) {
+	store := newMemoryStore(
+		newBoundedStore[*tokenBucket](0, 0, 0),
+		newBoundedStore[*leakyBucket](0, 0, 0),
+	)
+
+	// The last 20% is for critical traffic, background may only use the first half
+	policy := models.RateLimitConfig{
+		Capacity:   10,
+		RefillRate: time.Hour,
+		Reserve:    map[string]float64{models.PriorityNormal: 0.2, models.PriorityBackground: 0.5},
+	}
+	at := func(priority string) models.RateLimitConfig {
+		p := policy
+		p.Priority = priority
+		return p
+	}
+
+	for _, algorithm := range []string{"token_bucket", "leaky_bucket"} {
+		t.Run(algorithm, func(t *testing.T) {
+			key := "priority_" + algorithm
+			consume := func(priority string, tokens int64) bool {
+				allowed, _ := evaluate(store, key, at(priority), tokens, algorithm)
+				return allowed
+			}
+
+			if !consume(models.PriorityBackground, 5) {
+				t.Fatal("Expected background traffic to use the first half of the bucket")
+			}
+			if consume(models.PriorityBackground, 1) {
+				t.Error("Expected background traffic to be throttled first")
+			}
+			if !consume("", 3) {
+				t.Fatal("Expected normal traffic to use up to 80% of the bucket")
+			}
+			if consume(models.PriorityNormal, 1) {
+				t.Error("Expected normal traffic to be kept out of the critical reserve")
+			}
+			if !consume(models.PriorityCritical, 2) {
+				t.Error("Expected critical traffic to use the reserve")
+			}
+			if consume(models.PriorityCritical, 1) {
+				t.Error("Expected an empty bucket to reject critical traffic too")
+			}
+		})
+	}
+
+	// Every level of a hierarchy keeps its reserve
+	levels := []QuotaLevel{{Key: "user", Policy: at(models.PriorityNormal)}, {Key: "team", Policy: at(models.PriorityNormal)}}
+	if allowed, _ := store.ConsumeHierarchy(levels, 9); allowed {
+		t.Error("Expected the hierarchy to keep the critical reserve")
+	}
+	if allowed, _ := store.ConsumeHierarchy(withPriority(levels, models.PriorityCritical), 9); !allowed {
+		t.Error("Expected critical traffic to use the hierarchy's reserve")
+	}
+}
+
+func TestMemoryStore_TokenDebt(t *testing.T) {
+	store := newMemoryStore(
+		newBoundedStore[*tokenBucket](0, 0, 0),
+		newBoundedStore[*leakyBucket](0, 0, 0),
+	)
+	policy := models.RateLimitConfig{Capacity: 10, RefillRate: 10 * time.Millisecond, Debt: 5}
+
+	if allowed, _ := store.ConsumeTokens("uploader", policy, 16); allowed {
+		t.Error("Expected a request beyond the debt limit to be rejected")
+	}
+	if allowed, _ := store.ConsumeTokens("uploader", policy, 14); !allowed {
+		t.Fatal("Expected the request to borrow 4 tokens")
+	}
+
+	status, _ := store.TokenBucketStatus("uploader", policy)
+	if status.Level != -4 {
+		t.Errorf("Expected a debt of 4 tokens, got a level of %d", status.Level)
+	}
+
+	// Nothing is admitted until refills have repaid the debt
+	if allowed, _ := store.ConsumeTokens("uploader", policy, 1); allowed {
+		t.Error("Expected a key in debt to be rejected")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if allowed, _ := store.ConsumeTokens("uploader", policy, 1); !allowed {
+		t.Error("Expected the key to borrow again once the debt is repaid")
+	}
+
+	// Borrowing never eats into a priority reserve
+	policy.Reserve = map[string]float64{models.PriorityNormal: 0.2}
+	if floor := policy.TokenFloor(); floor != 2 {
+		t.Errorf("Expected the reserve to win over the debt limit, got a floor of %d", floor)
+	}
+}
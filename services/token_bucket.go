@@ -2,7 +2,8 @@ package services
 
 import (
 	"context"
-	"encoding/json"
+	"fmt"
+	"math"
 	"sync"
 	"time"
 
@@ -11,180 +12,253 @@ import (
 
 // tokenBucket represents a token bucket for a specific key (private struct)
 type tokenBucket struct {
-	capacity   int64         // Maximum number of tokens
-	tokens     int64         // Current number of tokens
-	refillRate time.Duration // How often to add tokens
-	lastRefill time.Time     // Last time bucket was refilled
-	mutex      sync.RWMutex  // Thread safety
+	capacity     int64         // Maximum number of tokens
+	tokens       float64       // Current number of tokens (keeps the fraction between refills)
+	refillRate   time.Duration // Refill interval
+	refillTokens float64       // Tokens added per refill interval (may be fractional)
+	lastRefill   time.Time     // Last time bucket was refilled
+	mutex        sync.RWMutex  // Thread safety
 }
 
 // TokenBucketRedis handles Redis-based token bucket operations
 type TokenBucketRedis struct {
-	client     *redis.Client
-	key        string
-	capacity   int64
-	refillRate time.Duration
+	client        *redis.Client
+	key           string
+	capacity      int64
+	refillRate    time.Duration
+	refillTokens  float64       // tokens added per refill interval
+	initialTokens int64         // tokens a new key starts with
+	floor         int64         // lowest level the request may leave: its priority reserve, or minus the debt limit
+	serverTime    bool          // use the Redis server clock instead of the local one
+	ttl           time.Duration // how long idle state is kept
+	usage         usageCounters // period counters charged with the tokens
 }
 
-// NewTokenBucket creates a new in-memory token bucket (fallback only)
+// tokenBucketLua is shared by the token bucket scripts.
+// Whole tokens are stored in "tokens" and the fraction in "token_millionths",
+// so both stay integers; refill is continuous at refill_tokens per refill_rate_us.
+const tokenBucketLua = `
+local function read_tokens(key)
+	local tokens, last_refill_us = read_bucket(key, 'tokens', 'last_refill_us')
+	if tokens == nil or last_refill_us == nil then
+		return nil, nil
+	end
+	local millionths = tonumber(redis.call('HGET', key, 'token_millionths')) or 0
+	return tokens + millionths / 1000000, last_refill_us
+end
+
+local function refill_tokens_at(tokens, last_refill_us, now_us, capacity, refill_rate_us, refill_tokens)
+	local time_passed_us = now_us - last_refill_us
+	if time_passed_us <= 0 then
+		return tokens, last_refill_us -- never refill backwards on a clock step
+	end
+	return math.min(capacity, tokens + time_passed_us * refill_tokens / refill_rate_us), now_us
+end
+
+local function write_tokens(key, capacity, tokens, refill_rate_us, refill_tokens, last_refill_us, now_us, ttl_ms)
+	local whole = math.floor(tokens)
+	redis.call('HSET', key,
+		'algorithm', 'token_bucket',
+		'capacity', int(capacity),
+		'tokens', int(whole),
+		'token_millionths', int(math.floor((tokens - whole) * 1000000)),
+		'refill_rate_us', int(refill_rate_us),
+		'refill_tokens', tostring(refill_tokens),
+		'last_refill_us', int(last_refill_us),
+		'last_updated', int(now_us))
+	redis.call('PEXPIRE', key, ttl_ms) -- Drop the state once it is idle for the policy TTL
+end
+`
+
+// tokenBucketConsumeScript atomically refills and consumes tokens down to the floor,
+// charging the period counters in KEYS[2] onwards (limits from ARGV[9]).
+// A bucket in debt (below zero) admits nothing until refills have repaid it.
+var tokenBucketConsumeScript = redis.NewScript(bucketStateLua + tokenBucketLua + usageLua + `
+local bucket_key = KEYS[1]
+local tokens_needed = tonumber(ARGV[1])
+local capacity = tonumber(ARGV[2])
+local refill_rate_us = tonumber(ARGV[3])
+local now_us = current_time_us(tonumber(ARGV[4]))
+local ttl_ms = tonumber(ARGV[5])
+local refill_tokens = tonumber(ARGV[6])
+local initial_tokens = tonumber(ARGV[7])
+local floor = tonumber(ARGV[8])
+
+-- Get current bucket data
+local current_tokens, last_refill_us = read_tokens(bucket_key)
+if current_tokens == nil then
+	-- New bucket, start with the policy's initial tokens (full by default)
+	current_tokens = initial_tokens
+	last_refill_us = now_us
+end
+
+-- Add tokens for the time elapsed, keeping the fraction
+current_tokens, last_refill_us = refill_tokens_at(current_tokens, last_refill_us, now_us, capacity, refill_rate_us, refill_tokens)
+
+-- Check if we can consume the requested tokens without going below the floor or past a period limit
+local allowed = 0
+if current_tokens >= 0 and current_tokens - tokens_needed >= floor and usage_allows(2, 9, tokens_needed) then
+	current_tokens = current_tokens - tokens_needed
+	usage_charge(2, 9, tokens_needed)
+	allowed = 1
+end
+
+-- Save state even if the request failed (for accurate timing)
+write_tokens(bucket_key, capacity, current_tokens, refill_rate_us, refill_tokens, last_refill_us, now_us, ttl_ms)
+
+return allowed
+`)
+
+// tokenBucketMergeScript folds locally consumed tokens into the Redis state
+var tokenBucketMergeScript = redis.NewScript(bucketStateLua + tokenBucketLua + `
+local bucket_key = KEYS[1]
+local local_tokens = tonumber(ARGV[1])
+local local_last_refill_us = tonumber(ARGV[2])
+local capacity = tonumber(ARGV[3])
+local refill_rate_us = tonumber(ARGV[4])
+local now_us = current_time_us(tonumber(ARGV[5]))
+local ttl_ms = tonumber(ARGV[6])
+local refill_tokens = tonumber(ARGV[7])
+
+local current_tokens = local_tokens
+local last_refill_us = local_last_refill_us
+
+local redis_tokens, redis_last_refill_us = read_tokens(bucket_key)
+if redis_tokens ~= nil then
+	-- Bring the Redis state up to date before comparing
+	redis_tokens, redis_last_refill_us = refill_tokens_at(redis_tokens, redis_last_refill_us, now_us, capacity, refill_rate_us, refill_tokens)
+
+	if redis_tokens < current_tokens then
+		current_tokens = redis_tokens
+		last_refill_us = redis_last_refill_us
+	end
+end
+
+write_tokens(bucket_key, capacity, current_tokens, refill_rate_us, refill_tokens, last_refill_us, now_us, ttl_ms)
+
+return math.floor(current_tokens)
+`)
+
+// NewTokenBucket creates a new in-memory token bucket adding one token per refill interval
 func NewTokenBucket(capacity int64, refillRate time.Duration) *tokenBucket {
 	return &tokenBucket{
-		capacity:   capacity,
-		tokens:     capacity, // Start with full bucket
-		refillRate: refillRate,
-		lastRefill: time.Now(),
+		capacity:     capacity,
+		tokens:       float64(capacity), // Start with full bucket
+		refillRate:   refillRate,
+		refillTokens: 1,
+		lastRefill:   time.Now(),
 	}
 }
 
-// NewTokenBucketRedis creates a new Redis-based token bucket
+// restoreTokenBucket recreates an in-memory token bucket from persisted state
+func restoreTokenBucket(capacity int64, refillRate time.Duration, refillTokens float64, tokens float64, lastRefill time.Time) *tokenBucket {
+	if refillTokens <= 0 {
+		refillTokens = 1
+	}
+
+	return &tokenBucket{
+		capacity:     capacity,
+		tokens:       math.Min(float64(capacity), tokens),
+		refillRate:   refillRate,
+		refillTokens: refillTokens,
+		lastRefill:   lastRefill,
+	}
+}
+
+// NewTokenBucketRedis creates a new Redis-based token bucket adding one token per refill interval
 func NewTokenBucketRedis(client *redis.Client, key string, capacity int64, refillRate time.Duration) *TokenBucketRedis {
 	return &TokenBucketRedis{
-		client:     client,
-		key:        "rate_limit:token_bucket:" + key,
-		capacity:   capacity,
-		refillRate: refillRate,
+		client:        client,
+		key:           "rate_limit:token_bucket:" + key,
+		capacity:      capacity,
+		refillRate:    refillRate,
+		refillTokens:  1,
+		initialTokens: capacity,
+		ttl:           recoveryTime(capacity, refillRate, 1),
 	}
 }
 
-// TryConsume attempts to consume tokens from Redis-based token bucket
-func (tbr *TokenBucketRedis) TryConsume(tokens int64) bool {
+// TryConsume attempts to consume tokens from Redis-based token bucket.
+// The error is non-nil only when Redis could not make a decision.
+func (tbr *TokenBucketRedis) TryConsume(tokens int64) (bool, error) {
 	if tokens < 0 {
-		return false
+		return false, nil
 	}
 
 	ctx := context.Background()
 
-	// Redis Lua script for atomic token bucket operations
-	luaScript := `
-		local bucket_key = KEYS[1]
-		local tokens_needed = tonumber(ARGV[1])
-		local capacity = tonumber(ARGV[2])
-		local refill_rate_ns = tonumber(ARGV[3])
-		local now_ns = tonumber(ARGV[4])
-		
-		-- Get current bucket data
-		local bucket_data = redis.call('GET', bucket_key)
-		local current_tokens, last_refill_ns
-		
-		if bucket_data then
-			local data = cjson.decode(bucket_data)
-			current_tokens = data.tokens
-			last_refill_ns = data.last_refill_ns
-		else
-			-- New bucket, start with full capacity
-			current_tokens = capacity
-			last_refill_ns = now_ns
-		end
-		
-		-- Calculate tokens to add based on time elapsed
-		local time_passed_ns = now_ns - last_refill_ns
-		local tokens_to_add = math.floor(time_passed_ns / refill_rate_ns)
-		
-		if tokens_to_add > 0 then
-			current_tokens = math.min(capacity, current_tokens + tokens_to_add)
-			last_refill_ns = last_refill_ns + (tokens_to_add * refill_rate_ns)
-		end
-		
-		-- Check if we can consume the requested tokens
-		if current_tokens >= tokens_needed then
-			current_tokens = current_tokens - tokens_needed
-			
-			-- Save updated bucket data
-			local updated_data = {
-				algorithm = "token_bucket",
-				capacity = capacity,
-				tokens = current_tokens,
-				refill_rate_ns = refill_rate_ns,
-				last_refill_ns = last_refill_ns,
-				last_updated = now_ns
-			}
-			
-			redis.call('SET', bucket_key, cjson.encode(updated_data))
-			redis.call('EXPIRE', bucket_key, 3600) -- Expire in 1 hour if unused
-			
-			return 1 -- Success
-		else
-			-- Save current state even if request failed (for accurate timing)
-			local updated_data = {
-				algorithm = "token_bucket",
-				capacity = capacity,
-				tokens = current_tokens,
-				refill_rate_ns = refill_rate_ns,
-				last_refill_ns = last_refill_ns,
-				last_updated = now_ns
-			}
-			
-			redis.call('SET', bucket_key, cjson.encode(updated_data))
-			redis.call('EXPIRE', bucket_key, 3600)
-			
-			return 0 -- Failed
-		end
-	`
-
-	// Execute the Lua script
-	refillRate := tbr.refillRate.Nanoseconds()
-	now := time.Now().UnixNano()
-
-	result, err := tbr.client.Eval(ctx, luaScript, []string{tbr.key}, tokens, tbr.capacity, refillRate, now).Result()
+	// EVALSHA the preloaded script; go-redis falls back to EVAL (which reloads it) on NOSCRIPT
+	refillRate := scriptRate(tbr.refillRate)
+	now := scriptNow(tbr.serverTime)
+
+	keys := append([]string{tbr.key}, tbr.usage.keys...)
+	args := append([]interface{}{tokens, tbr.capacity, refillRate, now, tbr.ttl.Milliseconds(), tbr.refillTokens, tbr.initialTokens, tbr.floor}, tbr.usage.args...)
+	result, err := tokenBucketConsumeScript.Run(ctx, tbr.client, keys, args...).Int64()
 
 	if err != nil {
-		return false
+		return false, fmt.Errorf("token bucket eval failed for %s: %w", tbr.key, err)
 	}
 
-	return result.(int64) == 1
+	return result == 1, nil
 }
 
-// GetStatus returns current status from Redis
-func (tbr *TokenBucketRedis) GetStatus() (tokensLeft int64, capacity int64, nextRefill time.Time) {
+// MergeLocal folds tokens consumed locally during an outage into the Redis state.
+// The lower of the two remaining token counts wins so recovery never grants a free burst.
+func (tbr *TokenBucketRedis) MergeLocal(localTokens float64, localLastRefill time.Time) (int64, error) {
 	ctx := context.Background()
 
-	bucketData, err := tbr.client.Get(ctx, tbr.key).Result()
+	result, err := tokenBucketMergeScript.Run(ctx, tbr.client, []string{tbr.key},
+		localTokens, localLastRefill.UnixMicro(), tbr.capacity, scriptRate(tbr.refillRate),
+		scriptNow(tbr.serverTime), tbr.ttl.Milliseconds(), tbr.refillTokens).Int64()
 	if err != nil {
-		// No data in Redis, return default values
-		return tbr.capacity, tbr.capacity, time.Now().Add(tbr.refillRate)
-	}
-
-	// Parse bucket data
-	var data struct {
-		Algorithm    string  `json:"algorithm"`
-		Capacity     int64   `json:"capacity"`
-		Tokens       int64   `json:"tokens"`
-		RefillRateNs int64   `json:"refill_rate_ns"`
-		LastRefillNs float64 `json:"last_refill_ns"`
-		LastUpdated  float64 `json:"last_updated"`
+		return 0, fmt.Errorf("token bucket merge failed for %s: %w", tbr.key, err)
 	}
 
-	if err := json.Unmarshal([]byte(bucketData), &data); err != nil {
-		return tbr.capacity, tbr.capacity, time.Now().Add(tbr.refillRate)
-	}
+	return result, nil
+}
 
-	// Calculate current tokens (simulate refill)
-	now := time.Now()
-	lastRefillNs := int64(data.LastRefillNs)
-	timePassed := now.UnixNano() - lastRefillNs
-	tokensToAdd := timePassed / data.RefillRateNs
-	currentTokens := data.Tokens + tokensToAdd
+// GetStatus returns current status from Redis
+func (tbr *TokenBucketRedis) GetStatus() (tokensLeft int64, capacity int64, nextRefill time.Time) {
+	ctx := context.Background()
 
-	if currentTokens > data.Capacity {
-		currentTokens = data.Capacity
+	data, exists, err := readBucketState(ctx, tbr.client, tbr.key, tokenBucketFields)
+	if err != nil || !exists || data.Rate <= 0 {
+		// No data in Redis, return default values
+		return tbr.initialTokens, tbr.capacity, time.Now().Add(tokenInterval(tbr.refillRate, tbr.refillTokens))
 	}
 
-	nextRefillTime := time.Unix(0, lastRefillNs).Add(time.Duration(data.RefillRateNs))
+	// Calculate current tokens (simulate refill) on the same clock as the script
+	now := redisNow(ctx, tbr.client, tbr.serverTime)
+	tokens := float64(data.Level) + data.Fraction
+	if timePassed := now.Sub(data.Last); timePassed > 0 {
+		tokens = math.Min(float64(data.Capacity), tokens+float64(timePassed)*tbr.refillTokens/float64(data.Rate))
+	}
 
-	return currentTokens, data.Capacity, nextRefillTime
+	return int64(math.Floor(tokens)), data.Capacity, nextTokenAt(now, tokens, data.Rate, tbr.refillTokens)
 }
 
 // HasState checks if this token bucket has state in Redis
 func (tbr *TokenBucketRedis) HasState() bool {
 	ctx := context.Background()
-	_, err := tbr.client.Get(ctx, tbr.key).Result()
-	return err == nil
+	count, err := tbr.client.Exists(ctx, tbr.key).Result()
+	return err == nil && count > 0
+}
+
+// ExpiresAt returns when the idle state expires in Redis (zero if there is no state)
+func (tbr *TokenBucketRedis) ExpiresAt() time.Time {
+	return keyExpiresAt(context.Background(), tbr.client, tbr.key)
 }
 
 // ===== IN-MEMORY TOKEN BUCKET (FALLBACK ONLY) =====
 
 // TryConsume attempts to consume the specified number of tokens (in-memory)
 func (tb *tokenBucket) TryConsume(tokens int64) bool {
+	return tb.tryConsume(tokens, 0)
+}
+
+// tryConsume consumes tokens only if the bucket is not in debt and at least floor
+// tokens (negative when borrowing) remain afterwards (in-memory)
+func (tb *tokenBucket) tryConsume(tokens int64, floor int64) bool {
 	// Add this validation at the beginning
 	if tokens < 0 {
 		return false // Reject negative token requests
@@ -196,9 +270,9 @@ func (tb *tokenBucket) TryConsume(tokens int64) bool {
 	// First, refill the bucket based on time elapsed
 	tb.refill()
 
-	// Check if we have enough tokens
-	if tb.tokens >= tokens {
-		tb.tokens -= tokens
+	// Check if we have enough tokens above the floor
+	if tb.tokens >= 0 && tb.tokens-float64(tokens) >= float64(floor) {
+		tb.tokens -= float64(tokens)
 		return true
 	}
 
@@ -207,31 +281,94 @@ func (tb *tokenBucket) TryConsume(tokens int64) bool {
 
 // GetStatus returns current status of the bucket (in-memory)
 func (tb *tokenBucket) GetStatus() (tokensLeft int64, capacity int64, nextRefill time.Time) {
-	tb.mutex.RLock()
-	defer tb.mutex.RUnlock()
+	tb.mutex.Lock() // refill mutates the bucket
+	defer tb.mutex.Unlock()
 
 	// Refill before returning status
 	tb.refill()
 
-	return tb.tokens, tb.capacity, tb.lastRefill.Add(tb.refillRate)
+	return int64(math.Floor(tb.tokens)), tb.capacity, nextTokenAt(tb.lastRefill, tb.tokens, tb.refillRate, tb.refillTokens)
 }
 
-// refill adds tokens to the bucket based on elapsed time
+// setLimits resizes the bucket and changes its refill interval, refilling at the old rate first (in-memory)
+func (tb *tokenBucket) setLimits(capacity int64, refillRate time.Duration) {
+	tb.mutex.Lock()
+	defer tb.mutex.Unlock()
+
+	if capacity == tb.capacity && refillRate == tb.refillRate {
+		return
+	}
+
+	tb.refill()
+	tb.capacity = capacity
+	tb.refillRate = refillRate
+	tb.tokens = math.Min(float64(capacity), tb.tokens)
+}
+
+// refund gives back tokens taken by a request another level rejected, up to the capacity (in-memory)
+func (tb *tokenBucket) refund(tokens int64) {
+	tb.mutex.Lock()
+	defer tb.mutex.Unlock()
+
+	tb.refill()
+	tb.tokens = math.Min(float64(tb.capacity), tb.tokens+float64(tokens))
+}
+
+// recovered reports whether the bucket has refilled to its capacity, so dropping it
+// changes nothing for the key (in-memory)
+func (tb *tokenBucket) recovered() bool {
+	tb.mutex.Lock()
+	defer tb.mutex.Unlock()
+
+	tb.refill()
+	return tb.tokens >= float64(tb.capacity)
+}
+
+// snapshot returns the refilled token count and refill timestamp (in-memory)
+func (tb *tokenBucket) snapshot() (tokens float64, lastRefill time.Time) {
+	tb.mutex.Lock()
+	defer tb.mutex.Unlock()
+
+	tb.refill()
+
+	return tb.tokens, tb.lastRefill
+}
+
+// limits returns the bucket's current size and refill interval (in-memory)
+func (tb *tokenBucket) limits() (capacity int64, refillRate time.Duration) {
+	tb.mutex.Lock()
+	defer tb.mutex.Unlock()
+
+	return tb.capacity, tb.refillRate
+}
+
+// refill adds tokens to the bucket based on elapsed time, keeping the fraction
 // Note: This method assumes the caller already holds the lock
 func (tb *tokenBucket) refill() {
 	now := time.Now()
 	elapsed := now.Sub(tb.lastRefill)
 
-	refillPeriods := elapsed.Nanoseconds() / tb.refillRate.Nanoseconds()
+	if elapsed <= 0 {
+		return
+	}
 
-	if refillPeriods > 0 {
-		// Add tokens (1 token per refill period)
-		tokensToAdd := refillPeriods
-		tb.tokens = min(tb.capacity, tb.tokens+tokensToAdd)
+	added := float64(elapsed) * tb.refillTokens / float64(tb.refillRate)
+	tb.tokens = math.Min(float64(tb.capacity), tb.tokens+added)
+	tb.lastRefill = now
+}
 
-		actualTimeProcessed := time.Duration(refillPeriods) * tb.refillRate
-		tb.lastRefill = tb.lastRefill.Add(actualTimeProcessed)
+// tokenInterval is the time it takes to add one whole token
+func tokenInterval(refillRate time.Duration, refillTokens float64) time.Duration {
+	if refillTokens <= 0 {
+		return refillRate
 	}
+	return time.Duration(float64(refillRate) / refillTokens)
+}
+
+// nextTokenAt returns when the next whole token is added, given the tokens at a point in time
+func nextTokenAt(at time.Time, tokens float64, refillRate time.Duration, refillTokens float64) time.Time {
+	missing := 1 - (tokens - math.Floor(tokens))
+	return at.Add(time.Duration(missing * float64(tokenInterval(refillRate, refillTokens))))
 }
 
 // min helper function
@@ -354,3 +354,40 @@ func BenchmarkTokenBucket_Concurrent(b *testing.B) {
 		}
 	})
 }
+
+// TestTokenBucket_FractionalRefill tests rates below one token per interval
+func TestTokenBucket_FractionalRefill(t *testing.T) {
+	// 0.5 tokens per second, empty 3 seconds ago
+	bucket := restoreTokenBucket(10, time.Second, 0.5, 0, time.Now().Add(-3*time.Second))
+
+	tokensLeft, _, _ := bucket.GetStatus()
+	if tokensLeft != 1 {
+		t.Errorf("Expected 1 whole token after 1.5 refilled, got %d", tokensLeft)
+	}
+
+	if !bucket.TryConsume(1) {
+		t.Error("Expected to consume the whole token")
+	}
+	if bucket.TryConsume(1) {
+		t.Error("Expected the remaining half token not to be consumable")
+	}
+
+	tokens, _ := bucket.snapshot()
+	if tokens < 0.5 || tokens > 0.6 {
+		t.Errorf("Expected the half token to be kept, got %f", tokens)
+	}
+}
+
+// TestTokenBucket_MultiTokenRefill tests rates of many tokens per interval
+func TestTokenBucket_MultiTokenRefill(t *testing.T) {
+	// 1000 tokens per minute, empty 3 seconds ago
+	bucket := restoreTokenBucket(1000, time.Minute, 1000, 0, time.Now().Add(-3*time.Second))
+
+	tokensLeft, _, nextRefill := bucket.GetStatus()
+	if tokensLeft != 50 {
+		t.Errorf("Expected 50 tokens after 3s at 1000/min, got %d", tokensLeft)
+	}
+	if wait := time.Until(nextRefill); wait > 60*time.Millisecond {
+		t.Errorf("Expected next token within 60ms, got %v", wait)
+	}
+}
@@ -0,0 +1,171 @@
+package services
+
+import (
+	"time"
+
+	"github.com/Appy29/rate-limiter/models"
+)
+
+// Long-horizon quotas count the tokens a key uses per calendar window (UTC day or
+// month). Counters are kept for usageRetention after their window ends so past
+// periods can still be billed, independent of the bucket state TTL.
+// Every store checks and charges the counters in the same atomic step as the bucket
+// they limit: a request is only counted when admitted, and concurrent requests never
+// see each other's tentative charges. In Redis the counters therefore live on the
+// bucket's shard.
+
+const usageRetention = 400 * 24 * time.Hour
+
+// UsageWindow is one period counter of a key
+type UsageWindow struct {
+	ID      string    // period and window start, e.g. "month:2026-10"
+	Limit   int64     // enforced limit (0 = not enforced)
+	ResetAt time.Time // end of the window
+}
+
+// expireAt is when the counter can be dropped
+func (uw UsageWindow) expireAt() time.Time {
+	return uw.ResetAt.Add(usageRetention)
+}
+
+// usageCounter is an in-memory period counter
+type usageCounter struct {
+	value    int64
+	expireAt time.Time
+}
+
+// usageLua is shared by the scripts that charge period counters with their bucket.
+// The counters are KEYS[first_key] onwards, with a limit and an expire_at_ms for each
+// in ARGV from first_arg on. usage_allows checks that no enforced limit would be
+// exceeded; usage_charge adds the tokens (negative tokens refund).
+const usageLua = `
+local function usage_allows(first_key, first_arg, tokens)
+	for i = first_key, #KEYS do
+		local limit = tonumber(ARGV[first_arg + (i - first_key) * 2])
+		if tokens > 0 and limit > 0 and (tonumber(redis.call('GET', KEYS[i])) or 0) + tokens > limit then
+			return false
+		end
+	end
+	return true
+end
+
+local function usage_charge(first_key, first_arg, tokens)
+	for i = first_key, #KEYS do
+		redis.call('INCRBY', KEYS[i], tokens)
+		redis.call('PEXPIREAT', KEYS[i], ARGV[first_arg + (i - first_key) * 2 + 1])
+	end
+end
+`
+
+// usageCounters are the Redis period counters a script charges along with its bucket
+type usageCounters struct {
+	keys []string
+	args []interface{} // limit and expire_at_ms per key
+}
+
+// add appends the key's counters for the policy's current windows
+func (uc *usageCounters) add(key string, policy models.RateLimitConfig) {
+	for _, window := range usageWindows(policy, time.Now()) {
+		uc.keys = append(uc.keys, "rate_limit:"+usageCounterKey(key, window.ID))
+		uc.args = append(uc.args, window.Limit, window.expireAt().UnixMilli())
+	}
+}
+
+// levelUsage returns the counters of the given levels
+func levelUsage(levels ...QuotaLevel) usageCounters {
+	var counters usageCounters
+	for _, level := range levels {
+		counters.add(level.Key, level.Policy)
+	}
+	return counters
+}
+
+// periodWindow returns the calendar window of the period containing t (UTC)
+func periodWindow(period string, t time.Time) (id string, start time.Time, reset time.Time, ok bool) {
+	t = t.UTC()
+
+	switch period {
+	case models.PeriodDay:
+		start = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+		return period + ":" + start.Format("2006-01-02"), start, start.AddDate(0, 0, 1), true
+	case models.PeriodMonth:
+		start = time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+		return period + ":" + start.Format("2006-01"), start, start.AddDate(0, 1, 0), true
+	default:
+		return "", time.Time{}, time.Time{}, false
+	}
+}
+
+// usageWindows returns the policy's period counters at time t
+func usageWindows(policy models.RateLimitConfig, t time.Time) []UsageWindow {
+	var windows []UsageWindow
+
+	for _, quota := range policy.Periods {
+		id, _, reset, ok := periodWindow(quota.Period, t)
+		if !ok {
+			continue
+		}
+
+		window := UsageWindow{ID: id, ResetAt: reset}
+		if !quota.Overage {
+			window.Limit = quota.Limit
+		}
+		windows = append(windows, window)
+	}
+
+	return windows
+}
+
+// usageCounterKey names a key's counter for one window
+func usageCounterKey(key string, windowID string) string {
+	return "usage:" + key + ":" + windowID
+}
+
+// GetUsage reports the usage of every key in the period windows containing at
+func (rrs *RedisRateLimiterService) GetUsage(keys []string, at time.Time) ([]models.PeriodUsage, error) {
+	var usage []models.PeriodUsage
+
+	for _, level := range rrs.quotaLevels(keys) {
+		windows := usageWindows(level.Policy, at)
+		if len(windows) == 0 {
+			continue
+		}
+
+		consumed, err := rrs.store.Usage(level, windows)
+		if err != nil {
+			return nil, err
+		}
+
+		next := 0
+		for _, quota := range level.Policy.Periods {
+			_, start, reset, ok := periodWindow(quota.Period, at)
+			if !ok {
+				continue
+			}
+			usage = append(usage, periodUsage(level.Key, quota, start, reset, consumed[next]))
+			next++
+		}
+	}
+
+	return usage, nil
+}
+
+// periodUsage builds the API view of one counter
+func periodUsage(key string, quota models.PeriodQuota, start time.Time, reset time.Time, consumed int64) models.PeriodUsage {
+	usage := models.PeriodUsage{
+		Key:      key,
+		Period:   quota.Period,
+		Start:    start,
+		ResetAt:  reset,
+		Consumed: consumed,
+	}
+
+	if quota.Limit > 0 {
+		remaining := max(0, quota.Limit-consumed)
+		usage.Limit = quota.Limit
+		usage.Remaining = &remaining
+		usage.Overage = max(0, consumed-quota.Limit)
+	}
+
+	return usage
+}
@@ -0,0 +1,139 @@
+package services
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Appy29/rate-limiter/models"
+)
+
+func TestPeriodWindow(t *testing.T) {
+	at := time.Date(2026, 12, 31, 23, 30, 0, 0, time.FixedZone("UTC+2", 2*60*60))
+
+	id, start, reset, _ := periodWindow(models.PeriodDay, at)
+	if id != "day:2026-12-31" || !start.Equal(time.Date(2026, 12, 31, 0, 0, 0, 0, time.UTC)) || !reset.Equal(time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Unexpected day window %s [%v, %v)", id, start, reset)
+	}
+
+	id, start, reset, _ = periodWindow(models.PeriodMonth, at)
+	if id != "month:2026-12" || !start.Equal(time.Date(2026, 12, 1, 0, 0, 0, 0, time.UTC)) || !reset.Equal(time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Unexpected month window %s [%v, %v)", id, start, reset)
+	}
+
+	if _, _, _, ok := periodWindow("fortnight", at); ok {
+		t.Error("Expected an unknown period to be rejected")
+	}
+}
+
+func TestMemoryStore_ChargesUsageWithBucket(t *testing.T) {
+	store := newMemoryStore(newBoundedStore[*tokenBucket](0, 0, 0), newBoundedStore[*leakyBucket](0, 0, 0))
+	policy := models.RateLimitConfig{
+		Capacity:   8,
+		RefillRate: time.Hour,
+		Periods:    []models.PeriodQuota{{Period: models.PeriodMonth, Limit: 10}, {Period: models.PeriodDay}},
+	}
+
+	if allowed, _ := store.ConsumeTokens("billing_user", policy, 6); !allowed {
+		t.Fatal("Expected usage within the monthly limit to be allowed")
+	}
+	if allowed, _ := store.ConsumeTokens("billing_user", policy, 3); allowed {
+		t.Fatal("Expected the bucket's rejection to be returned")
+	}
+	if allowed, _ := store.AddRequests("billing_user", policy, 5); allowed {
+		t.Error("Expected usage beyond the monthly limit to be rejected")
+	}
+
+	windows := usageWindows(policy, time.Now())
+	counts, _ := store.Usage(QuotaLevel{Key: "billing_user", Policy: policy}, windows)
+	if counts[0] != 6 || counts[1] != 6 {
+		t.Errorf("Expected only the admitted 6 tokens to be recorded, got %v", counts)
+	}
+	if status, _ := store.LeakyBucketStatus("billing_user", policy); status.HasState {
+		t.Error("Expected the leaky bucket not to be touched when the period limit rejects")
+	}
+}
+
+func TestRedisStore_ChargesUsageInTheBucketScript(t *testing.T) {
+	_, store := newTestRedisStore(t)
+	policy := models.RateLimitConfig{
+		Capacity:   8,
+		RefillRate: time.Hour,
+		Periods:    []models.PeriodQuota{{Period: models.PeriodMonth, Limit: 10}},
+	}
+	level := QuotaLevel{Key: "billing_user", Policy: policy}
+	windows := usageWindows(policy, time.Now())
+
+	if allowed, err := store.ConsumeTokens("billing_user", policy, 6); !allowed || err != nil {
+		t.Fatalf("Expected usage within the monthly limit to be allowed, got %v (%v)", allowed, err)
+	}
+	// Rejected by the bucket: nothing is charged, so there is nothing to refund
+	if allowed, _ := store.ConsumeTokens("billing_user", policy, 3); allowed {
+		t.Fatal("Expected the bucket to reject")
+	}
+	if counts, _ := store.Usage(level, windows); counts[0] != 6 {
+		t.Errorf("Expected 6 tokens charged, got %d", counts[0])
+	}
+
+	// Rejected by the period limit: the bucket keeps its tokens
+	if allowed, _ := store.AddRequests("billing_user", policy, 5); allowed {
+		t.Error("Expected usage beyond the monthly limit to be rejected")
+	}
+	if status, _ := store.LeakyBucketStatus("billing_user", policy); status.Level != 0 {
+		t.Errorf("Expected nothing queued after the period limit rejected, got %d", status.Level)
+	}
+
+	// The hierarchy charges the same counters, in its own script
+	policy.Capacity = 100
+	member := QuotaLevel{Key: "billing_member", Policy: policy}
+	if allowed, _ := store.ConsumeTokens(member.Key, member.Policy, 6); !allowed {
+		t.Fatal("Expected usage within the monthly limit to be allowed")
+	}
+	hierarchy := []QuotaLevel{member, {Key: "org:billing", Policy: models.RateLimitConfig{Capacity: 100, RefillRate: time.Hour}, Enclosing: true}}
+	if allowed, _ := store.ConsumeHierarchy(hierarchy, 4); !allowed {
+		t.Error("Expected the hierarchy to use the last 4 tokens of the month")
+	}
+	if allowed, _ := store.ConsumeHierarchy(hierarchy, 1); allowed {
+		t.Error("Expected the hierarchy to be held to the monthly limit")
+	}
+	if counts, _ := store.Usage(member, windows); counts[0] != 10 {
+		t.Errorf("Expected the full 10 tokens charged, got %d", counts[0])
+	}
+}
+
+func TestPeriodUsage_Overage(t *testing.T) {
+	usage := periodUsage("billing_user", models.PeriodQuota{Period: models.PeriodMonth, Limit: 100, Overage: true}, time.Time{}, time.Time{}, 130)
+
+	if usage.Remaining == nil || *usage.Remaining != 0 || usage.Overage != 30 {
+		t.Errorf("Expected 0 remaining and 30 overage, got %+v", usage)
+	}
+}
+
+func TestRedisStore_HierarchyRefundUnchargesUsage(t *testing.T) {
+	_, store := newTestRedisShards(t, 2)
+
+	// A user and an org that live on different shards
+	org := "org:0"
+	for i := 1; store.manager.GetClientIndex(org) == store.manager.GetClientIndex("billing_user"); i++ {
+		org = "org:" + strconv.Itoa(i)
+	}
+
+	user := QuotaLevel{Key: "billing_user", Policy: models.RateLimitConfig{
+		Capacity:   100,
+		RefillRate: time.Hour,
+		Periods:    []models.PeriodQuota{{Period: models.PeriodMonth, Limit: 100}},
+	}}
+	levels := []QuotaLevel{user, {Key: org, Policy: models.RateLimitConfig{Capacity: 5, RefillRate: time.Hour}}}
+
+	if allowed, _ := store.ConsumeHierarchy(levels, 4); !allowed {
+		t.Fatal("Expected the first request to be allowed")
+	}
+	if allowed, _ := store.ConsumeHierarchy(levels, 4); allowed {
+		t.Fatal("Expected the org to reject")
+	}
+
+	counts, _ := store.Usage(user, usageWindows(user.Policy, time.Now()))
+	if counts[0] != 4 {
+		t.Errorf("Expected the rejected request's usage to be refunded, got %d", counts[0])
+	}
+}
@@ -0,0 +1,67 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Appy29/rate-limiter/models"
+)
+
+// MaxBodyBytes is the largest request body the JSON endpoints read
+const MaxBodyBytes = 64 << 10
+
+// DecodeJSON decodes a JSON request body into v. The body must be declared as
+// application/json, be at most MaxBodyBytes long, hold exactly one JSON value and
+// only use fields v has. Errors are *models.ValidationError; send them with
+// SendValidationError.
+func DecodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		return &models.ValidationError{
+			Status:  http.StatusUnsupportedMediaType,
+			Code:    models.ErrorCodeUnsupportedMediaType,
+			Message: "Content-Type must be application/json",
+		}
+	}
+
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, MaxBodyBytes))
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(v); err != nil {
+		return decodeError(err)
+	}
+	// Anything after the value, even a second valid one, is rejected
+	if _, err := decoder.Token(); err != io.EOF {
+		if err != nil {
+			return decodeError(err)
+		}
+		return &models.ValidationError{Code: models.ErrorCodeInvalidJSON, Message: "Request body must contain a single JSON value"}
+	}
+	return nil
+}
+
+// decodeError turns a failed decode into a validation error
+func decodeError(err error) error {
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		return &models.ValidationError{
+			Status:  http.StatusRequestEntityTooLarge,
+			Code:    models.ErrorCodeBodyTooLarge,
+			Message: "Request body must not exceed " + strconv.FormatInt(tooLarge.Limit, 10) + " bytes",
+		}
+	case errors.Is(err, io.EOF):
+		return &models.ValidationError{Code: models.ErrorCodeInvalidJSON, Message: "Request body is empty"}
+	}
+
+	// encoding/json has no error type for unknown fields
+	if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		return &models.ValidationError{Code: models.ErrorCodeUnknownField, Message: "unknown field " + field}
+	}
+	return &models.ValidationError{Code: models.ErrorCodeInvalidJSON, Message: "Invalid JSON body: " + err.Error()}
+}
@@ -2,7 +2,11 @@ package utils
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/Appy29/rate-limiter/models"
 )
@@ -14,34 +18,97 @@ func SendJSON(w http.ResponseWriter, status int, data interface{}) {
 	json.NewEncoder(w).Encode(data)
 }
 
-// SendError sends an error response
+// SendError sends an error response, coded after the status (e.g. "method_not_allowed")
 func SendError(w http.ResponseWriter, status int, message string) {
+	SendErrorCode(w, status, strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_"), message)
+}
+
+// SendErrorCode sends an error response with a machine-readable error code
+func SendErrorCode(w http.ResponseWriter, status int, code string, message string) {
 	SendJSON(w, status, models.ErrorResponse{
-		Error:   http.StatusText(status),
-		Code:    status,
-		Message: message,
+		Error:     http.StatusText(status),
+		Code:      status,
+		ErrorCode: code,
+		Message:   message,
 	})
 }
 
+// SendValidationError sends a rejected request's status (400 unless it says otherwise),
+// coded after a *models.ValidationError
+func SendValidationError(w http.ResponseWriter, err error) {
+	var verr *models.ValidationError
+	if errors.As(err, &verr) {
+		status := verr.Status
+		if status == 0 {
+			status = http.StatusBadRequest
+		}
+		SendErrorCode(w, status, verr.Code, verr.Message)
+		return
+	}
+	SendError(w, http.StatusBadRequest, err.Error())
+}
+
+// DegradedHeader is set on acquire responses decided without the rate limiter backend
+const DegradedHeader = "X-RateLimit-Degraded"
+
 // SendSuccess sends a success response for acquire
-func SendAcquireSuccess(w http.ResponseWriter) {
+func SendAcquireSuccess(w http.ResponseWriter, degraded bool) {
+	markDegraded(w, degraded)
 	SendJSON(w, http.StatusOK, models.AcquireResponse{
-		Allowed: true,
-		Message: "Request allowed",
+		Allowed:  true,
+		Message:  "Request allowed",
+		Degraded: degraded,
+	})
+}
+
+// SendAcquireScheduled sends a success response for a shaped request with its start time
+func SendAcquireScheduled(w http.ResponseWriter, scheduledAt time.Time, degraded bool) {
+	markDegraded(w, degraded)
+
+	delayMs := time.Until(scheduledAt).Milliseconds()
+	if delayMs < 0 {
+		delayMs = 0
+	}
+
+	SendJSON(w, http.StatusOK, models.AcquireResponse{
+		Allowed:     true,
+		Message:     "Request scheduled",
+		Degraded:    degraded,
+		ScheduledAt: &scheduledAt,
+		DelayMs:     &delayMs,
 	})
 }
 
 // SendRateLimited sends a rate limited response
-func SendRateLimited(w http.ResponseWriter, retryAfter *int) {
+func SendRateLimited(w http.ResponseWriter, retryAfter *int, degraded bool) {
+	markDegraded(w, degraded)
 	response := models.AcquireResponse{
-		Allowed: false,
-		Message: "Rate limit exceeded",
+		Allowed:  false,
+		Message:  "Rate limit exceeded",
+		Degraded: degraded,
 	}
 
 	if retryAfter != nil {
 		response.RetryAfter = retryAfter
-		w.Header().Set("Retry-After", string(rune(*retryAfter)))
+		w.Header().Set("Retry-After", strconv.Itoa(*retryAfter))
 	}
 
 	SendJSON(w, http.StatusTooManyRequests, response)
 }
+
+// SendBackendUnavailable sends a fail-closed response when the backend could not decide
+func SendBackendUnavailable(w http.ResponseWriter) {
+	markDegraded(w, true)
+	SendJSON(w, http.StatusServiceUnavailable, models.AcquireResponse{
+		Allowed:  false,
+		Message:  "Rate limiter unavailable",
+		Degraded: true,
+	})
+}
+
+// markDegraded sets the degraded header when the decision bypassed the backend
+func markDegraded(w http.ResponseWriter, degraded bool) {
+	if degraded {
+		w.Header().Set(DegradedHeader, "true")
+	}
+}